@@ -8,17 +8,75 @@ import (
 	"github.com/spf13/viper"
 )
 
+// DB configures the storage of users. Driver is postgres, the default, or
+// memory, which keeps users in the process and needs no database.
 type DB struct {
+	Driver   string
 	User     string
 	Password string
 	Host     string
 	Port     string
 	Name     string
+	Tx       Tx
+	Replicas Replicas
+}
+
+// Tx configures transactions started with TxManager.WithinTx. IsolationLevel
+// is read_committed, repeatable_read or serializable, empty keeps the server
+// default. Transactions failing on a serialization failure or a deadlock are
+// retried MaxRetries times, waiting RetryBackoff and then twice as long
+// before each next attempt.
+type Tx struct {
+	IsolationLevel string
+	MaxRetries     int
+	RetryBackoff   time.Duration
+}
+
+// Replicas lists the connection strings of read replicas. Reads go to the
+// healthy ones, checked every HealthInterval, except for sessions that wrote
+// within the last StickyWindow, which read from the primary.
+type Replicas struct {
+	DSNs           []string
+	StickyWindow   time.Duration
+	HealthInterval time.Duration
 }
 
 type Cache struct {
-	TTL             time.Duration
-	CleanerInterval time.Duration
+	TTL                time.Duration
+	TTLJitter          time.Duration
+	Expiration         string
+	CleanerInterval    time.Duration
+	MaxEntries         int
+	MaxBytes           int
+	Policy             string
+	NegativeTTL        time.Duration
+	NegativeMaxEntries int
+	Shards             int
+	Backend            string
+	Redis              Redis
+	Invalidation       Invalidation
+	RefreshAhead       time.Duration
+	StaleIfError       time.Duration
+	Snapshot           Snapshot
+}
+
+type Snapshot struct {
+	Path       string
+	MaxEntries int
+}
+
+type Invalidation struct {
+	Enabled    bool
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+type Redis struct {
+	Address  string
+	Password string
+	DB       int
+	PoolSize int
+	Timeout  time.Duration
 }
 
 type Log struct {
@@ -30,6 +88,57 @@ type Metrics struct {
 	SendInterval time.Duration
 }
 
+// Admin serves cache administration on its own port. It is off by default
+// and requires a Token when enabled.
+type Admin struct {
+	Enabled bool
+	Port    string
+	Token   string
+}
+
+// Preconditions controls conditional writes. When Required is set, updates
+// and deletes without an If-Match header are rejected.
+type Preconditions struct {
+	Required bool
+}
+
+// Batch limits the batch endpoints.
+type Batch struct {
+	MaxItems int
+}
+
+// Search configures GET /user/search. Limit is the default number of
+// results and MaxLimit the most a request may ask for.
+type Search struct {
+	MinSimilarity float64
+	Limit         int
+	MaxLimit      int
+}
+
+// Retention controls how long soft-deleted users are kept before they are
+// removed for good.
+type Retention struct {
+	Enabled  bool
+	Days     int
+	Interval time.Duration
+}
+
+// Outbox configures the relay publishing user events to Sink, log or http.
+// The http sink POSTs to URL and gives up on a delivery after Timeout. The
+// outbox is polled every Interval for up to BatchSize events, which are
+// leased for BatchSize times Timeout while they are published; failed events
+// are retried after MinBackoff, doubling up to MaxBackoff.
+type Outbox struct {
+	Enabled    bool
+	Sink       string
+	URL        string
+	Timeout    time.Duration
+	Interval   time.Duration
+	BatchSize  int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
 type Agent struct {
 	Host string
 	Port string
@@ -51,12 +160,18 @@ type Jaeger struct {
 }
 
 type App struct {
-	Name        string
-	Address     string
-	Environment string
-	Cache       Cache
-	Log         Log
-	Metrics     Metrics
+	Name          string
+	Address       string
+	Environment   string
+	Cache         Cache
+	Log           Log
+	Metrics       Metrics
+	Admin         Admin
+	Retention     Retention
+	Preconditions Preconditions
+	Batch         Batch
+	Search        Search
+	Outbox        Outbox
 }
 
 type Config struct {
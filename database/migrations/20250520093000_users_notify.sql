@@ -0,0 +1,30 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION notify_user_change() RETURNS trigger AS $$
+DECLARE
+    origin TEXT := current_setting('gateway.origin', true);
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('user_changes', json_build_object('id', OLD.id, 'origin', origin)::text);
+    ELSE
+        PERFORM pg_notify('user_changes', json_build_object('id', NEW.id, 'origin', origin)::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER users_notify_change
+    AFTER INSERT OR UPDATE OR DELETE ON users
+    FOR EACH ROW EXECUTE FUNCTION notify_user_change();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS users_notify_change ON users;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP FUNCTION IF EXISTS notify_user_change();
+-- +goose StatementEnd
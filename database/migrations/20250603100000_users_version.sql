@@ -0,0 +1,37 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1,
+    ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION bump_user_version() RETURNS trigger AS $$
+BEGIN
+    NEW.version := OLD.version + 1;
+    NEW.updated_at := now();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE TRIGGER users_bump_version
+    BEFORE UPDATE ON users
+    FOR EACH ROW EXECUTE FUNCTION bump_user_version();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS users_bump_version ON users;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP FUNCTION IF EXISTS bump_user_version();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE users
+    DROP COLUMN IF EXISTS updated_at,
+    DROP COLUMN IF EXISTS version;
+-- +goose StatementEnd
@@ -0,0 +1,57 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS users_created_at_id_idx ON users (created_at, id);
+-- +goose StatementEnd
+
+-- Rows with a NULL sort key would drop out of keyset pagination: a row
+-- comparison against NULL is never true.
+-- +goose StatementBegin
+UPDATE users SET name = '' WHERE name IS NULL;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+UPDATE users SET age = 0 WHERE age IS NULL;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE users
+    ALTER COLUMN name SET NOT NULL,
+    ALTER COLUMN age SET NOT NULL;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS users_name_id_idx ON users (name, id);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS users_age_id_idx ON users (age, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS users_age_id_idx;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP INDEX IF EXISTS users_name_id_idx;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE users
+    ALTER COLUMN name DROP NOT NULL,
+    ALTER COLUMN age DROP NOT NULL;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP INDEX IF EXISTS users_created_at_id_idx;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+ALTER TABLE users
+    DROP COLUMN IF EXISTS created_at;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING GIN (name gin_trgm_ops);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS users_name_fts_idx ON users USING GIN (to_tsvector('simple', coalesce(name, '')));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS users_name_fts_idx;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP INDEX IF EXISTS users_name_trgm_idx;
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+DROP EXTENSION IF EXISTS pg_trgm;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS user_audit (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL,
+    action VARCHAR(16) NOT NULL,
+    before JSONB,
+    after JSONB,
+    claimed_actor VARCHAR(255) NOT NULL,
+    request_id VARCHAR(255) NOT NULL DEFAULT '',
+    changed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+-- +goose StatementEnd
+
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS user_audit_user_id_id_idx ON user_audit (user_id, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS user_audit;
+-- +goose StatementEnd
@@ -7,12 +7,12 @@ import (
 	"syscall"
 
 	"github.com/dankru/Api_gateway_v2/config"
-	"github.com/dankru/Api_gateway_v2/database"
 	"github.com/dankru/Api_gateway_v2/internal/cache"
 	"github.com/dankru/Api_gateway_v2/internal/handler"
+	"github.com/dankru/Api_gateway_v2/internal/listener"
 	"github.com/dankru/Api_gateway_v2/internal/metrics"
-	"github.com/dankru/Api_gateway_v2/internal/repository"
-	"github.com/dankru/Api_gateway_v2/internal/storage"
+	"github.com/dankru/Api_gateway_v2/internal/outbox"
+	"github.com/dankru/Api_gateway_v2/internal/retention"
 	"github.com/dankru/Api_gateway_v2/internal/tracing"
 	"github.com/dankru/Api_gateway_v2/internal/usecase"
 	"github.com/dankru/Api_gateway_v2/logger"
@@ -39,20 +39,11 @@ func Run() error {
 		return errors.Wrap(err, "logger initialization failed")
 	}
 
-	connStr := cfg.GetConnStr()
-	if err := database.Migrate(connStr); err != nil {
-		log.Err(err).Msg("failed to migrate")
+	if cfg.App.Admin.Enabled && cfg.App.Admin.Token == "" {
+		log.Error().Msg("admin API is enabled without a token")
+		return errors.New("app.admin.token is required when app.admin.enabled is set")
 	}
 
-	log.Info().Msgf("initializing db connection: %s", connStr)
-	conn, err := storage.GetConnect(connStr)
-	if err != nil {
-		log.Error().Err(err).
-			Msg("failed to get db pool")
-		return errors.Wrap(err, "initializing db connection failed")
-	}
-	defer conn.Close()
-
 	tracerProvider, err := tracing.NewTracerProvider(cfg.App.Name, cfg.Jaeger.Collector.Endpoint, cfg.App.Environment)
 	if err != nil {
 		log.Error().Msg("failed to initialize jaeger")
@@ -60,16 +51,56 @@ func Run() error {
 	}
 	otel.SetTracerProvider(tracerProvider)
 
-	repo := repository.NewUserRepository(conn)
-	cacheDecorator := cache.NewCacheDecorator(repo, cfg.App.Cache.TTL)
-	uc := usecase.NewUserUsecase(cacheDecorator)
-	handle := handler.NewHandler(uc)
+	store, err := openUserStore(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	cacheDecorator, err := cache.NewCacheDecorator(store.repo, cfg.App.Cache)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to initialize cache")
+		return errors.Wrap(err, "cache initialization failed")
+	}
+	defer func() {
+		if err := cacheDecorator.Close(); err != nil {
+			log.Error().Err(err).Msg("failed to close cache")
+		}
+	}()
+	// A snapshot would bring back users the in-memory store no longer has.
+	if path := cfg.App.Cache.Snapshot.Path; path != "" && cfg.DB.Driver != driverMemory {
+		restored, err := cacheDecorator.LoadSnapshot(path)
+		if err != nil {
+			log.Err(err).Msgf("failed to load cache snapshot: %s", path)
+		} else {
+			log.Info().Msgf("restored %d cached users from snapshot: %s", restored, path)
+		}
+	}
+	uc := usecase.NewUserUsecase(cacheDecorator, store.tx)
+	handle := handler.NewHandler(uc, cfg.App)
 	//
 	cacheDecorator.StartCleaner(ctx, cfg.App.Cache.CleanerInterval)
+	if cfg.App.Cache.Invalidation.Enabled && store.connStr != "" {
+		listener.NewUserListener(store.connStr, store.origin, cacheDecorator, cfg.App.Cache.Invalidation).Start(ctx)
+	}
+	if cfg.App.Retention.Enabled {
+		retention.NewUserPurger(store.purger, cfg.App.Retention).Start(ctx)
+	}
+
+	var relay *outbox.Relay
+	if cfg.App.Outbox.Enabled && store.conn != nil {
+		sink, err := outbox.NewSink(cfg.App.Outbox)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to initialize outbox sink")
+			return errors.Wrap(err, "outbox sink initialization failed")
+		}
+		relay = outbox.NewRelay(store.conn, sink, cfg.App.Outbox)
+		relay.Start(ctx)
+	}
 
-	metrics.InitMetrics(cfg.App.Metrics.Port, cacheDecorator, cfg.Metrics.SendInterval)
+	metrics.InitMetrics(cfg.App.Metrics.Port, cacheDecorator, store.replicas, relay, cfg.Metrics.SendInterval)
 
-	router := newRouter(fiber.Config{AppName: cfg.App.Name}, handle)
+	router := newRouter(fiber.Config{AppName: cfg.App.Name, ErrorHandler: handler.ErrorHandler}, handle)
 	go func() {
 		log.Info().Msgf("listen and serve on: %s", cfg.App.Address)
 		if err := router.Listen(":" + cfg.App.Address); err != nil {
@@ -79,15 +110,42 @@ func Run() error {
 		}
 	}()
 
+	var adminRouter *fiber.App
+	if cfg.App.Admin.Enabled {
+		adminRouter = newAdminRouter(fiber.Config{AppName: cfg.App.Name + "_admin"}, cfg.App.Admin.Token, handler.NewAdminHandler(cacheDecorator))
+		go func() {
+			log.Info().Msgf("admin listen and serve on: %s", cfg.App.Admin.Port)
+			if err := adminRouter.Listen(":" + cfg.App.Admin.Port); err != nil {
+				log.Error().
+					Err(err).
+					Msgf("unable to listen and serve admin on %s", cfg.App.Admin.Port)
+			}
+		}()
+	}
+
 	<-stop
 	log.Info().Msg("shutting down gracefully")
 
 	cancel()
+	if adminRouter != nil {
+		if err := adminRouter.Shutdown(); err != nil {
+			log.Error().Err(err).Msg("error shutting down admin server")
+		}
+	}
 	if err := router.Shutdown(); err != nil {
 		log.Error().Err(err).Msg("error shutting down server")
 		return errors.Wrap(err, "server shutdown failed")
 	}
 
+	if path := cfg.App.Cache.Snapshot.Path; path != "" {
+		saved, err := cacheDecorator.SaveSnapshot(path, cfg.App.Cache.Snapshot.MaxEntries)
+		if err != nil {
+			log.Err(err).Msgf("failed to save cache snapshot: %s", path)
+		} else {
+			log.Info().Msgf("saved %d cached users to snapshot: %s", saved, path)
+		}
+	}
+
 	log.Info().Msg("server stopped gracefully")
 
 	return nil
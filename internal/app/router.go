@@ -1,12 +1,19 @@
 package app
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/dankru/Api_gateway_v2/internal/audit"
 	"github.com/dankru/Api_gateway_v2/internal/handler"
 	"github.com/dankru/Api_gateway_v2/internal/metrics"
+	"github.com/dankru/Api_gateway_v2/internal/repository"
 	"github.com/gofiber/contrib/otelfiber"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/rs/zerolog/log"
 )
 
@@ -16,16 +23,27 @@ func newRouter(config fiber.Config, handler *handler.Handler) *fiber.App {
 	user := app.Group("/user")
 
 	user.Use(metrics.PrometheusMiddleware())
+	user.Use(requestid.New())
+	user.Use(auditSource)
+	user.Use(readYourWrites)
 	user.Use(otelfiber.Middleware(
 		otelfiber.WithSpanNameFormatter(func(ctx *fiber.Ctx) string {
 			return fmt.Sprintf("%s %s", ctx.Method(), ctx.Path())
 		}),
 	))
 
+	user.Post("/batch", handler.CreateUsers)
+	user.Post("/batch/get", handler.GetUsers)
+	user.Post("/batch/delete", handler.DeleteUsers)
+	user.Get("/", handler.ListUsers)
+	user.Get("/search", handler.SearchUsers)
 	user.Get("/:id", handler.GetUser)
 	user.Put("/:id", handler.ReplaceUser)
+	user.Patch("/:id", handler.PatchUser)
 	user.Post("/", handler.CreateUser)
 	user.Delete("/:id", handler.DeleteUser)
+	user.Post("/:id/restore", handler.RestoreUser)
+	user.Get("/:id/history", handler.GetUserHistory)
 
 	routes := app.GetRoutes()
 	for _, route := range routes {
@@ -34,3 +52,87 @@ func newRouter(config fiber.Config, handler *handler.Handler) *fiber.App {
 
 	return app
 }
+
+// actorHeader names the actor the client claims to act for. It is not
+// authenticated: the audit trail records it as claimed and nothing relies on
+// it to identify the client.
+const actorHeader = "X-Actor"
+
+// auditSource passes the claimed actor and the request id down to the
+// repository, which records them with every change.
+func auditSource(ctx *fiber.Ctx) error {
+	requestID, _ := ctx.Locals("requestid").(string)
+	ctx.SetUserContext(audit.NewContext(ctx.UserContext(), audit.Source{
+		ClaimedActor: ctx.Get(actorHeader),
+		RequestID:    requestID,
+	}))
+	return ctx.Next()
+}
+
+// lastWriteCookie carries the time of the client's last write, in Unix
+// nanoseconds, so that its reads go to the primary until the replicas catch
+// up.
+const lastWriteCookie = "last_write"
+
+// readYourWrites starts the read-your-writes session of the request from its
+// cookie and hands the cookie back when the request wrote.
+func readYourWrites(ctx *fiber.Ctx) error {
+	var lastWrite time.Time
+	if nanos, err := strconv.ParseInt(ctx.Cookies(lastWriteCookie), 10, 64); err == nil && nanos > 0 {
+		lastWrite = time.Unix(0, nanos)
+	}
+	userCtx, session := repository.WithSession(ctx.UserContext(), lastWrite)
+	ctx.SetUserContext(userCtx)
+
+	err := ctx.Next()
+	if wrote := session.LastWrite(); wrote.After(lastWrite) {
+		ctx.Cookie(&fiber.Cookie{
+			Name:     lastWriteCookie,
+			Value:    strconv.FormatInt(wrote.UnixNano(), 10),
+			HTTPOnly: true,
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+	}
+	return err
+}
+
+// adminTokenHeader carries the token configured in app.admin.token.
+const adminTokenHeader = "X-Admin-Token"
+
+// newAdminRouter serves cache administration. Every request is logged, and
+// requests without the token are rejected.
+func newAdminRouter(config fiber.Config, token string, handler *handler.AdminHandler) *fiber.App {
+	app := fiber.New(config)
+	log.Info().Msg("Initializing admin routes")
+
+	app.Use(func(ctx *fiber.Ctx) error {
+		if token == "" || subtle.ConstantTimeCompare([]byte(ctx.Get(adminTokenHeader)), []byte(token)) != 1 {
+			log.Warn().Msgf("rejected admin request: %s %s from %s", ctx.Method(), ctx.OriginalURL(), ctx.IP())
+			return fiber.NewError(http.StatusUnauthorized)
+		}
+
+		err := ctx.Next()
+		log.Info().Err(err).Msgf("admin request: %s %s from %s", ctx.Method(), ctx.OriginalURL(), ctx.IP())
+		return err
+	})
+	app.Use(otelfiber.Middleware(
+		otelfiber.WithSpanNameFormatter(func(ctx *fiber.Ctx) string {
+			return fmt.Sprintf("%s %s", ctx.Method(), ctx.Path())
+		}),
+	))
+
+	cache := app.Group("/cache")
+	cache.Get("/keys", handler.ListKeys)
+	cache.Get("/keys/:id", handler.GetEntry)
+	cache.Delete("/keys/:id", handler.PurgeEntry)
+	cache.Delete("/keys", handler.PurgePrefix)
+	cache.Delete("/", handler.Flush)
+	cache.Get("/settings", handler.GetSettings)
+	cache.Put("/settings", handler.UpdateSettings)
+
+	for _, route := range app.GetRoutes() {
+		log.Info().Msgf("Initialized admin route: %s [%s]", route.Path, route.Method)
+	}
+
+	return app
+}
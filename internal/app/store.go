@@ -0,0 +1,95 @@
+package app
+
+import (
+	"context"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/database"
+	"github.com/dankru/Api_gateway_v2/internal/repository"
+	"github.com/dankru/Api_gateway_v2/internal/retention"
+	"github.com/dankru/Api_gateway_v2/internal/storage"
+	"github.com/dankru/Api_gateway_v2/internal/usecase"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Storage drivers accepted in db.driver.
+const (
+	driverPostgres = "postgres"
+	driverMemory   = "memory"
+)
+
+// userStore is the storage of users picked by db.driver.
+type userStore struct {
+	repo   repository.UserProvider
+	purger retention.Purger
+	tx     usecase.Transactor
+	// conn, replicas, connStr and origin are set for Postgres only. Without
+	// them there are no change notifications to invalidate the cache with
+	// and no outbox to relay events from. origin names the writes of this
+	// gateway in the notifications.
+	conn     *pgxpool.Pool
+	replicas *repository.ReplicaRouter
+	connStr  string
+	origin   string
+	closers  []func()
+}
+
+func openUserStore(ctx context.Context, cfg *config.Config) (*userStore, error) {
+	switch cfg.DB.Driver {
+	case driverMemory:
+		log.Warn().Msg("using in-memory storage, users are lost on restart")
+		repo := repository.NewMemoryRepository()
+		return &userStore{repo: repo, purger: repo, tx: repo}, nil
+	case "", driverPostgres:
+		return openPostgresStore(ctx, cfg)
+	default:
+		return nil, errors.Errorf("unknown db driver %q", cfg.DB.Driver)
+	}
+}
+
+func openPostgresStore(ctx context.Context, cfg *config.Config) (*userStore, error) {
+	connStr := cfg.GetConnStr()
+	if err := database.Migrate(connStr); err != nil {
+		log.Err(err).Msg("failed to migrate")
+	}
+
+	log.Info().Msgf("initializing db connection: %s", connStr)
+	origin := uuid.NewString()
+	conn, err := storage.GetOriginConnect(connStr, origin)
+	if err != nil {
+		log.Error().Err(err).
+			Msg("failed to get db pool")
+		return nil, errors.Wrap(err, "initializing db connection failed")
+	}
+	store := &userStore{conn: conn, connStr: connStr, origin: origin, closers: []func(){conn.Close}}
+
+	replicas, err := repository.NewReplicaRouter(conn, cfg.DB.Replicas, storage.GetLazyConnect)
+	if err != nil {
+		store.Close()
+		log.Error().Err(err).Msg("failed to initialize replica pools")
+		return nil, errors.Wrap(err, "initializing replica pools failed")
+	}
+	store.closers = append(store.closers, replicas.Close)
+	replicas.Start(ctx)
+
+	txManager, err := repository.NewTxManager(conn, cfg.DB.Tx)
+	if err != nil {
+		store.Close()
+		log.Error().Err(err).Msg("failed to initialize transaction manager")
+		return nil, errors.Wrap(err, "transaction manager initialization failed")
+	}
+
+	repo := repository.NewUserRepository(conn, replicas)
+	store.repo, store.purger, store.tx, store.replicas = repo, repo, txManager, replicas
+	return store, nil
+}
+
+// Close releases the connections, the last opened first.
+func (s *userStore) Close() {
+	for i := len(s.closers) - 1; i >= 0; i-- {
+		s.closers[i]()
+	}
+}
@@ -1,7 +1,69 @@
 package apperr
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
 
 var (
-	ErrNotFound = errors.New("not found")
+	ErrNotFound        = errors.New("not found")
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrPreconditionFailed is returned by writes that expected another
+	// version of the entity.
+	ErrPreconditionFailed = errors.New("precondition failed")
+	// ErrConflict is returned by writes that clash with data already stored,
+	// such as a duplicate key.
+	ErrConflict = errors.New("conflict")
+	// ErrValidation is returned by writes the database rejects as invalid.
+	ErrValidation = errors.New("validation failed")
+	// ErrUnavailable is returned when the database cannot be reached or does
+	// not answer in time. The same call may succeed later.
+	ErrUnavailable = errors.New("unavailable")
 )
+
+// DBError is a database failure classified as ErrConflict, ErrValidation or
+// ErrUnavailable. errors.Is matches it against its Kind, and the driver error
+// stays reachable through errors.As.
+type DBError struct {
+	Kind error
+	// Constraint names the violated constraint, empty when there is none.
+	Constraint string
+	Err        error
+}
+
+func (e *DBError) Error() string {
+	if e.Constraint != "" {
+		return fmt.Sprintf("%s: constraint %s: %v", e.Kind, e.Constraint, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Kind, e.Err)
+}
+
+func (e *DBError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+// Rejected reports whether err is the database refusing the data of a write,
+// as opposed to failing to run it. Retrying a rejected write does not help.
+func Rejected(err error) bool {
+	return errors.Is(err, ErrConflict) || errors.Is(err, ErrValidation)
+}
+
+// BatchItemError is the failure of one item of a batch write, Index is the
+// position of the item in the batch.
+type BatchItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchItemError) Error() string {
+	return fmt.Sprintf("item %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchItemError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,34 @@
+// Package audit carries the origin of a request down to the repository, which
+// records it next to every change of a user.
+package audit
+
+import "context"
+
+// AnonymousActor is recorded for requests that do not claim an actor.
+const AnonymousActor = "anonymous"
+
+// Source describes the origin of a change. The gateway does not
+// authenticate callers, so ClaimedActor is whatever the client says it is: it
+// is kept for the record and must not be used to identify anyone.
+type Source struct {
+	ClaimedActor string
+	RequestID    string
+}
+
+type sourceKey struct{}
+
+// NewContext returns a context carrying source.
+func NewContext(ctx context.Context, source Source) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// FromContext returns the source carried by ctx. Changes made outside a
+// request, for example by background jobs, have an anonymous actor and no
+// request id.
+func FromContext(ctx context.Context) Source {
+	source, ok := ctx.Value(sourceKey{}).(Source)
+	if !ok || source.ClaimedActor == "" {
+		source.ClaimedActor = AnonymousActor
+	}
+	return source
+}
@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"context"
+	"maps"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// KeyInfo describes a cached entry without its value.
+type KeyInfo struct {
+	ID        string
+	StoredAt  time.Time
+	ExpiredAt time.Time
+}
+
+// Keys lists cached ids starting with prefix, sorted by id.
+func (cache *ReadThrough[K, V]) Keys(ctx context.Context, prefix string) ([]KeyInfo, error) {
+	ids, err := cache.backend.Keys(ctx, prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list cache keys")
+	}
+	sort.Strings(ids)
+
+	// Entries in process memory are peeked, the rest is read from the
+	// backend at once.
+	entries := make(map[string]Entry[V], len(ids))
+	var remote []string
+	local, isLocal := cache.backend.(localStore[V])
+	for _, id := range ids {
+		if isLocal {
+			if entry, exists := local.peek(id); exists {
+				entries[id] = entry
+				continue
+			}
+		}
+		remote = append(remote, id)
+	}
+	if len(remote) > 0 {
+		fetched, err := cache.backend.GetMany(ctx, remote)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get cached %s entries", cache.name)
+		}
+		maps.Copy(entries, fetched)
+	}
+
+	keys := make([]KeyInfo, 0, len(ids))
+	for _, id := range ids {
+		entry, exists := entries[id]
+		if !exists {
+			continue
+		}
+		keys = append(keys, KeyInfo{ID: id, StoredAt: entry.StoredAt, ExpiredAt: entry.ExpiredAt})
+	}
+	return keys, nil
+}
+
+// Peek returns the cached entry for id. Entries kept in process memory are
+// read without renewing their TTL or counting as an access.
+func (cache *ReadThrough[K, V]) Peek(ctx context.Context, key K) (Entry[V], bool, error) {
+	if local, ok := cache.backend.(localStore[V]); ok {
+		if entry, exists := local.peek(string(key)); exists {
+			entry.Value = cache.clone(entry.Value)
+			return entry, true, nil
+		}
+	}
+
+	entry, exists, err := cache.backend.Get(ctx, string(key))
+	if err != nil {
+		return Entry[V]{}, false, errors.Wrapf(err, "failed to get cached %s: %s", cache.name, key)
+	}
+	entry.Value = cache.clone(entry.Value)
+	return entry, exists, nil
+}
+
+// Purge drops key from the backend and the negative cache.
+func (cache *ReadThrough[K, V]) Purge(ctx context.Context, key K) error {
+	if err := cache.backend.Delete(ctx, string(key)); err != nil {
+		return errors.Wrapf(err, "failed to purge cached %s: %s", cache.name, key)
+	}
+	cache.missing.remove(string(key))
+	return nil
+}
+
+// PurgePrefix drops every id starting with prefix and returns how many
+// entries were dropped.
+func (cache *ReadThrough[K, V]) PurgePrefix(ctx context.Context, prefix string) (int, error) {
+	ids, err := cache.backend.Keys(ctx, prefix)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list cache keys")
+	}
+
+	for i, id := range ids {
+		if err := cache.Purge(ctx, K(id)); err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
+
+// Flush drops every cached entry, including negative ones, and returns how
+// many entries were dropped.
+func (cache *ReadThrough[K, V]) Flush(ctx context.Context) (int, error) {
+	purged, err := cache.PurgePrefix(ctx, "")
+	if err != nil {
+		return purged, err
+	}
+	cache.FlushLocal()
+	return purged, nil
+}
+
+// TTL returns the lifetime given to new and renewed entries.
+func (cache *ReadThrough[K, V]) TTL() time.Duration {
+	return cache.ttl.get()
+}
+
+// SetTTL changes the lifetime of entries stored from now on, entries already
+// in the cache keep their expiration until they are renewed.
+func (cache *ReadThrough[K, V]) SetTTL(ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.Errorf("ttl must be positive, got %s", ttl)
+	}
+	cache.ttl.set(ttl)
+	return nil
+}
+
+// CleanerInterval returns how often the cleaner drops expired entries, zero
+// if the cleaner is not running.
+func (cache *ReadThrough[K, V]) CleanerInterval() time.Duration {
+	return time.Duration(cache.cleanerInterval.Load())
+}
+
+// SetCleanerInterval changes the period of a running cleaner.
+func (cache *ReadThrough[K, V]) SetCleanerInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.Errorf("cleaner interval must be positive, got %s", interval)
+	}
+	if cache.CleanerInterval() == 0 {
+		return errors.New("cache cleaner is not running")
+	}
+
+	cache.cleanerInterval.Store(int64(interval))
+	// Only the latest interval matters: replace a reset the cleaner has not
+	// picked up yet instead of waiting for it, the cleaner may have stopped.
+	for {
+		select {
+		case cache.cleanerReset <- interval:
+			return nil
+		default:
+		}
+		select {
+		case <-cache.cleanerReset:
+		default:
+		}
+	}
+}
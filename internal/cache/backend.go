@@ -0,0 +1,250 @@
+package cache
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	BackendMemory  = "memory"
+	BackendRedis   = "redis"
+	BackendLayered = "layered"
+)
+
+// Entry is a cached value together with its version and the moments it was
+// stored and stops being fresh.
+type Entry[V any] struct {
+	Value     V
+	Version   int64
+	StoredAt  time.Time
+	ExpiredAt time.Time
+}
+
+func (e Entry[V]) fresh(now time.Time) bool {
+	return now.Before(e.ExpiredAt)
+}
+
+// Backend stores cached values. Get may return entries that are no longer
+// fresh but still inside the stale grace period, it is up to the caller to
+// decide whether to serve them. GetMany is Get for several ids at once, ids
+// that are not stored are left out. Set keeps an entry with a higher
+// version than the given one. Keys lists stored ids starting with prefix.
+type Backend[V any] interface {
+	Get(ctx context.Context, id string) (Entry[V], bool, error)
+	GetMany(ctx context.Context, ids []string) (map[string]Entry[V], error)
+	Set(ctx context.Context, id string, value V, version int64) error
+	Delete(ctx context.Context, id string) error
+	Keys(ctx context.Context, prefix string) ([]string, error)
+}
+
+// ttlValue is the entry TTL shared by the decorator and its backend, it can
+// be changed while the cache is in use.
+type ttlValue struct {
+	nanos  atomic.Int64
+	jitter time.Duration
+}
+
+func newTTLValue(ttl, jitter time.Duration) *ttlValue {
+	v := &ttlValue{jitter: jitter}
+	v.set(ttl)
+	return v
+}
+
+func (v *ttlValue) get() time.Duration {
+	return time.Duration(v.nanos.Load())
+}
+
+// entry returns the TTL for one stored entry. A random jitter is added, so
+// entries loaded together do not all expire together.
+func (v *ttlValue) entry() time.Duration {
+	if v.jitter <= 0 {
+		return v.get()
+	}
+	return v.get() + rand.N(v.jitter)
+}
+
+func (v *ttlValue) set(ttl time.Duration) {
+	v.nanos.Store(int64(ttl))
+}
+
+// localStore is implemented by backends that keep entries in process memory
+// and therefore need the cleaner and can report their size.
+type localStore[V any] interface {
+	invalidateExpired(t time.Time)
+	peek(id string) (Entry[V], bool)
+	entries() []snapshotEntry[V]
+	restore(id string, entry Entry[V])
+	evictLocal(id string)
+	flush()
+	stats() storeStats
+}
+
+type storeStats struct {
+	elementCount    int
+	sizeBytes       int
+	evictionCount   int
+	expirationCount int
+}
+
+func (s storeStats) add(other storeStats) storeStats {
+	return storeStats{
+		elementCount:    s.elementCount + other.elementCount,
+		sizeBytes:       s.sizeBytes + other.sizeBytes,
+		evictionCount:   s.evictionCount + other.evictionCount,
+		expirationCount: s.expirationCount + other.expirationCount,
+	}
+}
+
+// newBackend creates the backend selected in cfg. The name of the cache
+// separates its keys from other caches sharing the same server.
+func newBackend[V any](name string, cfg config.Cache, ttl *ttlValue, size Sizer[V]) (Backend[V], error) {
+	switch cfg.Backend {
+	case "", BackendMemory:
+		return newMemoryBackend(cfg, ttl, size)
+	case BackendRedis:
+		return newRESPBackend[V](cfg.Redis, name, ttl, cfg.StaleIfError), nil
+	case BackendLayered:
+		local, err := newMemoryBackend(cfg, ttl, size)
+		if err != nil {
+			return nil, err
+		}
+		return newLayeredBackend(local, newRESPBackend[V](cfg.Redis, name, ttl, cfg.StaleIfError)), nil
+	default:
+		return nil, errors.Errorf("unknown cache backend: %s", cfg.Backend)
+	}
+}
+
+// layeredBackend puts a process local L1 in front of a shared L2. Reads
+// that miss L1 but find a fresh entry in L2 are copied into L1, writes go to
+// both. A stale L1 entry is still returned when L2 has nothing better.
+type layeredBackend[V any] struct {
+	l1 *memoryBackend[V]
+	l2 Backend[V]
+}
+
+func newLayeredBackend[V any](l1 *memoryBackend[V], l2 Backend[V]) *layeredBackend[V] {
+	return &layeredBackend[V]{l1: l1, l2: l2}
+}
+
+func (l *layeredBackend[V]) Get(ctx context.Context, id string) (Entry[V], bool, error) {
+	now := time.Now()
+	local, localExists, _ := l.l1.Get(ctx, id)
+	if localExists && local.fresh(now) {
+		return local, true, nil
+	}
+
+	shared, sharedExists, err := l.l2.Get(ctx, id)
+	if err == nil && sharedExists {
+		if shared.fresh(now) {
+			_ = l.l1.Set(ctx, id, shared.Value, shared.Version)
+		}
+		return shared, true, nil
+	}
+	if localExists {
+		if err != nil {
+			logBackendErr(err, "get", id)
+		}
+		return local, true, nil
+	}
+	return Entry[V]{}, false, err
+}
+
+// GetMany serves fresh L1 entries and reads the rest from L2 at once. Stale
+// L1 entries are kept for the ids L2 does not have.
+func (l *layeredBackend[V]) GetMany(ctx context.Context, ids []string) (map[string]Entry[V], error) {
+	now := time.Now()
+	local, _ := l.l1.GetMany(ctx, ids)
+	var misses []string
+	for _, id := range ids {
+		if entry, exists := local[id]; !exists || !entry.fresh(now) {
+			misses = append(misses, id)
+		}
+	}
+	if len(misses) == 0 {
+		return local, nil
+	}
+
+	shared, err := l.l2.GetMany(ctx, misses)
+	if err != nil {
+		if len(local) == 0 {
+			return nil, err
+		}
+		log.Warn().Err(err).Msgf("cache backend get failed for %d keys", len(misses))
+		return local, nil
+	}
+	for id, entry := range shared {
+		if entry.fresh(now) {
+			_ = l.l1.Set(ctx, id, entry.Value, entry.Version)
+		}
+		local[id] = entry
+	}
+	return local, nil
+}
+
+func (l *layeredBackend[V]) Set(ctx context.Context, id string, value V, version int64) error {
+	_ = l.l1.Set(ctx, id, value, version)
+	return l.l2.Set(ctx, id, value, version)
+}
+
+func (l *layeredBackend[V]) Delete(ctx context.Context, id string) error {
+	_ = l.l1.Delete(ctx, id)
+	return l.l2.Delete(ctx, id)
+}
+
+// Keys merges the ids found in both layers.
+func (l *layeredBackend[V]) Keys(ctx context.Context, prefix string) ([]string, error) {
+	local, _ := l.l1.Keys(ctx, prefix)
+	shared, err := l.l2.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{}, len(shared))
+	for _, id := range shared {
+		seen[id] = struct{}{}
+	}
+	for _, id := range local {
+		if _, ok := seen[id]; !ok {
+			shared = append(shared, id)
+		}
+	}
+	return shared, nil
+}
+
+func (l *layeredBackend[V]) peek(id string) (Entry[V], bool) {
+	return l.l1.peek(id)
+}
+
+func (l *layeredBackend[V]) entries() []snapshotEntry[V] {
+	return l.l1.entries()
+}
+
+func (l *layeredBackend[V]) restore(id string, entry Entry[V]) {
+	l.l1.restore(id, entry)
+}
+
+func (l *layeredBackend[V]) invalidateExpired(t time.Time) {
+	l.l1.invalidateExpired(t)
+}
+
+func (l *layeredBackend[V]) evictLocal(id string) {
+	l.l1.evictLocal(id)
+}
+
+func (l *layeredBackend[V]) flush() {
+	l.l1.flush()
+}
+
+func (l *layeredBackend[V]) stats() storeStats {
+	return l.l1.stats()
+}
+
+func logBackendErr(err error, op, id string) {
+	log.Warn().Err(err).Msgf("cache backend %s failed for key: %s", op, id)
+}
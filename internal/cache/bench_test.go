@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/google/uuid"
+)
+
+const benchKeys = 1024
+
+// singleMapCache reproduces the storage the decorator used before sharding:
+// one map behind one RWMutex, with every hit taking the write lock to renew
+// the expiration.
+type singleMapCache struct {
+	mu    sync.RWMutex
+	users map[string]singleMapEntry
+	ttl   time.Duration
+}
+
+type singleMapEntry struct {
+	user      *models.User
+	expiredAt time.Time
+}
+
+func (c *singleMapCache) get(id string) (*models.User, bool) {
+	c.mu.RLock()
+	entry, exists := c.users[id]
+	c.mu.RUnlock()
+	if !exists {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	entry.expiredAt = time.Now().Add(c.ttl)
+	c.users[id] = entry
+	c.mu.Unlock()
+	return entry.user, true
+}
+
+func (c *singleMapCache) set(user *models.User, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.users[id] = singleMapEntry{user: user, expiredAt: time.Now().Add(c.ttl)}
+}
+
+func benchIDs() []string {
+	ids := make([]string, benchKeys)
+	for i := range ids {
+		ids[i] = uuid.NewString()
+	}
+	return ids
+}
+
+func BenchmarkSingleMap_GetParallel(b *testing.B) {
+	ids := benchIDs()
+	cache := &singleMapCache{users: make(map[string]singleMapEntry), ttl: time.Minute}
+	for _, id := range ids {
+		cache.set(&models.User{Name: id}, id)
+	}
+
+	var worker atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(worker.Add(1)) * 7919
+		for pb.Next() {
+			cache.get(ids[i%benchKeys])
+			i++
+		}
+	})
+}
+
+func BenchmarkCacheDecorator_GetUserParallel(b *testing.B) {
+	for _, shards := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			ids := benchIDs()
+			cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute, Shards: shards})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, id := range ids {
+				cache.set(context.Background(), &models.User{Name: id}, id)
+			}
+
+			var worker atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := context.Background()
+				i := int(worker.Add(1)) * 7919
+				for pb.Next() {
+					if _, err := cache.GetUser(ctx, ids[i%benchKeys]); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkCacheDecorator_MixedParallel(b *testing.B) {
+	for _, shards := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			ids := benchIDs()
+			cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute, Shards: shards})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, id := range ids {
+				cache.set(context.Background(), &models.User{Name: id}, id)
+			}
+
+			var worker atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := context.Background()
+				i := int(worker.Add(1)) * 7919
+				for pb.Next() {
+					id := ids[i%benchKeys]
+					if i%10 == 0 {
+						cache.set(ctx, &models.User{Name: id}, id)
+					} else {
+						cache.get(ctx, id)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -2,161 +2,197 @@ package cache
 
 import (
 	"context"
-	"sync"
-	"time"
 	"unsafe"
 
+	"github.com/dankru/Api_gateway_v2/config"
 	"github.com/dankru/Api_gateway_v2/internal/models"
 	"github.com/dankru/Api_gateway_v2/internal/repository"
 	"github.com/google/uuid"
-	"github.com/rs/zerolog/log"
 )
 
-type wrapUser struct {
-	user      *models.User
-	expiredAt time.Time
-}
+// userCacheName prefixes user keys in shared backends.
+const userCacheName = "user"
 
+// CacheDecorator puts a read-through cache in front of a UserProvider. Writes
+// made within a transaction reach the cache once it is committed.
 type CacheDecorator struct {
+	*ReadThrough[string, *models.User]
 	repo repository.UserProvider
-
-	mu    sync.RWMutex
-	users map[string]wrapUser
-
-	sizeBytes    int
-	elementCount int
-	cacheTTL     time.Duration
 }
 
-func NewCacheDecorator(repo repository.UserProvider, cacheTTL time.Duration) *CacheDecorator {
-	return &CacheDecorator{
-		repo:     repo,
-		mu:       sync.RWMutex{},
-		users:    make(map[string]wrapUser, 100),
-		cacheTTL: cacheTTL,
+func NewCacheDecorator(repo repository.UserProvider, cfg config.Cache) (*CacheDecorator, error) {
+	var source Loader[string, *models.User]
+	if repo != nil {
+		source = repo.GetUser
 	}
-}
 
-func (cache *CacheDecorator) StartCleaner(ctx context.Context, cleanerInterval time.Duration) {
-	ticker := time.NewTicker(cleanerInterval)
-
-	go func() {
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				log.Info().Msg("cache cleaner shutting down...")
-				return
-			case t := <-ticker.C:
-				cache.invalidateExpired(t)
-			}
-		}
-	}()
-}
-
-func (cache *CacheDecorator) invalidateExpired(t time.Time) {
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
-	for id, wrap := range cache.users {
-		if wrap.expiredAt.Before(t) {
-			log.Info().Msgf("invalidating expired user: %s", wrap.user.ID)
-			cache.decrementCacheMetrics(wrap)
-			delete(cache.users, id)
-		}
+	readThrough, err := NewReadThrough(userCacheName, source, cfg, Options[*models.User]{
+		Size:    getUserSize,
+		Version: getUserVersion,
+		Clone:   cloneUser,
+	})
+	if err != nil {
+		return nil, err
 	}
+	return &CacheDecorator{ReadThrough: readThrough, repo: repo}, nil
 }
 
-func (cache *CacheDecorator) get(id string) (wrapUser, bool) {
-	cache.mu.RLock()
-	defer cache.mu.RUnlock()
-	wrap, exists := cache.users[id]
-	return wrap, exists
+// getUserSize estimates the memory held by a cached user: the struct it
+// points to and the bytes behind its strings.
+func getUserSize(u *models.User) int {
+	return int(unsafe.Sizeof(*u)) + len(u.Name) + len(u.PasswordHash)
 }
 
-func (cache *CacheDecorator) set(user *models.User, id string) {
-	wrap := wrapUser{user, time.Now().Add(cache.cacheTTL)}
-
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
-	cache.users[id] = wrap
-	cache.incrementCacheMetrics(wrap)
+func getUserVersion(u *models.User) int64 {
+	return u.Version
 }
 
-func (cache *CacheDecorator) renewExpiredAt(id string) {
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
-	if wrap, exists := cache.users[id]; exists {
-		wrap.expiredAt = time.Now().Add(cache.cacheTTL)
-		cache.users[id] = wrap
+func cloneUser(u *models.User) *models.User {
+	if u == nil {
+		return nil
 	}
+	clone := *u
+	return &clone
 }
 
+// GetUser reads through the cache. Within a transaction the repository is
+// read directly: the transaction may see writes that are not committed yet,
+// and its connection must not be shared with loads of other requests.
 func (cache *CacheDecorator) GetUser(ctx context.Context, id string) (*models.User, error) {
-	wrap, exists := cache.get(id)
-	if exists {
-		cache.renewExpiredAt(id)
-		return wrap.user, nil
+	if repository.InTx(ctx) {
+		return cache.repo.GetUser(ctx, id)
+	}
+	return cache.Get(ctx, id)
+}
+
+func (cache *CacheDecorator) CreateUser(ctx context.Context, userReq models.UserRequest) (uuid.UUID, error) {
+	id, err := cache.repo.CreateUser(ctx, userReq)
+	if err != nil {
+		return id, err
 	}
+	repository.AfterCommit(ctx, cache.ForgetMissing)
+	return id, nil
+}
 
-	user, err := cache.repo.GetUser(ctx, id)
+func (cache *CacheDecorator) UpdateUser(ctx context.Context, id string, userReq models.UserRequest, version int64) (*models.User, error) {
+	user, err := cache.repo.UpdateUser(ctx, id, userReq, version)
 	if err != nil {
 		return user, err
 	}
-	cache.set(user, id)
-
+	repository.AfterCommit(ctx, func() { cache.Store(ctx, id, user) })
 	return user, nil
 }
 
-func (cache *CacheDecorator) CreateUser(ctx context.Context, userReq models.UserRequest) (uuid.UUID, error) {
-	return cache.repo.CreateUser(ctx, userReq)
-}
-
-func (cache *CacheDecorator) UpdateUser(ctx context.Context, id string, userReq models.UserRequest) (*models.User, error) {
-	user, err := cache.repo.UpdateUser(ctx, id, userReq)
+func (cache *CacheDecorator) PatchUser(ctx context.Context, id string, patch models.UserPatch, version int64) (*models.User, error) {
+	user, err := cache.repo.PatchUser(ctx, id, patch, version)
 	if err != nil {
 		return user, err
 	}
-	cache.set(user, id)
+	repository.AfterCommit(ctx, func() { cache.Store(ctx, id, user) })
 	return user, nil
 }
 
-func (cache *CacheDecorator) DeleteUser(ctx context.Context, id string) error {
-	if err := cache.repo.DeleteUser(ctx, id); err != nil {
+// DeleteUser soft-deletes the user. Deleted users are not found, so the
+// entry is dropped and the id is remembered in the negative cache.
+func (cache *CacheDecorator) DeleteUser(ctx context.Context, id string, version int64) error {
+	if err := cache.repo.DeleteUser(ctx, id, version); err != nil {
 		return err
 	}
 
-	cache.mu.Lock()
-	defer cache.mu.Unlock()
-	cache.decrementCacheMetrics(cache.users[id])
-	delete(cache.users, id)
+	repository.AfterCommit(ctx, func() { cache.Evict(ctx, id) })
 
 	return nil
 }
 
-func (cache *CacheDecorator) incrementCacheMetrics(u wrapUser) {
-	cache.elementCount++
-	cache.sizeBytes += cache.getWrapUserSize(u)
+// RestoreUser undeletes the user and caches it right away.
+func (cache *CacheDecorator) RestoreUser(ctx context.Context, id string) (*models.User, error) {
+	user, err := cache.repo.RestoreUser(ctx, id)
+	if err != nil {
+		return user, err
+	}
+	repository.AfterCommit(ctx, func() { cache.Store(ctx, id, user) })
+	return user, nil
+}
+
+// ListUsers is not cached, pages depend on the query and go stale as soon as
+// any user changes.
+func (cache *CacheDecorator) ListUsers(ctx context.Context, query models.UserListQuery) (models.UserPage, error) {
+	return cache.repo.ListUsers(ctx, query)
+}
+
+// SearchUsers is not cached for the same reason as ListUsers.
+func (cache *CacheDecorator) SearchUsers(ctx context.Context, query models.UserSearchQuery) ([]*models.User, error) {
+	return cache.repo.SearchUsers(ctx, query)
 }
 
-func (cache *CacheDecorator) decrementCacheMetrics(u wrapUser) {
-	cache.elementCount--
-	cache.sizeBytes -= cache.getWrapUserSize(u)
+// GetUserHistory is not cached, it grows with every change of the user.
+func (cache *CacheDecorator) GetUserHistory(ctx context.Context, id string, query models.UserHistoryQuery) (models.UserHistoryPage, error) {
+	return cache.repo.GetUserHistory(ctx, id, query)
 }
 
-func (cache *CacheDecorator) getWrapUserSize(u wrapUser) int {
-	size := int(unsafe.Sizeof(u)) + int(unsafe.Sizeof(u.user.ID)) + int(unsafe.Sizeof(u.user.Name)) + int(unsafe.Sizeof(u.user.Age)) + int(unsafe.Sizeof(u.user.Anonymous)) + int(unsafe.Sizeof(u.user.PasswordHash))
-	return size
+func (cache *CacheDecorator) CreateUsers(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, error) {
+	ids, err := cache.repo.CreateUsers(ctx, userReqs)
+	if err != nil {
+		return ids, err
+	}
+	repository.AfterCommit(ctx, cache.ForgetMissing)
+	return ids, nil
+}
+
+func (cache *CacheDecorator) CreateUsersPartially(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, []error, error) {
+	ids, errs, err := cache.repo.CreateUsersPartially(ctx, userReqs)
+	if err != nil {
+		return ids, errs, err
+	}
+	repository.AfterCommit(ctx, cache.ForgetMissing)
+	return ids, errs, nil
+}
+
+// GetUsers serves cached users and loads only the misses from the
+// repository, in one query. The loaded users are cached. Within a transaction
+// the repository is read directly, as in GetUser.
+func (cache *CacheDecorator) GetUsers(ctx context.Context, ids []string) ([]*models.User, error) {
+	if repository.InTx(ctx) {
+		return cache.repo.GetUsers(ctx, ids)
+	}
+
+	found, err := cache.GetMany(ctx, ids, cache.loadUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*models.User, 0, len(found))
+	for _, id := range ids {
+		if user, ok := found[id]; ok {
+			users = append(users, user)
+			delete(found, id)
+		}
+	}
+	return users, nil
 }
 
-func (cache *CacheDecorator) ElementCount() int {
-	cache.mu.RLock()
-	defer cache.mu.RUnlock()
-	return cache.elementCount
+func (cache *CacheDecorator) loadUsers(ctx context.Context, ids []string) (map[string]*models.User, error) {
+	users, err := cache.repo.GetUsers(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded := make(map[string]*models.User, len(users))
+	for _, user := range users {
+		loaded[user.ID.String()] = user
+	}
+	return loaded, nil
 }
 
-func (cache *CacheDecorator) SizeBytes() int {
-	cache.mu.RLock()
-	defer cache.mu.RUnlock()
-	return cache.sizeBytes
+func (cache *CacheDecorator) DeleteUsers(ctx context.Context, ids []string) ([]string, error) {
+	deleted, err := cache.repo.DeleteUsers(ctx, ids)
+	if err != nil {
+		return deleted, err
+	}
+	repository.AfterCommit(ctx, func() {
+		for _, id := range deleted {
+			cache.Evict(ctx, id)
+		}
+	})
+	return deleted, nil
 }
@@ -2,11 +2,19 @@ package cache
 
 import (
 	"context"
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
 	"github.com/dankru/Api_gateway_v2/internal/mocks"
 	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/dankru/Api_gateway_v2/internal/repository"
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/mock/gomock"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 )
@@ -39,7 +47,8 @@ func TestCacheDecorator_CreateUser(t *testing.T) {
 				Return(uuid.New(), nil)
 
 			t.Logf("initializing cache decorator, ttl: %s\n", tc.cacheTTL)
-			cache := NewCacheDecorator(mockUserProvider, tc.cacheTTL)
+			cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: tc.cacheTTL})
+			require.NoError(t, err)
 
 			t.Log("creating user through cache decorator")
 			id, err := cache.CreateUser(context.Background(), tc.userRequest)
@@ -78,16 +87,837 @@ func TestCacheDecorator_GetUser(t *testing.T) {
 				}, nil)
 
 			t.Logf("initializing cache decorator, ttl: %s\n", tc.cacheTTL)
-			cache := NewCacheDecorator(mockUserProvider, tc.cacheTTL)
+			cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: tc.cacheTTL})
+			require.NoError(t, err)
 
 			t.Log("creating user through cache decorator\n")
 			user, err := cache.GetUser(context.Background(), tc.ID.String())
 			require.NoError(t, err)
 
 			t.Log("get user from cache\n")
-			cached, ok := cache.users[user.ID.String()]
+			cached, ok := cache.get(context.Background(), user.ID.String())
 			require.Truef(t, ok, "пользователь должен быть в кэше \n")
-			require.Equal(t, tc.ID, cached.user.ID)
+			require.Equal(t, tc.ID, cached.Value.ID)
+		})
+	}
+}
+
+func TestCacheDecorator_Eviction(t *testing.T) {
+	testCases := []struct {
+		name    string
+		policy  string
+		access  []string
+		update  string
+		insert  string
+		evicted string
+	}{
+		{
+			name:    "lru вытесняет давно не используемый ключ",
+			policy:  PolicyLRU,
+			access:  []string{"a"},
+			insert:  "c",
+			evicted: "b",
+		},
+		{
+			name:    "lfu вытесняет редко используемый ключ",
+			policy:  PolicyLFU,
+			access:  []string{"b", "b", "a"},
+			insert:  "c",
+			evicted: "a",
+		},
+		{
+			name:    "lfu сохраняет частоту обновлённого ключа",
+			policy:  PolicyLFU,
+			access:  []string{"b", "b", "a"},
+			update:  "b",
+			insert:  "c",
+			evicted: "a",
+		},
+		{
+			name:    "tinylfu не пускает редкий ключ",
+			policy:  PolicyTinyLFU,
+			access:  []string{"a", "b"},
+			insert:  "c",
+			evicted: "",
+		},
+		{
+			name:    "tinylfu пускает популярный ключ",
+			policy:  PolicyTinyLFU,
+			access:  []string{"a", "c", "c", "c"},
+			insert:  "c",
+			evicted: "b",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Logf("initializing cache decorator, policy: %s\n", tc.policy)
+			cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute, MaxEntries: 2, Policy: tc.policy, Shards: 1})
+			require.NoError(t, err)
+
+			shard := cache.backend.(*memoryBackend[*models.User]).shards[0]
+			cache.set(context.Background(), &models.User{Name: "a"}, "a")
+			cache.set(context.Background(), &models.User{Name: "b"}, "b")
+			for _, id := range tc.access {
+				shard.mu.Lock()
+				shard.policy.touch(id)
+				shard.mu.Unlock()
+			}
+			if tc.update != "" {
+				t.Logf("updating %s in place\n", tc.update)
+				cache.set(context.Background(), &models.User{Name: tc.update, Version: 1}, tc.update)
+			}
+
+			t.Logf("inserting %s into full cache\n", tc.insert)
+			cache.set(context.Background(), &models.User{Name: tc.insert}, tc.insert)
+			require.Equal(t, 2, cache.ElementCount())
+
+			if tc.evicted == "" {
+				require.Equal(t, 0, cache.EvictionCount())
+				require.NotContains(t, shard.items, tc.insert)
+				return
+			}
+			require.Equal(t, 1, cache.EvictionCount())
+			require.Contains(t, shard.items, tc.insert)
+			require.NotContains(t, shard.items, tc.evicted)
+		})
+	}
+}
+
+func TestNewCacheDecorator_UnknownPolicy(t *testing.T) {
+	_, err := NewCacheDecorator(nil, config.Cache{TTL: time.Second, Policy: "fifo"})
+	require.Error(t, err)
+}
+
+func TestCacheDecorator_GetUserCoalescing(t *testing.T) {
+	const waiters = 10
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	id := uuid.New()
+	release := make(chan struct{})
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	mockUserProvider.EXPECT().
+		GetUser(gomock.Any(), id.String()).
+		DoAndReturn(func(context.Context, string) (*models.User, error) {
+			<-release
+			return &models.User{ID: id, Name: "Daniel", Age: 30}, nil
+		}).
+		Times(1)
+
+	cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: time.Minute})
+	require.NoError(t, err)
+	joined := make(chan struct{}, waiters+1)
+	cache.joined = func() { joined <- struct{}{} }
+
+	var wg sync.WaitGroup
+	users := make([]*models.User, waiters)
+	errs := make([]error, waiters)
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			users[i], errs[i] = cache.GetUser(context.Background(), id.String())
+		}(i)
+	}
+	t.Log("the load is held until every waiter shares it\n")
+	for i := 0; i < waiters; i++ {
+		<-joined
+	}
+
+	t.Log("cancelled waiter must not wait for repository\n")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cache.GetUser(cancelled, id.String())
+	require.ErrorIs(t, err, context.Canceled)
+
+	close(release)
+
+	wg.Wait()
+	for i := 0; i < waiters; i++ {
+		require.NoError(t, errs[i])
+		require.Equal(t, users[0], users[i])
+		if i > 0 {
+			require.NotSame(t, users[0], users[i], "каждый получает свою копию")
+		}
+	}
+	require.Equal(t, waiters-1, cache.CoalescedCount())
+}
+
+func TestCacheDecorator_NegativeCache(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	id := uuid.New()
+	userReq := models.UserRequest{Name: "Дмитрий", Age: 20}
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	gomock.InOrder(
+		mockUserProvider.EXPECT().GetUser(gomock.Any(), id.String()).Return(nil, apperr.ErrNotFound),
+		mockUserProvider.EXPECT().CreateUser(gomock.Any(), userReq).Return(id, nil),
+		mockUserProvider.EXPECT().GetUser(gomock.Any(), id.String()).Return(&models.User{ID: id, Name: userReq.Name, Age: userReq.Age}, nil),
+	)
+
+	cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: time.Minute, NegativeTTL: time.Minute})
+	require.NoError(t, err)
+
+	t.Log("first lookup reaches repository\n")
+	_, err = cache.GetUser(context.Background(), id.String())
+	require.ErrorIs(t, err, apperr.ErrNotFound)
+
+	t.Log("second lookup is answered by negative cache\n")
+	_, err = cache.GetUser(context.Background(), id.String())
+	require.ErrorIs(t, err, apperr.ErrNotFound)
+	require.Equal(t, 1, cache.NegativeHitCount())
+	require.Equal(t, 1, cache.NegativeMissCount())
+	require.Equal(t, 1, cache.MissCount(), "ответ negative cache не считается промахом")
+
+	t.Log("creating user clears negative cache\n")
+	_, err = cache.CreateUser(context.Background(), userReq)
+	require.NoError(t, err)
+
+	user, err := cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+	require.Equal(t, id, user.ID)
+}
+
+func TestNegativeCache_Bound(t *testing.T) {
+	testCases := []struct {
+		name    string
+		expired []string
+		add     string
+		want    []string
+	}{
+		{
+			name:    "переполненный кэш сначала забывает истёкшие ключи",
+			expired: []string{"a", "b"},
+			add:     "d",
+			want:    []string{"c", "d"},
+		},
+		{
+			name: "без истёкших ключей забывается самый старый",
+			add:  "d",
+			want: []string{"b", "c", "d"},
+		},
+		{
+			name: "повторно добавленный ключ становится самым новым",
+			add:  "a",
+			want: []string{"b", "c", "a"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			missing := newNegativeCache(time.Minute, 3)
+			for _, id := range []string{"a", "b", "c"} {
+				missing.add(id)
+			}
+			for _, id := range tc.expired {
+				missing.ids[id].Value.(*negativeEntry).expiredAt = time.Now().Add(-time.Second)
+			}
+
+			missing.add(tc.add)
+			var ids []string
+			for el := missing.order.Front(); el != nil; el = el.Next() {
+				ids = append(ids, el.Value.(*negativeEntry).id)
+			}
+			require.Equal(t, tc.want, ids)
+			require.Len(t, missing.ids, len(tc.want))
+			require.True(t, missing.has(tc.add))
+		})
+	}
+}
+
+func TestCacheDecorator_Shards(t *testing.T) {
+	cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute, Shards: 8})
+	require.NoError(t, err)
+	require.Len(t, cache.backend.(*memoryBackend[*models.User]).shards, 8)
+
+	for i := 0; i < 100; i++ {
+		cache.set(context.Background(), &models.User{ID: uuid.New()}, uuid.NewString())
+	}
+	require.Equal(t, 100, cache.ElementCount())
+
+	t.Log("expired entries are removed from every shard\n")
+	cache.invalidateExpired(time.Now().Add(time.Hour))
+	require.Equal(t, 0, cache.ElementCount())
+	require.Equal(t, 0, cache.SizeBytes())
+}
+
+func TestCacheDecorator_ShardLimits(t *testing.T) {
+	testCases := []struct {
+		name       string
+		maxEntries int
+		shards     int
+		wantShards int
+	}{
+		{name: "лимит делится между шардами с остатком", maxEntries: 10, shards: 4, wantShards: 4},
+		{name: "шардов не больше лимита", maxEntries: 3, shards: 8, wantShards: 3},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute, MaxEntries: tc.maxEntries, Shards: tc.shards})
+			require.NoError(t, err)
+			require.Len(t, cache.backend.(*memoryBackend[*models.User]).shards, tc.wantShards)
+
+			for i := 0; i < 100; i++ {
+				cache.set(context.Background(), &models.User{ID: uuid.New()}, uuid.NewString())
+			}
+			require.LessOrEqual(t, cache.ElementCount(), tc.maxEntries)
+		})
+	}
+}
+
+func TestCacheDecorator_Invalidate(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	id := uuid.New()
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	mockUserProvider.EXPECT().
+		GetUser(gomock.Any(), id.String()).
+		Return(&models.User{ID: id, Name: "Daniel", Age: 30}, nil).
+		Times(2)
+
+	cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: time.Minute, NegativeTTL: time.Minute})
+	require.NoError(t, err)
+
+	_, err = cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+
+	t.Log("invalidated user is loaded from repository again\n")
+	cache.Invalidate(context.Background(), id.String())
+	require.Equal(t, 0, cache.ElementCount())
+	_, err = cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+
+	t.Log("flush drops positive and negative entries\n")
+	cache.missing.add(uuid.NewString())
+	cache.FlushLocal()
+	require.Equal(t, 0, cache.ElementCount())
+	require.Empty(t, cache.missing.ids)
+}
+
+func TestCacheDecorator_StaleIfError(t *testing.T) {
+	testCases := []struct {
+		name         string
+		staleIfError time.Duration
+		repoErr      error
+		wantStale    bool
+	}{
+		{
+			name:         "устаревшая запись отдаётся при ошибке базы",
+			staleIfError: time.Minute,
+			repoErr:      errors.New("connection refused"),
+			wantStale:    true,
+		},
+		{
+			name:         "без grace периода ошибка возвращается",
+			staleIfError: 0,
+			repoErr:      errors.New("connection refused"),
+		},
+		{
+			name:         "not found не маскируется устаревшей записью",
+			staleIfError: time.Minute,
+			repoErr:      apperr.ErrNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+
+			id := uuid.New()
+			mockUserProvider := mocks.NewMockUserProvider(ctrl)
+			gomock.InOrder(
+				mockUserProvider.EXPECT().GetUser(gomock.Any(), id.String()).Return(&models.User{ID: id, Name: "Daniel"}, nil),
+				mockUserProvider.EXPECT().GetUser(gomock.Any(), id.String()).Return(nil, tc.repoErr),
+			)
+
+			cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: 10 * time.Millisecond, StaleIfError: tc.staleIfError})
+			require.NoError(t, err)
+
+			_, err = cache.GetUser(context.Background(), id.String())
+			require.NoError(t, err)
+
+			t.Log("waiting for entry to expire\n")
+			time.Sleep(20 * time.Millisecond)
+
+			ctx, freshness := repository.TrackFreshness(context.Background())
+			user, err := cache.GetUser(ctx, id.String())
+			if !tc.wantStale {
+				require.ErrorIs(t, err, tc.repoErr)
+				require.Equal(t, repository.Fresh, *freshness)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, id, user.ID)
+			require.Equal(t, repository.Stale, *freshness)
+			require.Equal(t, 1, cache.StaleCount())
 		})
 	}
 }
+
+func TestCacheDecorator_RefreshAhead(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	id := uuid.New()
+	refreshed := make(chan struct{})
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	gomock.InOrder(
+		mockUserProvider.EXPECT().GetUser(gomock.Any(), id.String()).Return(&models.User{ID: id, Name: "Daniel"}, nil),
+		mockUserProvider.EXPECT().GetUser(gomock.Any(), id.String()).
+			DoAndReturn(func(context.Context, string) (*models.User, error) {
+				defer close(refreshed)
+				return &models.User{ID: id, Name: "Daniil"}, nil
+			}),
+	)
+
+	cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: time.Minute, RefreshAhead: time.Minute})
+	require.NoError(t, err)
+
+	_, err = cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+
+	t.Log("entry inside refresh window is served and reloaded in background\n")
+	user, err := cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+	require.Equal(t, "Daniel", user.Name)
+
+	<-refreshed
+	require.Eventually(t, func() bool {
+		entry, ok := cache.get(context.Background(), id.String())
+		return ok && entry.Value.Name == "Daniil"
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 1, cache.RefreshCount())
+}
+
+func TestCacheDecorator_SizeAccounting(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: time.Minute})
+	require.NoError(t, err)
+
+	short := uuid.NewString()
+	long := uuid.NewString()
+	cache.set(context.Background(), &models.User{Name: "Da", PasswordHash: "x"}, short)
+	shortSize := cache.SizeBytes()
+	cache.set(context.Background(), &models.User{Name: "Daniel Daniel Daniel", PasswordHash: "xxxxxxxxxx"}, long)
+	longSize := cache.SizeBytes() - shortSize
+	require.Equal(t, len("Daniel Daniel Daniel")-len("Da")+len("xxxxxxxxxx")-len("x"), longSize-shortSize, "размер должен учитывать длину строк")
+
+	t.Log("deleting never cached user does not touch metrics\n")
+	mockUserProvider.EXPECT().DeleteUser(gomock.Any(), gomock.Any(), int64(0)).Return(nil)
+	require.NoError(t, cache.DeleteUser(context.Background(), uuid.NewString(), 0))
+	require.Equal(t, 2, cache.ElementCount())
+
+	mockUserProvider.EXPECT().DeleteUser(gomock.Any(), short, int64(0)).Return(nil)
+	require.NoError(t, cache.DeleteUser(context.Background(), short, 0))
+	mockUserProvider.EXPECT().DeleteUser(gomock.Any(), long, int64(0)).Return(nil)
+	require.NoError(t, cache.DeleteUser(context.Background(), long, 0))
+	require.Equal(t, 0, cache.ElementCount())
+	require.Equal(t, 0, cache.SizeBytes())
+}
+
+func TestCacheDecorator_Instrumentation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	id := uuid.New()
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	mockUserProvider.EXPECT().
+		GetUser(gomock.Any(), id.String()).
+		Return(&models.User{ID: id, Name: "Daniel"}, nil)
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: time.Minute})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		ctx, span := tracer.Start(context.Background(), "lookup")
+		_, err = cache.GetUser(ctx, id.String())
+		require.NoError(t, err)
+		span.End()
+	}
+
+	require.Equal(t, 1, cache.MissCount())
+	require.Equal(t, 1, cache.HitCount())
+	require.Equal(t, 1, cache.SetCount())
+
+	t.Log("lookup results are recorded as span events\n")
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	for i, want := range []string{lookupMiss, lookupHit} {
+		events := spans[i].Events()
+		require.Len(t, events, 1)
+		require.Equal(t, "cache.lookup", events[0].Name)
+		require.Equal(t, want, events[0].Attributes[0].Value.AsString())
+	}
+
+	t.Log("expired entries are counted by the cleaner\n")
+	cache.invalidateExpired(time.Now().Add(time.Hour))
+	require.Equal(t, 1, cache.ExpirationCount())
+}
+
+func TestCacheDecorator_Admin(t *testing.T) {
+	cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute, NegativeTTL: time.Minute})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, id := range []string{"aa-1", "aa-2", "bb-1"} {
+		cache.set(ctx, &models.User{ID: uuid.New(), Name: "Daniel"}, id)
+	}
+
+	t.Log("listing keys by prefix\n")
+	keys, err := cache.Keys(ctx, "aa-")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	require.Equal(t, "aa-1", keys[0].ID)
+	require.WithinDuration(t, keys[0].StoredAt.Add(time.Minute), keys[0].ExpiredAt, time.Millisecond)
+
+	t.Log("peek does not renew the entry\n")
+	entry, ok, err := cache.Peek(ctx, "aa-1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, keys[0].ExpiredAt, entry.ExpiredAt)
+
+	t.Log("purging by prefix leaves other entries\n")
+	purged, err := cache.PurgePrefix(ctx, "aa-")
+	require.NoError(t, err)
+	require.Equal(t, 2, purged)
+	require.Equal(t, 1, cache.ElementCount())
+
+	t.Log("new ttl applies to entries stored afterwards\n")
+	require.Error(t, cache.SetTTL(0))
+	require.NoError(t, cache.SetTTL(time.Hour))
+	cache.set(ctx, &models.User{ID: uuid.New()}, "cc-1")
+	entry, _, err = cache.Peek(ctx, "cc-1")
+	require.NoError(t, err)
+	require.WithinDuration(t, entry.StoredAt.Add(time.Hour), entry.ExpiredAt, time.Millisecond)
+
+	t.Log("cleaner interval can only be changed while the cleaner runs\n")
+	require.Error(t, cache.SetCleanerInterval(time.Second))
+	cleanerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cache.StartCleaner(cleanerCtx, time.Hour)
+	require.NoError(t, cache.SetCleanerInterval(10*time.Millisecond))
+	require.Equal(t, 10*time.Millisecond, cache.CleanerInterval())
+
+	t.Log("changes the cleaner has not picked up yet do not block\n")
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, cache.SetCleanerInterval(time.Duration(i)*time.Hour))
+	}
+	cancel()
+	require.Eventually(t, func() bool { return cache.CleanerInterval() == 0 }, time.Second, time.Millisecond)
+	require.Error(t, cache.SetCleanerInterval(time.Second))
+
+	t.Log("flush drops everything, including negative entries\n")
+	cache.missing.add("dd-1")
+	purged, err = cache.Flush(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, purged)
+	require.Equal(t, 0, cache.ElementCount())
+	require.Empty(t, cache.missing.ids)
+}
+
+func TestCacheDecorator_Snapshot(t *testing.T) {
+	testCases := []struct {
+		name         string
+		maxEntries   int
+		loadTTL      time.Duration
+		wantSaved    int
+		wantRestored int
+	}{
+		{
+			name:         "снапшот всех записей",
+			loadTTL:      time.Minute,
+			wantSaved:    3,
+			wantRestored: 3,
+		},
+		{
+			name:         "снапшот самых свежих записей",
+			maxEntries:   2,
+			loadTTL:      time.Minute,
+			wantSaved:    2,
+			wantRestored: 2,
+		},
+		{
+			name:         "записи старше ttl отбрасываются",
+			loadTTL:      time.Nanosecond,
+			wantSaved:    3,
+			wantRestored: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.json")
+			ctx := context.Background()
+
+			cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute})
+			require.NoError(t, err)
+			ids := []string{uuid.NewString(), uuid.NewString(), uuid.NewString()}
+			for _, id := range ids {
+				cache.set(ctx, &models.User{ID: uuid.MustParse(id), Name: "Daniel"}, id)
+			}
+			t.Log("hit renews the first entry, so it is the hottest one\n")
+			cache.get(ctx, ids[0])
+
+			saved, err := cache.SaveSnapshot(path, tc.maxEntries)
+			require.NoError(t, err)
+			require.Equal(t, tc.wantSaved, saved)
+
+			restarted, err := NewCacheDecorator(nil, config.Cache{TTL: tc.loadTTL})
+			require.NoError(t, err)
+			restored, err := restarted.LoadSnapshot(path)
+			require.NoError(t, err)
+			require.Equal(t, tc.wantRestored, restored)
+			require.Equal(t, tc.wantRestored, restarted.ElementCount())
+
+			if tc.wantRestored > 0 {
+				entry, ok := restarted.get(ctx, ids[0])
+				require.True(t, ok)
+				require.Equal(t, ids[0], entry.Value.ID.String())
+			}
+		})
+	}
+
+	t.Run("без файла снапшота", func(t *testing.T) {
+		cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute})
+		require.NoError(t, err)
+		restored, err := cache.LoadSnapshot(filepath.Join(t.TempDir(), "missing.json"))
+		require.NoError(t, err)
+		require.Zero(t, restored)
+	})
+}
+
+func TestCacheDecorator_Expiration(t *testing.T) {
+	testCases := []struct {
+		name        string
+		expiration  string
+		wantRenewed bool
+	}{
+		{
+			name:        "скользящее истечение продлевает запись при попадании",
+			expiration:  ExpirationSliding,
+			wantRenewed: true,
+		},
+		{
+			name:        "абсолютное истечение не продлевает запись",
+			expiration:  ExpirationAbsolute,
+			wantRenewed: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute, Expiration: tc.expiration, Shards: 1})
+			require.NoError(t, err)
+
+			ctx := context.Background()
+			renewed, other := uuid.NewString(), uuid.NewString()
+			cache.set(ctx, &models.User{Name: "Daniel"}, other)
+			cache.set(ctx, &models.User{Name: "Daniel"}, renewed)
+			stored, _, err := cache.Peek(ctx, renewed)
+			require.NoError(t, err)
+
+			time.Sleep(time.Millisecond)
+			t.Log("hit on the entry\n")
+			cache.get(ctx, renewed)
+			entry, _, err := cache.Peek(ctx, renewed)
+			require.NoError(t, err)
+			require.Equal(t, tc.wantRenewed, entry.ExpiredAt.After(stored.ExpiredAt))
+
+			t.Log("cleaner drops only entries that are due\n")
+			cache.invalidateExpired(stored.ExpiredAt.Add(time.Nanosecond))
+			shard := cache.backend.(*memoryBackend[*models.User]).shards[0]
+			if tc.wantRenewed {
+				require.Equal(t, 1, cache.ElementCount())
+				require.Contains(t, shard.items, renewed)
+				require.Len(t, shard.expiry, 1)
+				require.Equal(t, entry.ExpiredAt.UnixNano(), shard.expiry[0].deadline)
+				require.Equal(t, 1, cache.ExpirationCount())
+			} else {
+				require.Equal(t, 0, cache.ElementCount())
+				require.Empty(t, shard.expiry)
+				require.Equal(t, 2, cache.ExpirationCount())
+			}
+		})
+	}
+
+	t.Run("неизвестный режим истечения", func(t *testing.T) {
+		_, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute, Expiration: "eternal"})
+		require.Error(t, err)
+	})
+}
+
+func TestCacheDecorator_TTLJitter(t *testing.T) {
+	cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute, TTLJitter: time.Minute})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	lifetimes := make(map[time.Duration]struct{})
+	for i := 0; i < 10; i++ {
+		id := uuid.NewString()
+		cache.set(ctx, &models.User{Name: "Daniel"}, id)
+		entry, _, err := cache.Peek(ctx, id)
+		require.NoError(t, err)
+
+		lifetime := entry.ExpiredAt.Sub(entry.StoredAt)
+		require.GreaterOrEqual(t, lifetime, time.Minute)
+		require.Less(t, lifetime, 2*time.Minute+time.Millisecond)
+		lifetimes[lifetime] = struct{}{}
+	}
+	require.Greater(t, len(lifetimes), 1, "записи не должны истекать одновременно")
+}
+
+func TestCacheDecorator_Versions(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	id := uuid.New()
+	userReq := models.UserRequest{Name: "Daniil", Age: 31}
+	loaded := make(chan struct{})
+	release := make(chan struct{})
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	mockUserProvider.EXPECT().
+		GetUser(gomock.Any(), id.String()).
+		DoAndReturn(func(context.Context, string) (*models.User, error) {
+			close(loaded)
+			<-release
+			return &models.User{ID: id, Name: "Daniel", Age: 30, Version: 1}, nil
+		})
+	mockUserProvider.EXPECT().
+		UpdateUser(gomock.Any(), id.String(), userReq, int64(0)).
+		Return(&models.User{ID: id, Name: userReq.Name, Age: userReq.Age, Version: 2}, nil)
+
+	cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: time.Minute})
+	require.NoError(t, err)
+
+	t.Log("slow miss reads the old row while the user is updated\n")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = cache.GetUser(context.Background(), id.String())
+	}()
+	<-loaded
+	_, err = cache.UpdateUser(context.Background(), id.String(), userReq, 0)
+	require.NoError(t, err)
+	close(release)
+	<-done
+
+	user, err := cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+	require.Equal(t, int64(2), user.Version, "старая версия не должна перезаписать новую")
+	require.Equal(t, userReq.Name, user.Name)
+
+	t.Log("callers get their own copies of cached users\n")
+	user.Name = "Mutated"
+	again, err := cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+	require.Equal(t, userReq.Name, again.Name)
+}
+
+func TestCacheDecorator_PatchUser(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	id := uuid.New()
+	name := "Daniil"
+	patch := models.UserPatch{Name: &name}
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	mockUserProvider.EXPECT().
+		GetUser(gomock.Any(), id.String()).
+		Return(&models.User{ID: id, Name: "Daniel", Age: 30, Version: 1}, nil).
+		Times(1)
+	mockUserProvider.EXPECT().
+		PatchUser(gomock.Any(), id.String(), patch, int64(0)).
+		Return(&models.User{ID: id, Name: name, Age: 30, Version: 2}, nil)
+
+	cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: time.Minute})
+	require.NoError(t, err)
+
+	_, err = cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+
+	t.Log("patched user replaces the cached one\n")
+	_, err = cache.PatchUser(context.Background(), id.String(), patch, 0)
+	require.NoError(t, err)
+
+	user, err := cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+	require.Equal(t, name, user.Name)
+	require.Equal(t, int64(2), user.Version)
+}
+
+func TestCacheDecorator_SoftDelete(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	id := uuid.New()
+	user := &models.User{ID: id, Name: "Daniel", Age: 30, Version: 1}
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	mockUserProvider.EXPECT().
+		GetUser(gomock.Any(), id.String()).
+		Return(user, nil).
+		Times(1)
+	mockUserProvider.EXPECT().DeleteUser(gomock.Any(), id.String(), int64(0)).Return(nil)
+	mockUserProvider.EXPECT().
+		RestoreUser(gomock.Any(), id.String()).
+		Return(&models.User{ID: id, Name: "Daniel", Age: 30, Version: 3}, nil)
+
+	cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: time.Minute, NegativeTTL: time.Minute})
+	require.NoError(t, err)
+
+	_, err = cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+
+	t.Log("deleted user is not found without asking the repository\n")
+	require.NoError(t, cache.DeleteUser(context.Background(), id.String(), 0))
+	_, err = cache.GetUser(context.Background(), id.String())
+	require.ErrorIs(t, err, apperr.ErrNotFound)
+
+	t.Log("restored user is served from the cache\n")
+	_, err = cache.RestoreUser(context.Background(), id.String())
+	require.NoError(t, err)
+	restored, err := cache.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+	require.Equal(t, int64(3), restored.Version)
+}
+
+func TestCacheDecorator_GetUsers(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	cached := &models.User{ID: uuid.New(), Name: "Daniel", Version: 1}
+	stored := &models.User{ID: uuid.New(), Name: "Daniil", Version: 1}
+	missing := uuid.NewString()
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	mockUserProvider.EXPECT().
+		GetUsers(gomock.Any(), []string{stored.ID.String(), missing}).
+		Return([]*models.User{stored}, nil).
+		Times(1)
+
+	cache, err := NewCacheDecorator(mockUserProvider, config.Cache{TTL: time.Minute, NegativeTTL: time.Minute})
+	require.NoError(t, err)
+	cache.Store(context.Background(), cached.ID.String(), cached)
+
+	t.Log("only misses are loaded from the repository, in one call\n")
+	ids := []string{cached.ID.String(), stored.ID.String(), missing, cached.ID.String()}
+	users, err := cache.GetUsers(context.Background(), ids)
+	require.NoError(t, err)
+	require.Equal(t, []*models.User{cached, stored}, users)
+
+	t.Log("loaded users and missing ids are cached\n")
+	users, err = cache.GetUsers(context.Background(), ids)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, 1, cache.NegativeHitCount())
+}
@@ -0,0 +1,36 @@
+package cache
+
+// expiryQueue is a min-heap of the entries of a shard ordered by deadline,
+// so the cleaner only touches entries that are due. Hits renew expiredAt
+// without the write lock, so the deadline of an entry may lag behind it;
+// the cleaner reschedules such entries instead of dropping them.
+type expiryQueue[V any] []*wrapEntry[V]
+
+func (q expiryQueue[V]) Len() int {
+	return len(q)
+}
+
+func (q expiryQueue[V]) Less(i, j int) bool {
+	return q[i].deadline < q[j].deadline
+}
+
+func (q expiryQueue[V]) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue[V]) Push(x interface{}) {
+	wrap := x.(*wrapEntry[V])
+	wrap.index = len(*q)
+	*q = append(*q, wrap)
+}
+
+func (q *expiryQueue[V]) Pop() interface{} {
+	old := *q
+	wrap := old[len(old)-1]
+	old[len(old)-1] = nil
+	wrap.index = -1
+	*q = old[:len(old)-1]
+	return wrap
+}
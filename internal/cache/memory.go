@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"context"
+	"hash/maphash"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ExpirationSliding renews the expiration of fresh entries on every hit.
+	ExpirationSliding = "sliding"
+	// ExpirationAbsolute expires entries a fixed TTL after they were stored.
+	ExpirationAbsolute = "absolute"
+)
+
+// memoryBackend keeps values in process memory, spread over sharded maps.
+// With sliding expiration hits renew the expiration of fresh entries,
+// expired entries are kept for the stale grace period before the cleaner
+// drops them.
+type memoryBackend[V any] struct {
+	seed       maphash.Seed
+	shards     []*shard[V]
+	ttl        *ttlValue
+	size       Sizer[V]
+	sliding    bool
+	staleGrace time.Duration
+}
+
+func newMemoryBackend[V any](cfg config.Cache, ttl *ttlValue, size Sizer[V]) (*memoryBackend[V], error) {
+	var sliding bool
+	switch cfg.Expiration {
+	case "", ExpirationSliding:
+		sliding = true
+	case ExpirationAbsolute:
+	default:
+		return nil, errors.Errorf("unknown cache expiration: %s", cfg.Expiration)
+	}
+
+	shardCount := cfg.Shards
+	if shardCount <= 0 {
+		shardCount = defaultShards
+	}
+	// Every shard needs a share of at least one, a zero share would lift
+	// the limit for the shard.
+	for _, limit := range []int{cfg.MaxEntries, cfg.MaxBytes} {
+		if limit > 0 {
+			shardCount = min(shardCount, limit)
+		}
+	}
+
+	shards := make([]*shard[V], shardCount)
+	for i := range shards {
+		maxEntries := perShard(cfg.MaxEntries, shardCount, i)
+		policy, err := newEvictionPolicy(cfg.Policy, maxEntries)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create eviction policy")
+		}
+		shards[i] = newShard[V](policy, maxEntries, perShard(cfg.MaxBytes, shardCount, i))
+	}
+
+	return &memoryBackend[V]{
+		seed:       maphash.MakeSeed(),
+		shards:     shards,
+		ttl:        ttl,
+		size:       size,
+		sliding:    sliding,
+		staleGrace: cfg.StaleIfError,
+	}, nil
+}
+
+// perShard returns the share of a cache wide limit held by shard i. The
+// remainder of the split goes to the first shards, so the shares add up to
+// the limit.
+func perShard(limit, shardCount, i int) int {
+	share := limit / shardCount
+	if i < limit%shardCount {
+		share++
+	}
+	return share
+}
+
+func (m *memoryBackend[V]) shardFor(id string) *shard[V] {
+	return m.shards[maphash.String(m.seed, id)%uint64(len(m.shards))]
+}
+
+func (m *memoryBackend[V]) Get(_ context.Context, id string) (Entry[V], bool, error) {
+	wrap, exists := m.shardFor(id).get(id)
+	if !exists {
+		return Entry[V]{}, false, nil
+	}
+
+	now := time.Now()
+	if wrap.expiredBefore(now.Add(-m.staleGrace)) {
+		return Entry[V]{}, false, nil
+	}
+	if m.sliding && !wrap.expiredBefore(now) {
+		wrap.renew(m.ttl.entry())
+	}
+	return wrap.entry(), true, nil
+}
+
+func (m *memoryBackend[V]) GetMany(ctx context.Context, ids []string) (map[string]Entry[V], error) {
+	entries := make(map[string]Entry[V], len(ids))
+	for _, id := range ids {
+		if entry, exists, _ := m.Get(ctx, id); exists {
+			entries[id] = entry
+		}
+	}
+	return entries, nil
+}
+
+func (m *memoryBackend[V]) Set(_ context.Context, id string, value V, version int64) error {
+	m.shardFor(id).set(id, newWrapEntry(id, value, version, m.ttl.entry(), m.size))
+	return nil
+}
+
+func (m *memoryBackend[V]) Delete(_ context.Context, id string) error {
+	m.shardFor(id).remove(id)
+	return nil
+}
+
+func (m *memoryBackend[V]) Keys(_ context.Context, prefix string) ([]string, error) {
+	var ids []string
+	for _, s := range m.shards {
+		ids = s.keys(prefix, ids)
+	}
+	return ids, nil
+}
+
+// peek returns the entry for id without renewing it or counting an access.
+func (m *memoryBackend[V]) peek(id string) (Entry[V], bool) {
+	wrap, exists := m.shardFor(id).peek(id)
+	if !exists {
+		return Entry[V]{}, false
+	}
+	return wrap.entry(), true
+}
+
+func (m *memoryBackend[V]) entries() []snapshotEntry[V] {
+	var entries []snapshotEntry[V]
+	for _, s := range m.shards {
+		entries = s.entries(entries)
+	}
+	return entries
+}
+
+func (m *memoryBackend[V]) restore(id string, entry Entry[V]) {
+	m.shardFor(id).set(id, restoredWrapEntry(id, entry, m.size))
+}
+
+func (m *memoryBackend[V]) invalidateExpired(t time.Time) {
+	expired := 0
+	for _, s := range m.shards {
+		expired += s.invalidateExpired(t.Add(-m.staleGrace))
+	}
+	if expired > 0 {
+		log.Debug().Msgf("invalidated %d expired entries", expired)
+	}
+}
+
+func (m *memoryBackend[V]) evictLocal(id string) {
+	m.shardFor(id).remove(id)
+}
+
+func (m *memoryBackend[V]) flush() {
+	for _, s := range m.shards {
+		s.flush()
+	}
+}
+
+func (m *memoryBackend[V]) stats() storeStats {
+	var total storeStats
+	for _, s := range m.shards {
+		total = total.add(s.stats())
+	}
+	return total
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type negativeEntry struct {
+	id        string
+	expiredAt time.Time
+}
+
+// negativeCache remembers keys the Loader reported as not found, so
+// repeated lookups of missing keys do not reach the source. Every key lives
+// for the same TTL, so keeping keys in the order they were added also keeps
+// them in the order they expire: the cleaner and eviction only look at the
+// front.
+type negativeCache struct {
+	mu         sync.RWMutex
+	ids        map[string]*list.Element
+	order      *list.List
+	ttl        time.Duration
+	maxEntries int
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newNegativeCache(ttl time.Duration, maxEntries int) *negativeCache {
+	return &negativeCache{
+		ids:        make(map[string]*list.Element),
+		order:      list.New(),
+		ttl:        ttl,
+		maxEntries: maxEntries,
+	}
+}
+
+func (n *negativeCache) enabled() bool {
+	return n.ttl > 0
+}
+
+func (n *negativeCache) has(id string) bool {
+	if !n.enabled() {
+		return false
+	}
+
+	n.mu.RLock()
+	var expiredAt time.Time
+	el, exists := n.ids[id]
+	if exists {
+		expiredAt = el.Value.(*negativeEntry).expiredAt
+	}
+	n.mu.RUnlock()
+
+	if exists && time.Now().Before(expiredAt) {
+		n.hits.Add(1)
+		return true
+	}
+	n.misses.Add(1)
+	return false
+}
+
+// add remembers id for the TTL. When the cache is full, expired keys are
+// dropped first and the oldest key after that.
+func (n *negativeCache) add(id string) {
+	if !n.enabled() {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	if el, exists := n.ids[id]; exists {
+		el.Value.(*negativeEntry).expiredAt = now.Add(n.ttl)
+		n.order.MoveToBack(el)
+		return
+	}
+	if n.maxEntries > 0 && len(n.ids) >= n.maxEntries {
+		n.removeExpiredLocked(now)
+		if len(n.ids) >= n.maxEntries {
+			n.removeLocked(n.order.Front())
+		}
+	}
+	n.ids[id] = n.order.PushBack(&negativeEntry{id: id, expiredAt: now.Add(n.ttl)})
+}
+
+func (n *negativeCache) remove(id string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if el, exists := n.ids[id]; exists {
+		n.removeLocked(el)
+	}
+}
+
+func (n *negativeCache) clear() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	clear(n.ids)
+	n.order.Init()
+}
+
+func (n *negativeCache) invalidateExpired(t time.Time) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.removeExpiredLocked(t)
+}
+
+// removeExpiredLocked drops the keys that expired before t. Must be called
+// with n.mu held.
+func (n *negativeCache) removeExpiredLocked(t time.Time) {
+	for el := n.order.Front(); el != nil && el.Value.(*negativeEntry).expiredAt.Before(t); el = n.order.Front() {
+		n.removeLocked(el)
+	}
+}
+
+// removeLocked drops the key of el. Must be called with n.mu held.
+func (n *negativeCache) removeLocked(el *list.Element) {
+	n.order.Remove(el)
+	delete(n.ids, el.Value.(*negativeEntry).id)
+}
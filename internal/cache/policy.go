@@ -0,0 +1,285 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"hash/maphash"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	PolicyLRU     = "lru"
+	PolicyLFU     = "lfu"
+	PolicyTinyLFU = "tinylfu"
+)
+
+// evictionPolicy decides which key leaves a full cache. Implementations are
+// not safe for concurrent use, callers hold the cache lock.
+type evictionPolicy interface {
+	// touch records an access to key, whether or not it is stored.
+	touch(key string)
+	// add starts tracking a newly stored key.
+	add(key string)
+	// remove stops tracking key.
+	remove(key string)
+	// victim returns the key that should be evicted next.
+	victim() (string, bool)
+	// admit reports whether candidate is worth evicting victim for.
+	admit(candidate, victim string) bool
+}
+
+func newEvictionPolicy(name string, capacity int) (evictionPolicy, error) {
+	switch name {
+	case "", PolicyLRU:
+		return newLRUPolicy(), nil
+	case PolicyLFU:
+		return newLFUPolicy(), nil
+	case PolicyTinyLFU:
+		return newTinyLFUPolicy(capacity), nil
+	default:
+		return nil, errors.Errorf("unknown cache eviction policy: %s", name)
+	}
+}
+
+type lruPolicy struct {
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (p *lruPolicy) touch(key string) {
+	if el, ok := p.items[key]; ok {
+		p.order.MoveToFront(el)
+	}
+}
+
+func (p *lruPolicy) add(key string) {
+	if el, ok := p.items[key]; ok {
+		p.order.MoveToFront(el)
+		return
+	}
+	p.items[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) remove(key string) {
+	if el, ok := p.items[key]; ok {
+		p.order.Remove(el)
+		delete(p.items, key)
+	}
+}
+
+func (p *lruPolicy) victim() (string, bool) {
+	el := p.order.Back()
+	if el == nil {
+		return "", false
+	}
+	return el.Value.(string), true
+}
+
+func (p *lruPolicy) admit(string, string) bool {
+	return true
+}
+
+type lfuItem struct {
+	key   string
+	freq  int
+	seq   uint64
+	index int
+}
+
+// lfuHeap orders items by frequency, the least recently used item wins ties.
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq == h[j].freq {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].freq < h[j].freq
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+type lfuPolicy struct {
+	heap  lfuHeap
+	items map[string]*lfuItem
+	seq   uint64
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{items: make(map[string]*lfuItem)}
+}
+
+func (p *lfuPolicy) touch(key string) {
+	if item, ok := p.items[key]; ok {
+		p.seq++
+		item.freq++
+		item.seq = p.seq
+		heap.Fix(&p.heap, item.index)
+	}
+}
+
+func (p *lfuPolicy) add(key string) {
+	if _, ok := p.items[key]; ok {
+		p.touch(key)
+		return
+	}
+	p.seq++
+	item := &lfuItem{key: key, freq: 1, seq: p.seq}
+	heap.Push(&p.heap, item)
+	p.items[key] = item
+}
+
+func (p *lfuPolicy) remove(key string) {
+	if item, ok := p.items[key]; ok {
+		heap.Remove(&p.heap, item.index)
+		delete(p.items, key)
+	}
+}
+
+func (p *lfuPolicy) victim() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	return p.heap[0].key, true
+}
+
+func (p *lfuPolicy) admit(string, string) bool {
+	return true
+}
+
+// tinyLFUPolicy keeps an LRU order for victim selection and only admits a
+// new key when its estimated access frequency beats the victim's.
+type tinyLFUPolicy struct {
+	lru    *lruPolicy
+	sketch *countMinSketch
+}
+
+func newTinyLFUPolicy(capacity int) *tinyLFUPolicy {
+	return &tinyLFUPolicy{
+		lru:    newLRUPolicy(),
+		sketch: newCountMinSketch(capacity),
+	}
+}
+
+func (p *tinyLFUPolicy) touch(key string) {
+	p.sketch.increment(key)
+	p.lru.touch(key)
+}
+
+func (p *tinyLFUPolicy) add(key string) {
+	p.lru.add(key)
+}
+
+func (p *tinyLFUPolicy) remove(key string) {
+	p.lru.remove(key)
+}
+
+func (p *tinyLFUPolicy) victim() (string, bool) {
+	return p.lru.victim()
+}
+
+func (p *tinyLFUPolicy) admit(candidate, victim string) bool {
+	return p.sketch.estimate(candidate) > p.sketch.estimate(victim)
+}
+
+const (
+	sketchDepth      = 4
+	sketchMaxCounter = 15
+	sketchMinWidth   = 1024
+)
+
+// countMinSketch estimates key frequencies with saturating 4-bit counters.
+// Counters are halved every sampleSize increments so old popularity fades.
+type countMinSketch struct {
+	seed       maphash.Seed
+	rows       [sketchDepth][]uint8
+	mask       uint64
+	additions  int
+	sampleSize int
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := sketchMinWidth
+	for width < capacity {
+		width <<= 1
+	}
+
+	s := &countMinSketch{
+		seed:       maphash.MakeSeed(),
+		mask:       uint64(width - 1),
+		sampleSize: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *countMinSketch) indexes(key string) [sketchDepth]uint64 {
+	h := maphash.String(s.seed, key)
+	lo, hi := h, h>>32|h<<32
+
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (lo + uint64(i)*hi) & s.mask
+	}
+	return idx
+}
+
+func (s *countMinSketch) increment(key string) {
+	for row, i := range s.indexes(key) {
+		if s.rows[row][i] < sketchMaxCounter {
+			s.rows[row][i]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	est := uint8(sketchMaxCounter)
+	for row, i := range s.indexes(key) {
+		est = min(est, s.rows[row][i])
+	}
+	return est
+}
+
+func (s *countMinSketch) reset() {
+	for row := range s.rows {
+		for i := range s.rows[row] {
+			s.rows[row][i] >>= 1
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,446 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/dankru/Api_gateway_v2/internal/repository"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// Loader fetches a value that is missing from the cache. It returns
+// apperr.ErrNotFound for keys that do not exist, those are remembered in the
+// negative cache.
+type Loader[K ~string, V any] func(ctx context.Context, key K) (V, error)
+
+// BatchLoader fetches several values missing from the cache at once. Keys
+// it leaves out of the result do not exist, they are remembered in the
+// negative cache.
+type BatchLoader[K ~string, V any] func(ctx context.Context, keys []K) (map[K]V, error)
+
+// Sizer estimates the memory owned by a cached value beyond its own size,
+// for example the bytes behind its strings. It is used for the maxBytes
+// limit.
+type Sizer[V any] func(value V) int
+
+// Options describe how a ReadThrough handles its values, every field is
+// optional.
+type Options[V any] struct {
+	// Size estimates the memory owned by a value, by default only the fixed
+	// size of each entry is counted.
+	Size Sizer[V]
+	// Version orders values of one key. A value never replaces a cached
+	// value with a higher version, so a slow load cannot overwrite a newer
+	// write. Without it every value replaces the cached one.
+	Version func(value V) int64
+	// Clone copies values on their way into and out of the cache, so
+	// callers cannot modify a cached value they share with others.
+	Clone func(value V) V
+}
+
+// ReadThrough serves values from a cache backend and loads misses through a
+// Loader. Keys are strings underneath, because they are shared with other
+// replicas, written to snapshots and purged by prefix.
+type ReadThrough[K ~string, V any] struct {
+	name    string
+	source  Loader[K, V]
+	version func(V) int64
+	clone   func(V) V
+
+	loads          singleflight.Group
+	coalescedCount atomic.Int64
+	// joined, when set, is called once a lookup waits for a load. Tests use
+	// it to know that every waiter shares the load.
+	joined func()
+
+	hitCount  atomic.Int64
+	missCount atomic.Int64
+	setCount  atomic.Int64
+
+	missing *negativeCache
+	backend Backend[V]
+
+	ttl          *ttlValue
+	refreshAhead time.Duration
+	refreshing   sync.Map
+	refreshCount atomic.Int64
+	staleCount   atomic.Int64
+
+	cleanerInterval atomic.Int64
+	cleanerReset    chan time.Duration
+}
+
+// NewReadThrough creates a cache named name, the name separates its keys
+// from other caches sharing a backend.
+func NewReadThrough[K ~string, V any](name string, source Loader[K, V], cfg config.Cache, opts Options[V]) (*ReadThrough[K, V], error) {
+	size := opts.Size
+	if size == nil {
+		size = func(V) int { return 0 }
+	}
+	version := opts.Version
+	if version == nil {
+		version = func(V) int64 { return 0 }
+	}
+	clone := opts.Clone
+	if clone == nil {
+		clone = func(value V) V { return value }
+	}
+
+	ttl := newTTLValue(cfg.TTL, cfg.TTLJitter)
+	backend, err := newBackend(name, cfg, ttl, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create cache backend")
+	}
+
+	return &ReadThrough[K, V]{
+		name:         name,
+		source:       source,
+		version:      version,
+		clone:        clone,
+		missing:      newNegativeCache(cfg.NegativeTTL, cfg.NegativeMaxEntries),
+		backend:      backend,
+		ttl:          ttl,
+		refreshAhead: cfg.RefreshAhead,
+		cleanerReset: make(chan time.Duration, 1),
+	}, nil
+}
+
+// StartCleaner drops expired entries every cleanerInterval. The interval can
+// be changed later with SetCleanerInterval.
+func (cache *ReadThrough[K, V]) StartCleaner(ctx context.Context, cleanerInterval time.Duration) {
+	cache.cleanerInterval.Store(int64(cleanerInterval))
+	ticker := time.NewTicker(cleanerInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				log.Info().Msgf("%s cache cleaner shutting down...", cache.name)
+				cache.cleanerInterval.Store(0)
+				return
+			case interval := <-cache.cleanerReset:
+				ticker.Reset(interval)
+			case t := <-ticker.C:
+				cache.invalidateExpired(t)
+				cache.missing.invalidateExpired(t)
+			}
+		}
+	}()
+}
+
+func (cache *ReadThrough[K, V]) invalidateExpired(t time.Time) {
+	if local, ok := cache.backend.(localStore[V]); ok {
+		local.invalidateExpired(t)
+	}
+}
+
+// Close releases connections held by the backend.
+func (cache *ReadThrough[K, V]) Close() error {
+	if closer, ok := cache.backend.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (cache *ReadThrough[K, V]) get(ctx context.Context, key K) (Entry[V], bool) {
+	entry, exists, err := cache.backend.Get(ctx, string(key))
+	if err != nil {
+		logBackendErr(err, "get", string(key))
+		return Entry[V]{}, false
+	}
+	return entry, exists
+}
+
+func (cache *ReadThrough[K, V]) set(ctx context.Context, value V, key K) {
+	cache.setCount.Add(1)
+	if err := cache.backend.Set(ctx, string(key), cache.clone(value), cache.version(value)); err != nil {
+		logBackendErr(err, "set", string(key))
+	}
+}
+
+func (cache *ReadThrough[K, V]) delete(ctx context.Context, key K) {
+	if err := cache.backend.Delete(ctx, string(key)); err != nil {
+		logBackendErr(err, "delete", string(key))
+	}
+}
+
+// Get serves fresh entries from the cache and loads the rest through the
+// Loader. Entries close to expiry are refreshed in the background. When the
+// Loader fails, an expired entry still inside the stale grace period is
+// served instead of the error and the context is marked as Stale.
+func (cache *ReadThrough[K, V]) Get(ctx context.Context, key K) (V, error) {
+	entry, exists := cache.get(ctx, key)
+	if exists && entry.fresh(time.Now()) {
+		cache.hitCount.Add(1)
+		cache.traceLookup(ctx, key, lookupHit)
+		if cache.shouldRefresh(entry) {
+			cache.refresh(ctx, key)
+		}
+		return cache.clone(entry.Value), nil
+	}
+	// Negative hits are counted by the negative cache, misses are the
+	// lookups that go to the Loader.
+	if cache.missing.has(string(key)) {
+		cache.traceLookup(ctx, key, lookupNegativeHit)
+		var zero V
+		return zero, apperr.ErrNotFound
+	}
+	cache.missCount.Add(1)
+	cache.traceLookup(ctx, key, lookupMiss)
+
+	value, err := cache.load(ctx, key)
+	if err != nil && exists && ctx.Err() == nil && !errors.Is(err, apperr.ErrNotFound) {
+		log.Warn().Err(err).Msgf("serving stale %s: %s", cache.name, key)
+		cache.staleCount.Add(1)
+		cache.traceLookup(ctx, key, lookupStale)
+		repository.MarkStale(ctx)
+		return cache.clone(entry.Value), nil
+	}
+	return value, err
+}
+
+// GetMany returns the values of keys, serving what it can from the cache and
+// fetching all the misses with a single call to load. Keys that do not exist
+// are left out of the result.
+func (cache *ReadThrough[K, V]) GetMany(ctx context.Context, keys []K, load BatchLoader[K, V]) (map[K]V, error) {
+	now := time.Now()
+	values := make(map[K]V, len(keys))
+	seen := make(map[K]struct{}, len(keys))
+	var misses []K
+	var negativeHits int
+	for _, key := range keys {
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+
+		entry, exists := cache.get(ctx, key)
+		if exists && entry.fresh(now) {
+			cache.hitCount.Add(1)
+			values[key] = cache.clone(entry.Value)
+			continue
+		}
+		if cache.missing.has(string(key)) {
+			negativeHits++
+			continue
+		}
+		cache.missCount.Add(1)
+		misses = append(misses, key)
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("cache.lookup_many", trace.WithAttributes(
+		attribute.Int("cache.hits", len(values)),
+		attribute.Int("cache.negative_hits", negativeHits),
+		attribute.Int("cache.misses", len(misses)),
+		attribute.String("cache.name", cache.name),
+	))
+	if len(misses) == 0 {
+		return values, nil
+	}
+
+	loaded, err := load(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range misses {
+		value, ok := loaded[key]
+		if !ok {
+			cache.missing.add(string(key))
+			continue
+		}
+		cache.set(ctx, value, key)
+		values[key] = value
+	}
+	return values, nil
+}
+
+const (
+	lookupHit         = "hit"
+	lookupMiss        = "miss"
+	lookupNegativeHit = "negative_hit"
+	lookupStale       = "stale"
+)
+
+// traceLookup adds the outcome of a cache lookup to the current span, so
+// traces show whether a request was served from the cache.
+func (cache *ReadThrough[K, V]) traceLookup(ctx context.Context, key K, result string) {
+	trace.SpanFromContext(ctx).AddEvent("cache.lookup", trace.WithAttributes(
+		attribute.String("cache.result", result),
+		attribute.String("cache.key", string(key)),
+		attribute.String("cache.name", cache.name),
+	))
+}
+
+func (cache *ReadThrough[K, V]) shouldRefresh(entry Entry[V]) bool {
+	if cache.refreshAhead <= 0 {
+		return false
+	}
+	return time.Since(entry.StoredAt) >= cache.ttl.get()-cache.refreshAhead
+}
+
+// refresh reloads key in the background, at most once at a time per key.
+func (cache *ReadThrough[K, V]) refresh(ctx context.Context, key K) {
+	if _, inFlight := cache.refreshing.LoadOrStore(key, struct{}{}); inFlight {
+		return
+	}
+
+	cache.refreshCount.Add(1)
+	go func() {
+		defer cache.refreshing.Delete(key)
+		if _, err, _ := cache.loads.Do(string(key), cache.loader(context.WithoutCancel(ctx), key)); err != nil {
+			log.Warn().Err(err).Msgf("failed to refresh cached %s: %s", cache.name, key)
+		}
+	}()
+}
+
+// loader returns the Loader call shared by all concurrent loads of key.
+func (cache *ReadThrough[K, V]) loader(ctx context.Context, key K) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		value, err := cache.source(ctx, key)
+		if errors.Is(err, apperr.ErrNotFound) {
+			cache.delete(ctx, key)
+			cache.missing.add(string(key))
+		}
+		if err != nil {
+			return nil, err
+		}
+		cache.set(ctx, value, key)
+		return value, nil
+	}
+}
+
+// load fetches a missing value through the Loader. Concurrent misses for the
+// same key share a single call, each waiter still returns as soon as its own
+// context is done.
+func (cache *ReadThrough[K, V]) load(ctx context.Context, key K) (V, error) {
+	var zero V
+	var leader bool
+	load := cache.loader(context.WithoutCancel(ctx), key)
+	ch := cache.loads.DoChan(string(key), func() (interface{}, error) {
+		leader = true
+		return load()
+	})
+	if cache.joined != nil {
+		cache.joined()
+	}
+
+	select {
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	case res := <-ch:
+		if !leader {
+			cache.coalescedCount.Add(1)
+		}
+		if res.Err != nil {
+			return zero, res.Err
+		}
+		// Every waiter gets its own copy of the shared result.
+		return cache.clone(res.Val.(V)), nil
+	}
+}
+
+// Store writes value through to the cache after it changed in the source.
+// The key exists from now on, so it is dropped from the negative cache.
+func (cache *ReadThrough[K, V]) Store(ctx context.Context, key K, value V) {
+	cache.set(ctx, value, key)
+	cache.missing.remove(string(key))
+}
+
+// Evict drops key from the cache after it was deleted from the source.
+// Lookups report it as not found without reaching the source until the
+// negative TTL passes.
+func (cache *ReadThrough[K, V]) Evict(ctx context.Context, key K) {
+	cache.delete(ctx, key)
+	cache.missing.add(string(key))
+}
+
+// ForgetMissing clears the negative cache. It is called after new keys were
+// created in the source, because one of them may have been looked up before.
+func (cache *ReadThrough[K, V]) ForgetMissing() {
+	cache.missing.clear()
+}
+
+// Invalidate drops key from process memory after it changed elsewhere, for
+// example on another gateway replica. Shared backends are kept up to date by
+// the replica that made the change.
+func (cache *ReadThrough[K, V]) Invalidate(_ context.Context, key K) {
+	if local, ok := cache.backend.(localStore[V]); ok {
+		local.evictLocal(string(key))
+	}
+	cache.missing.remove(string(key))
+}
+
+// FlushLocal drops everything held in process memory. Shared backends are
+// left untouched.
+func (cache *ReadThrough[K, V]) FlushLocal() {
+	if local, ok := cache.backend.(localStore[V]); ok {
+		local.flush()
+	}
+	cache.missing.clear()
+}
+
+func (cache *ReadThrough[K, V]) stats() storeStats {
+	if local, ok := cache.backend.(localStore[V]); ok {
+		return local.stats()
+	}
+	return storeStats{}
+}
+
+func (cache *ReadThrough[K, V]) ElementCount() int {
+	return cache.stats().elementCount
+}
+
+func (cache *ReadThrough[K, V]) SizeBytes() int {
+	return cache.stats().sizeBytes
+}
+
+func (cache *ReadThrough[K, V]) EvictionCount() int {
+	return cache.stats().evictionCount
+}
+
+func (cache *ReadThrough[K, V]) ExpirationCount() int {
+	return cache.stats().expirationCount
+}
+
+func (cache *ReadThrough[K, V]) HitCount() int {
+	return int(cache.hitCount.Load())
+}
+
+func (cache *ReadThrough[K, V]) MissCount() int {
+	return int(cache.missCount.Load())
+}
+
+func (cache *ReadThrough[K, V]) SetCount() int {
+	return int(cache.setCount.Load())
+}
+
+func (cache *ReadThrough[K, V]) CoalescedCount() int {
+	return int(cache.coalescedCount.Load())
+}
+
+func (cache *ReadThrough[K, V]) RefreshCount() int {
+	return int(cache.refreshCount.Load())
+}
+
+func (cache *ReadThrough[K, V]) StaleCount() int {
+	return int(cache.staleCount.Load())
+}
+
+func (cache *ReadThrough[K, V]) NegativeHitCount() int {
+	return int(cache.missing.hits.Load())
+}
+
+func (cache *ReadThrough[K, V]) NegativeMissCount() int {
+	return int(cache.missing.misses.Load())
+}
@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/stretchr/testify/require"
+)
+
+type sku string
+
+type product struct {
+	Title string
+	Price int
+}
+
+func TestReadThrough_CustomTypes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		key     sku
+		wantErr error
+	}{
+		{
+			name: "значение загружается один раз",
+			key:  "sku-1",
+		},
+		{
+			name:    "отсутствующий ключ попадает в негативный кэш",
+			key:     "sku-404",
+			wantErr: apperr.ErrNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			source := func(_ context.Context, key sku) (product, error) {
+				calls++
+				if key == "sku-404" {
+					return product{}, apperr.ErrNotFound
+				}
+				return product{Title: string(key), Price: 100}, nil
+			}
+			size := func(p product) int { return len(p.Title) }
+
+			cache, err := NewReadThrough[sku, product]("product", source, config.Cache{TTL: time.Minute, NegativeTTL: time.Minute}, Options[product]{Size: size})
+			require.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				value, err := cache.Get(context.Background(), tc.key)
+				if tc.wantErr != nil {
+					require.ErrorIs(t, err, tc.wantErr)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, product{Title: string(tc.key), Price: 100}, value)
+			}
+			require.Equal(t, 1, calls)
+		})
+	}
+}
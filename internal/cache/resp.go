@@ -0,0 +1,379 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRESPPool    = 8
+	defaultRESPTimeout = time.Second
+	respScanCount      = 100
+)
+
+// respSetIfNotOlder stores ARGV[1] under KEYS[1] for ARGV[2] milliseconds
+// unless the stored entry has a version higher than ARGV[3].
+const respSetIfNotOlder = `
+local current = redis.call('GET', KEYS[1])
+if current then
+	local ok, entry = pcall(cjson.decode, current)
+	if ok and tonumber(entry.version or 0) > tonumber(ARGV[3]) then
+		return 0
+	end
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`
+
+// respError is an error reply sent by the server.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// respEntry is the JSON document stored under a key. The value keeps the
+// "user" field name of the entries written before the cache became generic,
+// so replicas of both releases read each other's entries during a deploy.
+type respEntry[V any] struct {
+	Value     V         `json:"user"`
+	Version   int64     `json:"version"`
+	StoredAt  time.Time `json:"storedAt"`
+	ExpiredAt time.Time `json:"expiredAt"`
+}
+
+// respBackend stores values in a Redis-protocol server, so every gateway
+// replica shares the same cached copies. Expiration is always absolute:
+// entries expire a fixed TTL after they were stored, the server keeps them
+// for the stale grace period on top. Keys are prefixed with the cache name.
+type respBackend[V any] struct {
+	keyPrefix  string
+	address    string
+	password   string
+	db         int
+	timeout    time.Duration
+	ttl        *ttlValue
+	staleGrace time.Duration
+	conns      chan *respConn
+}
+
+func newRESPBackend[V any](cfg config.Redis, name string, ttl *ttlValue, staleGrace time.Duration) *respBackend[V] {
+	poolSize := cfg.PoolSize
+	if poolSize <= 0 {
+		poolSize = defaultRESPPool
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultRESPTimeout
+	}
+
+	return &respBackend[V]{
+		keyPrefix:  name + ":",
+		address:    cfg.Address,
+		password:   cfg.Password,
+		db:         cfg.DB,
+		timeout:    timeout,
+		ttl:        ttl,
+		staleGrace: staleGrace,
+		conns:      make(chan *respConn, poolSize),
+	}
+}
+
+func (b *respBackend[V]) Get(ctx context.Context, id string) (Entry[V], bool, error) {
+	reply, err := b.do(ctx, "GET", b.keyPrefix+id)
+	if err != nil {
+		return Entry[V]{}, false, err
+	}
+	if reply == nil {
+		return Entry[V]{}, false, nil
+	}
+
+	payload, ok := reply.([]byte)
+	if !ok {
+		return Entry[V]{}, false, errors.Errorf("unexpected GET reply: %v", reply)
+	}
+
+	entry, err := decodeRESPEntry[V](payload)
+	if err != nil {
+		return Entry[V]{}, false, err
+	}
+	return entry, true, nil
+}
+
+// GetMany reads all ids with a single MGET.
+func (b *respBackend[V]) GetMany(ctx context.Context, ids []string) (map[string]Entry[V], error) {
+	entries := make(map[string]Entry[V], len(ids))
+	if len(ids) == 0 {
+		return entries, nil
+	}
+
+	args := make([]string, 0, len(ids)+1)
+	args = append(args, "MGET")
+	for _, id := range ids {
+		args = append(args, b.keyPrefix+id)
+	}
+	reply, err := b.do(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != len(ids) {
+		return nil, errors.Errorf("unexpected MGET reply: %v", reply)
+	}
+	for i, value := range values {
+		payload, ok := value.([]byte)
+		if !ok {
+			continue
+		}
+		entry, err := decodeRESPEntry[V](payload)
+		if err != nil {
+			return nil, err
+		}
+		entries[ids[i]] = entry
+	}
+	return entries, nil
+}
+
+func decodeRESPEntry[V any](payload []byte) (Entry[V], error) {
+	var entry respEntry[V]
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return Entry[V]{}, errors.Wrap(err, "failed to decode cached value")
+	}
+	return Entry[V](entry), nil
+}
+
+// Set compares versions on the server, so replicas racing to store the same
+// key cannot replace a newer value with an older one.
+func (b *respBackend[V]) Set(ctx context.Context, id string, value V, version int64) error {
+	now := time.Now()
+	ttl := b.ttl.entry()
+	payload, err := json.Marshal(respEntry[V]{Value: value, Version: version, StoredAt: now, ExpiredAt: now.Add(ttl)})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode value")
+	}
+
+	_, err = b.do(ctx, "EVAL", respSetIfNotOlder, "1", b.keyPrefix+id, string(payload), b.ttlMillis(ttl), strconv.FormatInt(version, 10))
+	return err
+}
+
+func (b *respBackend[V]) Delete(ctx context.Context, id string) error {
+	_, err := b.do(ctx, "DEL", b.keyPrefix+id)
+	return err
+}
+
+// Keys walks the keyspace with SCAN, so the server is never blocked the way
+// KEYS would block it.
+func (b *respBackend[V]) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var ids []string
+	pattern := b.keyPrefix + escapeRESPPattern(prefix) + "*"
+	cursor := "0"
+	for {
+		reply, err := b.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", strconv.Itoa(respScanCount))
+		if err != nil {
+			return nil, err
+		}
+
+		page, ok := reply.([]interface{})
+		if !ok || len(page) != 2 {
+			return nil, errors.Errorf("unexpected SCAN reply: %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		for _, key := range keys {
+			if key, ok := key.([]byte); ok {
+				ids = append(ids, strings.TrimPrefix(string(key), b.keyPrefix))
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return ids, nil
+		}
+	}
+}
+
+func escapeRESPPattern(prefix string) string {
+	var sb strings.Builder
+	for _, r := range prefix {
+		if strings.ContainsRune(`*?[]\`, r) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func (b *respBackend[V]) Close() error {
+	for {
+		select {
+		case c := <-b.conns:
+			_ = c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (b *respBackend[V]) ttlMillis(ttl time.Duration) string {
+	return strconv.FormatInt(max((ttl+b.staleGrace).Milliseconds(), 1), 10)
+}
+
+// do sends one command and reads its reply. Connections that fail are
+// closed instead of going back to the pool.
+func (b *respBackend[V]) do(ctx context.Context, args ...string) (interface{}, error) {
+	c, err := b.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.roundTrip(b.deadline(ctx), args...)
+	var replyErr respError
+	if err != nil && !errors.As(err, &replyErr) {
+		_ = c.conn.Close()
+		return nil, errors.Wrapf(err, "resp %s failed", args[0])
+	}
+
+	b.release(c)
+	return reply, err
+}
+
+func (b *respBackend[V]) deadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(b.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+func (b *respBackend[V]) acquire(ctx context.Context) (*respConn, error) {
+	select {
+	case c := <-b.conns:
+		return c, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: b.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", b.address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s", b.address)
+	}
+
+	c := &respConn{conn: conn, r: bufio.NewReader(conn)}
+	if b.password != "" {
+		if _, err := c.roundTrip(b.deadline(ctx), "AUTH", b.password); err != nil {
+			_ = conn.Close()
+			return nil, errors.Wrap(err, "resp auth failed")
+		}
+	}
+	if b.db != 0 {
+		if _, err := c.roundTrip(b.deadline(ctx), "SELECT", strconv.Itoa(b.db)); err != nil {
+			_ = conn.Close()
+			return nil, errors.Wrap(err, "resp select failed")
+		}
+	}
+	return c, nil
+}
+
+func (b *respBackend[V]) release(c *respConn) {
+	select {
+	case b.conns <- c:
+	default:
+		_ = c.conn.Close()
+	}
+}
+
+func (c *respConn) roundTrip(deadline time.Time, args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(encodeRESPCommand(args...)); err != nil {
+		return nil, err
+	}
+	return readRESPReply(c.r)
+}
+
+func encodeRESPCommand(args ...string) []byte {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	return buf
+}
+
+// readRESPReply reads one RESP2 value. Bulk strings come back as []byte,
+// null bulk strings and arrays as nil and error replies as respError.
+func readRESPReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty resp reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		payload := make([]byte, n+2)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+		return payload[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRESPReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, errors.Errorf("unknown resp reply type: %q", line[0])
+	}
+}
+
+func readRESPLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed resp line")
+	}
+	return line[:len(line)-2], nil
+}
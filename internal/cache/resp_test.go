@@ -0,0 +1,308 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/mocks"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+// respStandIn is an in-process server speaking enough of the Redis protocol
+// for respBackend.
+type respStandIn struct {
+	listener net.Listener
+	password string
+
+	mu        sync.Mutex
+	values    map[string][]byte
+	expiredAt map[string]time.Time
+	commands  map[string]int
+}
+
+func newRESPStandIn(t *testing.T, password string) *respStandIn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &respStandIn{
+		listener:  listener,
+		password:  password,
+		values:    make(map[string][]byte),
+		expiredAt: make(map[string]time.Time),
+		commands:  make(map[string]int),
+	}
+	go srv.serve()
+	t.Cleanup(func() { _ = listener.Close() })
+	return srv
+}
+
+func (srv *respStandIn) addr() string {
+	return srv.listener.Addr().String()
+}
+
+func (srv *respStandIn) serve() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		go srv.handle(conn)
+	}
+}
+
+func (srv *respStandIn) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	authenticated := srv.password == ""
+	for {
+		reply, err := readRESPReply(r)
+		if err != nil {
+			return
+		}
+
+		items := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i] = string(item.([]byte))
+		}
+
+		cmd := strings.ToUpper(args[0])
+		if cmd == "AUTH" {
+			authenticated = args[1] == srv.password
+		}
+		if !authenticated {
+			_, _ = conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			continue
+		}
+		_, _ = conn.Write(srv.exec(cmd, args[1:]))
+	}
+}
+
+func (srv *respStandIn) exec(cmd string, args []string) []byte {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.commands[cmd]++
+
+	switch cmd {
+	case "AUTH", "SELECT", "PING":
+		return []byte("+OK\r\n")
+	case "SET":
+		srv.values[args[0]] = []byte(args[1])
+		srv.expire(args[0], args[2:])
+		return []byte("+OK\r\n")
+	case "GET":
+		value, ok := srv.values[args[0]]
+		if !ok || time.Now().After(srv.expiredAt[args[0]]) {
+			return []byte("$-1\r\n")
+		}
+		return []byte("$" + strconv.Itoa(len(value)) + "\r\n" + string(value) + "\r\n")
+	case "MGET":
+		reply := "*" + strconv.Itoa(len(args)) + "\r\n"
+		for _, key := range args {
+			value, ok := srv.values[key]
+			if !ok || time.Now().After(srv.expiredAt[key]) {
+				reply += "$-1\r\n"
+				continue
+			}
+			reply += "$" + strconv.Itoa(len(value)) + "\r\n" + string(value) + "\r\n"
+		}
+		return []byte(reply)
+	case "DEL":
+		_, ok := srv.values[args[0]]
+		delete(srv.values, args[0])
+		if ok {
+			return []byte(":1\r\n")
+		}
+		return []byte(":0\r\n")
+	case "EVAL":
+		// Only the script used by respBackend.Set is understood: args are
+		// script, numkeys, key, payload, ttl and version.
+		var current struct {
+			Version int64 `json:"version"`
+		}
+		if value, ok := srv.values[args[2]]; ok && !time.Now().After(srv.expiredAt[args[2]]) {
+			version, _ := strconv.ParseInt(args[5], 10, 64)
+			if json.Unmarshal(value, &current) == nil && current.Version > version {
+				return []byte(":0\r\n")
+			}
+		}
+		srv.values[args[2]] = []byte(args[3])
+		srv.expire(args[2], []string{"PX", args[4]})
+		return []byte(":1\r\n")
+	case "SCAN":
+		// Every key is returned in a single page, the cursor is always 0.
+		var keys []string
+		for key := range srv.values {
+			if ok, _ := path.Match(args[2], key); ok {
+				keys = append(keys, "$"+strconv.Itoa(len(key))+"\r\n"+key+"\r\n")
+			}
+		}
+		return []byte("*2\r\n$1\r\n0\r\n*" + strconv.Itoa(len(keys)) + "\r\n" + strings.Join(keys, ""))
+	default:
+		return []byte("-ERR unknown command '" + cmd + "'\r\n")
+	}
+}
+
+func (srv *respStandIn) expire(key string, opts []string) {
+	if len(opts) == 2 && strings.EqualFold(opts[0], "PX") {
+		ms, _ := strconv.Atoi(opts[1])
+		srv.expiredAt[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+	}
+}
+
+func TestRESPBackend(t *testing.T) {
+	testCases := []struct {
+		name     string
+		password string
+		auth     string
+		wantErr  bool
+	}{
+		{
+			name: "без пароля",
+		},
+		{
+			name:     "с верным паролем",
+			password: "secret",
+			auth:     "secret",
+		},
+		{
+			name:     "с неверным паролем",
+			password: "secret",
+			auth:     "wrong",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newRESPStandIn(t, tc.password)
+			backend := newRESPBackend[*models.User](config.Redis{Address: srv.addr(), Password: tc.auth}, userCacheName, newTTLValue(time.Minute, 0), 0)
+			defer backend.Close()
+
+			ctx := context.Background()
+			user := &models.User{ID: uuid.New(), Name: "Daniel", Age: 30, Anonymous: true, Version: 2}
+
+			t.Log("storing user in resp backend\n")
+			err := backend.Set(ctx, user.ID.String(), user, user.Version)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			cached, ok, err := backend.Get(ctx, user.ID.String())
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, user, cached.Value)
+			require.True(t, cached.fresh(time.Now()))
+
+			t.Log("older version does not replace stored user\n")
+			require.NoError(t, backend.Set(ctx, user.ID.String(), &models.User{ID: user.ID, Name: "Old", Version: 1}, 1))
+			cached, _, err = backend.Get(ctx, user.ID.String())
+			require.NoError(t, err)
+			require.Equal(t, int64(2), cached.Version)
+			require.Equal(t, user, cached.Value)
+
+			ids, err := backend.Keys(ctx, user.ID.String()[:8])
+			require.NoError(t, err)
+			require.Equal(t, []string{user.ID.String()}, ids)
+
+			t.Log("entry written by the previous release is read\n")
+			srv.mu.Lock()
+			srv.values[userCacheName+":"+user.ID.String()] = []byte(`{"user":{"id":"` + user.ID.String() +
+				`","name":"Daniel","age":30},"storedAt":"` + time.Now().Format(time.RFC3339Nano) +
+				`","expiredAt":"` + time.Now().Add(time.Minute).Format(time.RFC3339Nano) + `"}`)
+			srv.mu.Unlock()
+			cached, ok, err = backend.Get(ctx, user.ID.String())
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, "Daniel", cached.Value.Name)
+
+			t.Log("deleting user from resp backend\n")
+			require.NoError(t, backend.Delete(ctx, user.ID.String()))
+			_, ok, err = backend.Get(ctx, user.ID.String())
+			require.NoError(t, err)
+			require.False(t, ok)
+		})
+	}
+}
+
+func TestCacheDecorator_SharedKeys(t *testing.T) {
+	srv := newRESPStandIn(t, "")
+	cache, err := NewCacheDecorator(nil, config.Cache{TTL: time.Minute, Backend: BackendRedis, Redis: config.Redis{Address: srv.addr()}})
+	require.NoError(t, err)
+	defer cache.Close()
+
+	ctx := context.Background()
+	for _, id := range []string{"aa-1", "aa-2", "aa-3"} {
+		cache.set(ctx, &models.User{ID: uuid.New(), Name: "Daniel"}, id)
+	}
+
+	t.Log("entries of listed keys are read with one command\n")
+	keys, err := cache.Keys(ctx, "aa-")
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+	require.WithinDuration(t, keys[0].StoredAt.Add(time.Minute), keys[0].ExpiredAt, time.Millisecond)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	require.Equal(t, 1, srv.commands["MGET"])
+	require.Zero(t, srv.commands["GET"])
+}
+
+func TestCacheDecorator_SharedBackend(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	srv := newRESPStandIn(t, "")
+	id := uuid.New()
+	mockUserProvider := mocks.NewMockUserProvider(ctrl)
+	mockUserProvider.EXPECT().
+		GetUser(gomock.Any(), id.String()).
+		Return(&models.User{ID: id, Name: "Daniel", Age: 30}, nil).
+		Times(1)
+
+	cfg := config.Cache{TTL: time.Minute, Backend: BackendLayered, Redis: config.Redis{Address: srv.addr()}}
+	first, err := NewCacheDecorator(mockUserProvider, cfg)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := NewCacheDecorator(mockUserProvider, cfg)
+	require.NoError(t, err)
+	defer second.Close()
+
+	t.Log("first replica loads user from repository\n")
+	user, err := first.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+	require.Equal(t, 1, first.ElementCount())
+
+	t.Log("second replica finds user in shared backend\n")
+	shared, err := second.GetUser(context.Background(), id.String())
+	require.NoError(t, err)
+	require.Equal(t, user, shared)
+	require.Equal(t, 1, second.ElementCount())
+
+	t.Log("deleting through one replica clears shared backend\n")
+	mockUserProvider.EXPECT().DeleteUser(gomock.Any(), id.String(), int64(0)).Return(nil)
+	require.NoError(t, first.DeleteUser(context.Background(), id.String(), 0))
+	_, ok, err := newRESPBackend[*models.User](cfg.Redis, userCacheName, newTTLValue(cfg.TTL, 0), 0).Get(context.Background(), id.String())
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestNewCacheDecorator_UnknownBackend(t *testing.T) {
+	_, err := NewCacheDecorator(nil, config.Cache{TTL: time.Second, Backend: "memcached"})
+	require.Error(t, err)
+}
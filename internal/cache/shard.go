@@ -0,0 +1,301 @@
+package cache
+
+import (
+	"container/heap"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultShards    = 16
+	accessBufferSize = 64
+)
+
+type wrapEntry[V any] struct {
+	id       string
+	value    V
+	version  int64
+	size     int
+	storedAt time.Time
+	// expiredAt holds unix nanoseconds, it is renewed on hits under the
+	// shard read lock.
+	expiredAt atomic.Int64
+
+	// deadline and index place the entry in the shard expiry queue, they
+	// are only touched under the shard write lock.
+	deadline int64
+	index    int
+}
+
+func newWrapEntry[V any](id string, value V, version int64, ttl time.Duration, size Sizer[V]) *wrapEntry[V] {
+	wrap := &wrapEntry[V]{id: id, value: value, version: version, storedAt: time.Now(), index: -1}
+	wrap.size = getWrapEntrySize(wrap, size)
+	wrap.renew(ttl)
+	return wrap
+}
+
+// restoredWrapEntry wraps an entry read back from a snapshot, keeping the
+// times it had before the restart.
+func restoredWrapEntry[V any](id string, entry Entry[V], size Sizer[V]) *wrapEntry[V] {
+	wrap := &wrapEntry[V]{id: id, value: entry.Value, version: entry.Version, storedAt: entry.StoredAt, index: -1}
+	wrap.size = getWrapEntrySize(wrap, size)
+	wrap.expiredAt.Store(entry.ExpiredAt.UnixNano())
+	return wrap
+}
+
+func (w *wrapEntry[V]) renew(ttl time.Duration) {
+	w.expiredAt.Store(time.Now().Add(ttl).UnixNano())
+}
+
+func (w *wrapEntry[V]) expiredBefore(t time.Time) bool {
+	return w.expiredAt.Load() < t.UnixNano()
+}
+
+func (w *wrapEntry[V]) entry() Entry[V] {
+	return Entry[V]{
+		Value:     w.value,
+		Version:   w.version,
+		StoredAt:  w.storedAt,
+		ExpiredAt: time.Unix(0, w.expiredAt.Load()),
+	}
+}
+
+// shard is an independently locked part of the cache. Hits only take the
+// read lock, the accesses they make are buffered and handed to the eviction
+// policy the next time the shard is locked for writing.
+type shard[V any] struct {
+	mu       sync.RWMutex
+	items    map[string]*wrapEntry[V]
+	policy   evictionPolicy
+	accesses chan string
+	expiry   expiryQueue[V]
+
+	sizeBytes       int
+	elementCount    int
+	evictionCount   int
+	expirationCount int
+	maxEntries      int
+	maxBytes        int
+}
+
+func newShard[V any](policy evictionPolicy, maxEntries, maxBytes int) *shard[V] {
+	return &shard[V]{
+		items:      make(map[string]*wrapEntry[V]),
+		policy:     policy,
+		accesses:   make(chan string, accessBufferSize),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+func (s *shard[V]) get(id string) (*wrapEntry[V], bool) {
+	s.mu.RLock()
+	wrap, exists := s.items[id]
+	s.mu.RUnlock()
+
+	if exists {
+		// Dropping an access when the buffer is full only makes the policy
+		// slightly less precise.
+		select {
+		case s.accesses <- id:
+		default:
+		}
+	}
+	return wrap, exists
+}
+
+func (s *shard[V]) peek(id string) (*wrapEntry[V], bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wrap, exists := s.items[id]
+	return wrap, exists
+}
+
+// keys appends ids starting with prefix to dst.
+func (s *shard[V]) keys(prefix string, dst []string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for id := range s.items {
+		if strings.HasPrefix(id, prefix) {
+			dst = append(dst, id)
+		}
+	}
+	return dst
+}
+
+// entries appends every entry held by the shard to dst.
+func (s *shard[V]) entries(dst []snapshotEntry[V]) []snapshotEntry[V] {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for id, wrap := range s.items {
+		dst = append(dst, newSnapshotEntry(id, wrap.entry()))
+	}
+	return dst
+}
+
+// set stores wrap unless the shard holds a higher version of id, which
+// happens when a slow load finishes after a newer value was written.
+func (s *shard[V]) set(id string, wrap *wrapEntry[V]) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drainAccesses()
+
+	if current, exists := s.items[id]; exists {
+		if current.version > wrap.version {
+			log.Debug().Msgf("keeping newer version of key: %s", id)
+			return
+		}
+		s.replaceLocked(current, wrap)
+		return
+	}
+	s.policy.touch(id)
+	if !s.makeRoom(id, wrap.size) {
+		return
+	}
+	s.items[id] = wrap
+	wrap.deadline = wrap.expiredAt.Load()
+	heap.Push(&s.expiry, wrap)
+	s.policy.add(id)
+	s.elementCount++
+	s.sizeBytes += wrap.size
+}
+
+// replaceLocked stores wrap in place of current without dropping the key
+// from the policy, so an updated key keeps its access history. Entries are
+// evicted when the new value no longer fits. Must be called with s.mu held.
+func (s *shard[V]) replaceLocked(current, wrap *wrapEntry[V]) {
+	s.policy.touch(wrap.id)
+	if current.index >= 0 {
+		heap.Remove(&s.expiry, current.index)
+	}
+	s.items[wrap.id] = wrap
+	wrap.deadline = wrap.expiredAt.Load()
+	heap.Push(&s.expiry, wrap)
+	s.sizeBytes += wrap.size - current.size
+
+	for s.maxBytes > 0 && s.sizeBytes > s.maxBytes {
+		victim, ok := s.policy.victim()
+		if !ok {
+			return
+		}
+		log.Debug().Msgf("evicting key: %s", victim)
+		s.removeLocked(victim)
+		s.evictionCount++
+	}
+}
+
+func (s *shard[V]) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drainAccesses()
+	s.removeLocked(id)
+}
+
+// removeLocked drops id from the shard. Must be called with s.mu held.
+func (s *shard[V]) removeLocked(id string) bool {
+	wrap, exists := s.items[id]
+	if !exists {
+		return false
+	}
+	s.elementCount--
+	s.sizeBytes -= wrap.size
+	s.policy.remove(id)
+	if wrap.index >= 0 {
+		heap.Remove(&s.expiry, wrap.index)
+	}
+	delete(s.items, id)
+	return true
+}
+
+// makeRoom evicts entries until one more of the given size fits into the
+// shard limits. It returns false when the policy rejects the candidate.
+// Must be called with s.mu held.
+func (s *shard[V]) makeRoom(id string, size int) bool {
+	for s.overLimit(size) {
+		victim, ok := s.policy.victim()
+		if !ok || !s.policy.admit(id, victim) {
+			return false
+		}
+
+		log.Debug().Msgf("evicting key: %s", victim)
+		s.removeLocked(victim)
+		s.evictionCount++
+	}
+	return true
+}
+
+func (s *shard[V]) overLimit(size int) bool {
+	if s.maxEntries > 0 && s.elementCount+1 > s.maxEntries {
+		return true
+	}
+	return s.maxBytes > 0 && s.sizeBytes+size > s.maxBytes
+}
+
+// drainAccesses replays buffered hits into the policy. Must be called with
+// s.mu held.
+func (s *shard[V]) drainAccesses() {
+	for {
+		select {
+		case id := <-s.accesses:
+			s.policy.touch(id)
+		default:
+			return
+		}
+	}
+}
+
+// invalidateExpired drops entries that expired before t and returns how
+// many were dropped. Only entries whose deadline has passed are visited.
+func (s *shard[V]) invalidateExpired(t time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drainAccesses()
+
+	expired := 0
+	for len(s.expiry) > 0 && s.expiry[0].deadline < t.UnixNano() {
+		wrap := s.expiry[0]
+		if !wrap.expiredBefore(t) {
+			// Renewed by a hit after it was scheduled.
+			wrap.deadline = wrap.expiredAt.Load()
+			heap.Fix(&s.expiry, 0)
+			continue
+		}
+		s.removeLocked(wrap.id)
+		s.expirationCount++
+		expired++
+	}
+	return expired
+}
+
+func (s *shard[V]) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drainAccesses()
+	for id := range s.items {
+		s.removeLocked(id)
+	}
+}
+
+func (s *shard[V]) stats() storeStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return storeStats{
+		elementCount:    s.elementCount,
+		sizeBytes:       s.sizeBytes,
+		evictionCount:   s.evictionCount,
+		expirationCount: s.expirationCount,
+	}
+}
+
+// getWrapEntrySize estimates the memory held by one entry: the wrapper, the
+// memory owned by its value and the map key.
+func getWrapEntrySize[V any](wrap *wrapEntry[V], size Sizer[V]) int {
+	total := int(unsafe.Sizeof(*wrap)) + size(wrap.value)
+	total += int(unsafe.Sizeof(wrap.id)) + len(wrap.id)
+	return total
+}
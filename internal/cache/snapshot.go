@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// snapshotFormat is bumped whenever the snapshot layout changes, snapshots
+// written in another format are rejected.
+const snapshotFormat = 2
+
+// snapshotEntry is a cached value as written to the snapshot file.
+type snapshotEntry[V any] struct {
+	ID        string    `json:"id"`
+	Value     V         `json:"value"`
+	Version   int64     `json:"version"`
+	StoredAt  time.Time `json:"storedAt"`
+	ExpiredAt time.Time `json:"expiredAt"`
+}
+
+func newSnapshotEntry[V any](id string, entry Entry[V]) snapshotEntry[V] {
+	return snapshotEntry[V]{ID: id, Value: entry.Value, Version: entry.Version, StoredAt: entry.StoredAt, ExpiredAt: entry.ExpiredAt}
+}
+
+func (e snapshotEntry[V]) entry() Entry[V] {
+	return Entry[V]{Value: e.Value, Version: e.Version, StoredAt: e.StoredAt, ExpiredAt: e.ExpiredAt}
+}
+
+type snapshot[V any] struct {
+	Format  int                `json:"format"`
+	SavedAt time.Time          `json:"savedAt"`
+	Entries []snapshotEntry[V] `json:"entries"`
+}
+
+// SaveSnapshot writes the entries held in process memory to path, so the
+// next start does not begin with a cold cache. Hits push the expiration of
+// an entry forward, so the maxEntries entries expiring last are the most
+// recently used ones; zero keeps every entry. The file is replaced
+// atomically and returns how many entries were written.
+func (cache *ReadThrough[K, V]) SaveSnapshot(path string, maxEntries int) (int, error) {
+	local, ok := cache.backend.(localStore[V])
+	if !ok {
+		return 0, nil
+	}
+
+	entries := local.entries()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ExpiredAt.After(entries[j].ExpiredAt)
+	})
+	if maxEntries > 0 && len(entries) > maxEntries {
+		entries = entries[:maxEntries]
+	}
+
+	payload, err := json.Marshal(snapshot[V]{Format: snapshotFormat, SavedAt: time.Now(), Entries: entries})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to encode cache snapshot")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create cache snapshot")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(payload); err != nil {
+		_ = tmp.Close()
+		return 0, errors.Wrap(err, "failed to write cache snapshot")
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, errors.Wrap(err, "failed to write cache snapshot")
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, errors.Wrap(err, "failed to replace cache snapshot")
+	}
+	return len(entries), nil
+}
+
+// LoadSnapshot restores entries written by SaveSnapshot. Entries stored
+// longer than the TTL ago are dropped, the rest keep their original
+// expiration. A missing snapshot is not an error.
+func (cache *ReadThrough[K, V]) LoadSnapshot(path string) (int, error) {
+	local, ok := cache.backend.(localStore[V])
+	if !ok {
+		return 0, nil
+	}
+
+	payload, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read cache snapshot")
+	}
+
+	var snap snapshot[V]
+	if err := json.Unmarshal(payload, &snap); err != nil {
+		return 0, errors.Wrap(err, "failed to decode cache snapshot")
+	}
+	if snap.Format != snapshotFormat {
+		return 0, errors.Errorf("unsupported cache snapshot format: %d", snap.Format)
+	}
+
+	now := time.Now()
+	ttl := cache.ttl.get()
+	restored := 0
+	for _, e := range snap.Entries {
+		if now.Sub(e.StoredAt) >= ttl || !e.ExpiredAt.After(now) {
+			continue
+		}
+		local.restore(e.ID, e.entry())
+		restored++
+	}
+	return restored, nil
+}
@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/cache"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+type CacheAdmin interface {
+	Keys(ctx context.Context, prefix string) ([]cache.KeyInfo, error)
+	Peek(ctx context.Context, id string) (cache.Entry[*models.User], bool, error)
+	Purge(ctx context.Context, id string) error
+	PurgePrefix(ctx context.Context, prefix string) (int, error)
+	Flush(ctx context.Context) (int, error)
+	TTL() time.Duration
+	SetTTL(ttl time.Duration) error
+	CleanerInterval() time.Duration
+	SetCleanerInterval(interval time.Duration) error
+}
+
+// AdminHandler exposes cache maintenance operations. It is served on a
+// separate port and must not be reachable from the public network.
+type AdminHandler struct {
+	cache CacheAdmin
+}
+
+func NewAdminHandler(cache CacheAdmin) *AdminHandler {
+	return &AdminHandler{cache: cache}
+}
+
+func (h *AdminHandler) ListKeys(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "AdminHandler.ListKeys")
+	defer span.End()
+
+	keys, err := h.cache.Keys(spanCtx, ctx.Query("prefix"))
+	if err != nil {
+		log.Err(err).Msg("failed to list cache keys")
+		return errors.Wrap(err, "failed to list cache keys")
+	}
+
+	response := make([]models.CacheKeyResponse, len(keys))
+	for i, key := range keys {
+		response[i] = models.CacheKeyResponse{ID: key.ID, StoredAt: key.StoredAt, ExpiredAt: key.ExpiredAt}
+	}
+	return ctx.JSON(fiber.Map{"data": response})
+}
+
+func (h *AdminHandler) GetEntry(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "AdminHandler.GetEntry")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("id", ctx.Params("id")), // Параметр запроса (id)
+	)
+
+	id := ctx.Params("id")
+	entry, exists, err := h.cache.Peek(spanCtx, id)
+	if err != nil {
+		log.Err(err).Msgf("failed to get cached user: %s", id)
+		return errors.Wrap(err, "failed to get cached user")
+	}
+	if !exists {
+		return fiber.NewError(http.StatusNotFound)
+	}
+
+	return ctx.JSON(fiber.Map{"data": models.CacheEntryResponse{
+		CacheKeyResponse: models.CacheKeyResponse{ID: id, StoredAt: entry.StoredAt, ExpiredAt: entry.ExpiredAt},
+		User:             h.mapUserToResponse(entry.Value),
+	}})
+}
+
+func (h *AdminHandler) PurgeEntry(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "AdminHandler.PurgeEntry")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("id", ctx.Params("id")), // Параметр запроса (id)
+	)
+
+	id := ctx.Params("id")
+	if err := h.cache.Purge(spanCtx, id); err != nil {
+		log.Err(err).Msgf("failed to purge cached user: %s", id)
+		return errors.Wrap(err, "failed to purge cached user")
+	}
+
+	log.Info().Msgf("admin purged cached user: %s", id)
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+// PurgePrefix drops the entries whose id starts with the prefix query
+// parameter. An empty prefix is rejected, Flush drops everything.
+func (h *AdminHandler) PurgePrefix(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "AdminHandler.PurgePrefix")
+	defer span.End()
+
+	prefix := ctx.Query("prefix")
+	if prefix == "" {
+		return fiber.NewError(http.StatusBadRequest, "prefix is required")
+	}
+
+	purged, err := h.cache.PurgePrefix(spanCtx, prefix)
+	if err != nil {
+		log.Err(err).Msgf("failed to purge cached users by prefix: %s", prefix)
+		return errors.Wrap(err, "failed to purge cached users")
+	}
+
+	log.Info().Msgf("admin purged %d cached users by prefix: %s", purged, prefix)
+	return ctx.JSON(fiber.Map{"purged": purged})
+}
+
+func (h *AdminHandler) Flush(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "AdminHandler.Flush")
+	defer span.End()
+
+	purged, err := h.cache.Flush(spanCtx)
+	if err != nil {
+		log.Err(err).Msg("failed to flush cache")
+		return errors.Wrap(err, "failed to flush cache")
+	}
+
+	log.Info().Msgf("admin flushed cache, %d users purged", purged)
+	return ctx.JSON(fiber.Map{"purged": purged})
+}
+
+func (h *AdminHandler) GetSettings(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx.UserContext(), "AdminHandler.GetSettings")
+	defer span.End()
+
+	return ctx.JSON(fiber.Map{"data": h.settings()})
+}
+
+// UpdateSettings changes the TTL and the cleaner interval, fields left empty
+// keep their current value.
+func (h *AdminHandler) UpdateSettings(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx.UserContext(), "AdminHandler.UpdateSettings")
+	defer span.End()
+
+	var settingsReq models.CacheSettings
+	if err := ctx.BodyParser(&settingsReq); err != nil {
+		log.Err(err).Msg("failed to parse cache settings")
+		return fiber.NewError(http.StatusBadRequest, "invalid input")
+	}
+
+	var ttl, cleanerInterval time.Duration
+	var err error
+	if settingsReq.TTL != "" {
+		if ttl, err = time.ParseDuration(settingsReq.TTL); err != nil || ttl <= 0 {
+			return fiber.NewError(http.StatusBadRequest, "invalid ttl")
+		}
+	}
+	if settingsReq.CleanerInterval != "" {
+		if cleanerInterval, err = time.ParseDuration(settingsReq.CleanerInterval); err != nil || cleanerInterval <= 0 {
+			return fiber.NewError(http.StatusBadRequest, "invalid cleaner interval")
+		}
+	}
+
+	if ttl > 0 {
+		if err := h.cache.SetTTL(ttl); err != nil {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		log.Info().Msgf("admin changed cache ttl to %s", ttl)
+	}
+	if cleanerInterval > 0 {
+		if err := h.cache.SetCleanerInterval(cleanerInterval); err != nil {
+			return fiber.NewError(http.StatusConflict, err.Error())
+		}
+		log.Info().Msgf("admin changed cache cleaner interval to %s", cleanerInterval)
+	}
+
+	return ctx.JSON(fiber.Map{"data": h.settings()})
+}
+
+func (h *AdminHandler) mapUserToResponse(u *models.User) models.UserResponse {
+	return models.UserResponse{
+		ID:        u.ID,
+		Name:      u.Name,
+		Age:       u.Age,
+		Anonymous: u.Anonymous,
+	}
+}
+
+func (h *AdminHandler) settings() models.CacheSettings {
+	return models.CacheSettings{
+		TTL:             h.cache.TTL().String(),
+		CleanerInterval: h.cache.CleanerInterval().String(),
+	}
+}
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/dankru/Api_gateway_v2/internal/validation"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const defaultMaxBatchItems = 1000
+
+// CreateUsers creates the valid users of the batch in one transaction.
+// Invalid users are reported per item. An atomic batch is rejected as a
+// whole when any user is invalid or cannot be inserted, the item at fault is
+// reported with its error; other batches report failed inserts per item and
+// keep the rest.
+func (h *Handler) CreateUsers(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "Handler.CreateUsers")
+	defer span.End()
+
+	var batchReq models.BatchCreateRequest
+	if err := ctx.BodyParser(&batchReq); err != nil {
+		log.Err(err).Msg("failed to parse batch input")
+		return fiber.NewError(http.StatusBadRequest, "invalid input")
+	}
+	if err := h.checkBatchSize(len(batchReq.Users)); err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("batch.size", len(batchReq.Users)))
+
+	results := make([]models.BatchItemResult, len(batchReq.Users))
+	valid := make([]models.UserRequest, 0, len(batchReq.Users))
+	positions := make([]int, 0, len(batchReq.Users))
+	for i, userReq := range batchReq.Users {
+		if err := validation.Validate(userReq); err != nil {
+			results[i] = models.BatchItemResult{Status: http.StatusBadRequest, Error: err.Error()}
+			continue
+		}
+		valid = append(valid, userReq)
+		positions = append(positions, i)
+	}
+
+	if batchReq.Atomic && len(valid) < len(batchReq.Users) {
+		for _, i := range positions {
+			results[i] = models.BatchItemResult{Status: http.StatusFailedDependency, Error: "batch rejected"}
+		}
+		return ctx.Status(http.StatusUnprocessableEntity).JSON(fiber.Map{"results": results})
+	}
+
+	if !batchReq.Atomic {
+		ids, errs, err := h.userUC.CreateUsersPartially(spanCtx, valid)
+		if err != nil {
+			log.Err(err).Msgf("failed to create %d users", len(valid))
+			return errors.Wrap(err, "failed to insert into users")
+		}
+		for j, i := range positions {
+			if errs[j] != nil {
+				log.Err(errs[j]).Msgf("failed to create user %d of the batch", i)
+				results[i] = batchItemError(errs[j])
+				continue
+			}
+			results[i] = models.BatchItemResult{ID: ids[j].String(), Status: http.StatusCreated}
+		}
+		return ctx.JSON(fiber.Map{"results": results})
+	}
+
+	ids, err := h.userUC.CreateUsers(spanCtx, valid)
+	var itemErr *apperr.BatchItemError
+	if errors.As(err, &itemErr) && apperr.Rejected(itemErr) {
+		log.Err(err).Msgf("failed to create user %d of the atomic batch", positions[itemErr.Index])
+		for _, i := range positions {
+			results[i] = models.BatchItemResult{Status: http.StatusFailedDependency, Error: "batch rejected"}
+		}
+		failed := batchItemError(itemErr.Err)
+		results[positions[itemErr.Index]] = failed
+		return ctx.Status(failed.Status).JSON(fiber.Map{"results": results})
+	}
+	if err != nil {
+		log.Err(err).Msgf("failed to create %d users", len(valid))
+		return errors.Wrap(err, "failed to insert into users")
+	}
+	for j, i := range positions {
+		results[i] = models.BatchItemResult{ID: ids[j].String(), Status: http.StatusCreated}
+	}
+
+	return ctx.JSON(fiber.Map{"results": results})
+}
+
+// GetUsers fetches users by id. Cached users are served from the cache and
+// the rest are loaded with a single query.
+func (h *Handler) GetUsers(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "Handler.GetUsers")
+	defer span.End()
+
+	ids, results, err := h.parseBatchIDs(ctx)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("batch.size", len(results)))
+
+	users, err := h.userUC.GetUsers(spanCtx, validIDs(ids))
+	if err != nil {
+		log.Err(err).Msgf("failed to get %d users", len(ids))
+		return errors.Wrap(err, "failed to get users")
+	}
+
+	found := make(map[string]*models.User, len(users))
+	for _, user := range users {
+		found[user.ID.String()] = user
+	}
+	for i, id := range ids {
+		if id == "" {
+			continue
+		}
+		user, ok := found[id]
+		if !ok {
+			results[i] = models.BatchItemResult{ID: id, Status: http.StatusNotFound, Error: "user not found"}
+			continue
+		}
+		response := h.mapUserToResponse(user)
+		results[i] = models.BatchItemResult{ID: id, Status: http.StatusOK, User: &response}
+	}
+
+	return ctx.JSON(fiber.Map{"results": results})
+}
+
+// DeleteUsers soft-deletes users by id in one statement.
+func (h *Handler) DeleteUsers(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "Handler.DeleteUsers")
+	defer span.End()
+
+	ids, results, err := h.parseBatchIDs(ctx)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("batch.size", len(results)))
+
+	deleted, err := h.userUC.DeleteUsers(spanCtx, validIDs(ids))
+	if err != nil {
+		log.Err(err).Msgf("failed to delete %d users", len(ids))
+		return errors.Wrap(err, "failed to delete users")
+	}
+
+	removed := make(map[string]struct{}, len(deleted))
+	for _, id := range deleted {
+		removed[id] = struct{}{}
+	}
+	for i, id := range ids {
+		if id == "" {
+			continue
+		}
+		if _, ok := removed[id]; !ok {
+			results[i] = models.BatchItemResult{ID: id, Status: http.StatusNotFound, Error: "user not found"}
+			continue
+		}
+		results[i] = models.BatchItemResult{ID: id, Status: http.StatusNoContent}
+	}
+
+	return ctx.JSON(fiber.Map{"results": results})
+}
+
+func (h *Handler) checkBatchSize(size int) error {
+	if size == 0 {
+		return fiber.NewError(http.StatusBadRequest, "batch is empty")
+	}
+	if size > h.maxBatchItems {
+		return fiber.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("batch exceeds %d items", h.maxBatchItems))
+	}
+	return nil
+}
+
+// parseBatchIDs reads the ids of a batch request. Valid ids are returned in
+// their canonical form, invalid ones are left empty and already have their
+// result filled in.
+func (h *Handler) parseBatchIDs(ctx *fiber.Ctx) ([]string, []models.BatchItemResult, error) {
+	var batchReq models.BatchIDsRequest
+	if err := ctx.BodyParser(&batchReq); err != nil {
+		log.Err(err).Msg("failed to parse batch input")
+		return nil, nil, fiber.NewError(http.StatusBadRequest, "invalid input")
+	}
+	if err := h.checkBatchSize(len(batchReq.IDs)); err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]string, len(batchReq.IDs))
+	results := make([]models.BatchItemResult, len(batchReq.IDs))
+	for i, raw := range batchReq.IDs {
+		id, err := uuid.Parse(raw)
+		if err != nil {
+			results[i] = models.BatchItemResult{ID: raw, Status: http.StatusBadRequest, Error: "invalid uuid"}
+			continue
+		}
+		ids[i] = id.String()
+	}
+	return ids, results, nil
+}
+
+func validIDs(ids []string) []string {
+	valid := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" {
+			valid = append(valid, id)
+		}
+	}
+	return valid
+}
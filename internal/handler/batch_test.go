@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/dankru/Api_gateway_v2/internal/mocks"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/dankru/Api_gateway_v2/internal/usecase"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/mock/gomock"
+)
+
+func TestHandler_CreateUsers(t *testing.T) {
+	created := uuid.New()
+	conflict := &apperr.DBError{Kind: apperr.ErrConflict, Constraint: "users_pkey", Err: errors.New("duplicate key")}
+	body := `{"atomic":%t,"users":[{"name":"Daniel","age":30},{"name":"D","age":30},{"name":"Daniil","age":31}]}`
+
+	testCases := []struct {
+		name        string
+		atomic      bool
+		body        string
+		setup       func(repo *mocks.MockUserProvider)
+		wantStatus  int
+		wantResults []int
+	}{
+		{
+			name:   "ошибка вставки отмечается у своего элемента",
+			atomic: false,
+			setup: func(repo *mocks.MockUserProvider) {
+				repo.EXPECT().CreateUsersPartially(gomock.Any(), []models.UserRequest{{Name: "Daniel", Age: 30}, {Name: "Daniil", Age: 31}}).
+					Return([]uuid.UUID{created, uuid.Nil}, []error{nil, conflict}, nil)
+			},
+			wantStatus:  http.StatusOK,
+			wantResults: []int{http.StatusCreated, http.StatusBadRequest, http.StatusConflict},
+		},
+		{
+			name:   "атомарный пакет с отклонённой вставкой называет элемент",
+			atomic: true,
+			setup: func(repo *mocks.MockUserProvider) {
+				repo.EXPECT().CreateUsers(gomock.Any(), gomock.Len(2)).Return(nil, &apperr.BatchItemError{Index: 1, Err: conflict})
+			},
+			body:        `{"atomic":true,"users":[{"name":"Daniel","age":30},{"name":"Daniil","age":31}]}`,
+			wantStatus:  http.StatusConflict,
+			wantResults: []int{http.StatusFailedDependency, http.StatusConflict},
+		},
+		{
+			name:        "атомарный пакет с невалидным элементом отклоняется",
+			atomic:      true,
+			setup:       func(repo *mocks.MockUserProvider) {},
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantResults: []int{http.StatusFailedDependency, http.StatusBadRequest, http.StatusFailedDependency},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			repo := mocks.NewMockUserProvider(ctrl)
+			tc.setup(repo)
+
+			handler := NewHandler(usecase.NewUserUsecase(repo, nil), config.App{})
+			app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+			app.Post("/user/batch", handler.CreateUsers)
+
+			reqBody := tc.body
+			if reqBody == "" {
+				reqBody = fmt.Sprintf(body, tc.atomic)
+			}
+			resp, respBody := doRequest(t, app, http.MethodPost, "/user/batch", reqBody,
+				map[string]string{fiber.HeaderContentType: fiber.MIMEApplicationJSON})
+			require.Equal(t, tc.wantStatus, resp.StatusCode, respBody)
+
+			var batchResp struct {
+				Results []models.BatchItemResult `json:"results"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(respBody), &batchResp))
+			statuses := make([]int, 0, len(batchResp.Results))
+			for _, result := range batchResp.Results {
+				statuses = append(statuses, result.Status)
+			}
+			require.Equal(t, tc.wantResults, statuses)
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+)
+
+// dbErrorStatuses maps the kinds of apperr.DBError to the status they are
+// answered with.
+var dbErrorStatuses = map[error]int{
+	apperr.ErrConflict:    http.StatusConflict,
+	apperr.ErrValidation:  http.StatusUnprocessableEntity,
+	apperr.ErrUnavailable: http.StatusServiceUnavailable,
+}
+
+// ErrorHandler answers the errors handlers return. Classified database errors
+// get their own status and name the violated constraint, everything else is
+// left to fiber.DefaultErrorHandler.
+func ErrorHandler(ctx *fiber.Ctx, err error) error {
+	var dbErr *apperr.DBError
+	if !errors.As(err, &dbErr) {
+		return fiber.DefaultErrorHandler(ctx, err)
+	}
+	status, ok := dbErrorStatuses[dbErr.Kind]
+	if !ok {
+		return fiber.DefaultErrorHandler(ctx, err)
+	}
+
+	body := fiber.Map{"error": dbErr.Kind.Error()}
+	if dbErr.Constraint != "" {
+		body["constraint"] = dbErr.Constraint
+	}
+	if status == http.StatusServiceUnavailable {
+		ctx.Set(fiber.HeaderRetryAfter, "1")
+	}
+	return ctx.Status(status).JSON(body)
+}
+
+// batchItemError is the result of a batch item whose write failed, with the
+// status ErrorHandler would answer the error with on its own.
+func batchItemError(err error) models.BatchItemResult {
+	var dbErr *apperr.DBError
+	if errors.As(err, &dbErr) {
+		if status, ok := dbErrorStatuses[dbErr.Kind]; ok {
+			message := dbErr.Kind.Error()
+			if dbErr.Constraint != "" {
+				message += ": " + dbErr.Constraint
+			}
+			return models.BatchItemResult{Status: status, Error: message}
+		}
+	}
+	return models.BatchItemResult{Status: http.StatusInternalServerError, Error: http.StatusText(http.StatusInternalServerError)}
+}
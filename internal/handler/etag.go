@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// userETag is the strong entity tag of a user, its version. The database
+// bumps the version on every update, so equal tags mean equal users.
+func userETag(u *models.User) string {
+	return `"` + strconv.FormatInt(u.Version, 10) + `"`
+}
+
+// parseETags splits an If-Match or If-None-Match list. Weak tags are
+// returned with their W/ prefix.
+func parseETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// notModified reports whether If-None-Match matches etag. The comparison is
+// weak, as RFC 9110 requires for If-None-Match.
+func notModified(ctx *fiber.Ctx, etag string) bool {
+	for _, tag := range parseETags(ctx.Get(fiber.HeaderIfNoneMatch)) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedVersion returns the version required by If-Match, zero when any
+// version may be overwritten. Without the header writes are rejected with
+// 428 if preconditions are required. Weak tags never match, so they fail
+// with 412 just like an outdated version.
+func (h *Handler) expectedVersion(ctx *fiber.Ctx) (int64, error) {
+	header := ctx.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		if h.requireIfMatch {
+			return 0, fiber.NewError(http.StatusPreconditionRequired, "If-Match header is required")
+		}
+		return 0, nil
+	}
+
+	tags := parseETags(header)
+	if len(tags) == 1 && tags[0] == "*" {
+		return 0, nil
+	}
+	if len(tags) != 1 {
+		return 0, fiber.NewError(http.StatusBadRequest, "If-Match must hold a single entity tag")
+	}
+
+	version, err := strconv.ParseInt(strings.Trim(tags[0], `"`), 10, 64)
+	if err != nil || version <= 0 || !strings.HasPrefix(tags[0], `"`) {
+		return 0, fiber.NewError(http.StatusPreconditionFailed)
+	}
+	return version, nil
+}
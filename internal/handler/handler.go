@@ -1,11 +1,19 @@
 package handler
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/dankru/Api_gateway_v2/config"
 	"github.com/dankru/Api_gateway_v2/internal/apperr"
 	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/dankru/Api_gateway_v2/internal/patch"
 	"github.com/dankru/Api_gateway_v2/internal/usecase"
 	"github.com/dankru/Api_gateway_v2/internal/validation"
 	"github.com/gofiber/fiber/v2"
@@ -17,12 +25,47 @@ import (
 	"go.opentelemetry.io/otel/codes"
 )
 
+// cacheStatusHeader marks responses that were not served fresh, with the
+// reason as its value.
+const (
+	cacheStatusHeader = "X-Cache-Status"
+	cacheStatusStale  = "stale"
+)
+
+const (
+	defaultSearchMinSimilarity = 0.3
+	defaultSearchLimit         = 20
+	defaultSearchMaxLimit      = 100
+)
+
 type Handler struct {
-	userUC usecase.UserProvider
+	userUC         usecase.UserProvider
+	requireIfMatch bool
+	maxBatchItems  int
+	search         config.Search
 }
 
-func NewHandler(userUC *usecase.UserUsecase) *Handler {
-	return &Handler{userUC: userUC}
+func NewHandler(userUC *usecase.UserUsecase, cfg config.App) *Handler {
+	maxBatchItems := cfg.Batch.MaxItems
+	if maxBatchItems <= 0 {
+		maxBatchItems = defaultMaxBatchItems
+	}
+	search := cfg.Search
+	if search.MinSimilarity <= 0 || search.MinSimilarity > 1 {
+		search.MinSimilarity = defaultSearchMinSimilarity
+	}
+	if search.MaxLimit <= 0 {
+		search.MaxLimit = defaultSearchMaxLimit
+	}
+	if search.Limit <= 0 || search.Limit > search.MaxLimit {
+		search.Limit = min(defaultSearchLimit, search.MaxLimit)
+	}
+	return &Handler{
+		userUC:         userUC,
+		requireIfMatch: cfg.Preconditions.Required,
+		maxBatchItems:  maxBatchItems,
+		search:         search,
+	}
 }
 
 func (h *Handler) GetUser(ctx *fiber.Ctx) error {
@@ -40,7 +83,7 @@ func (h *Handler) GetUser(ctx *fiber.Ctx) error {
 		return fiber.NewError(http.StatusBadRequest, "invalid uuid")
 	}
 
-	user, err := h.userUC.GetUser(spanCtx, id)
+	user, stale, err := h.userUC.GetUser(spanCtx, id)
 	if err != nil {
 		if errors.Is(err, apperr.ErrNotFound) {
 			log.Err(err).Msgf("user with id: %s not found", id)
@@ -51,6 +94,16 @@ func (h *Handler) GetUser(ctx *fiber.Ctx) error {
 		span.SetStatus(codes.Error, "failed to get user")
 		return errors.Wrap(err, "failed to get user")
 	}
+	if stale {
+		span.SetAttributes(attribute.Bool("cache.stale", true))
+		ctx.Set(cacheStatusHeader, cacheStatusStale)
+	}
+
+	etag := userETag(user)
+	ctx.Set(fiber.HeaderETag, etag)
+	if notModified(ctx, etag) {
+		return ctx.SendStatus(http.StatusNotModified)
+	}
 
 	response := h.mapUserToResponse(user)
 	return ctx.JSON(fiber.Map{"data": response})
@@ -104,20 +157,140 @@ func (h *Handler) ReplaceUser(ctx *fiber.Ctx) error {
 		return fiber.NewError(http.StatusBadRequest, err.Error())
 	}
 
-	user, err := h.userUC.UpdateUser(spanCtx, id, userReq)
+	version, err := h.expectedVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	user, err := h.userUC.UpdateUser(spanCtx, id, userReq, version)
 	if err != nil {
 		if errors.Is(err, apperr.ErrNotFound) {
 			log.Err(err).Msgf("user with id: %s not found", id)
 			return fiber.NewError(http.StatusNotFound)
 		}
+		if errors.Is(err, apperr.ErrPreconditionFailed) {
+			return fiber.NewError(http.StatusPreconditionFailed)
+		}
 		log.Err(err).Msgf("failed to update user by id %s", id)
 		return errors.Wrap(err, "failed to update user")
 	}
 
+	ctx.Set(fiber.HeaderETag, userETag(user))
 	response := h.mapUserToResponse(user)
 	return ctx.JSON(fiber.Map{"data": response})
 }
 
+// PatchUser applies a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902)
+// to the user, depending on the Content-Type. The patched user is validated
+// as a whole and only the fields that actually changed are written.
+func (h *Handler) PatchUser(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "Handler.PatchUser")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("id", ctx.Params("id")), // Параметр запроса (id)
+	)
+
+	id := ctx.Params("id")
+	if err := uuid.Validate(id); err != nil {
+		log.Err(err).Msg("validation failed")
+		return fiber.NewError(http.StatusBadRequest, "invalid uuid")
+	}
+
+	var apply func(doc, patch []byte) ([]byte, error)
+	switch mediaType, _, _ := mime.ParseMediaType(ctx.Get(fiber.HeaderContentType)); mediaType {
+	case patch.MergePatchContentType:
+		apply = patch.Merge
+	case patch.JSONPatchContentType:
+		apply = patch.Apply
+	default:
+		return fiber.NewError(http.StatusUnsupportedMediaType,
+			fmt.Sprintf("content type must be %s or %s", patch.MergePatchContentType, patch.JSONPatchContentType))
+	}
+
+	version, err := h.expectedVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The patch is applied to the stored user rather than the cached one, a
+	// stale base would drop the fields the client sets back to its values.
+	user, err := h.userUC.PatchUserWith(spanCtx, id, version, func(current *models.User) (models.UserPatch, error) {
+		userReq, err := patchUserRequest(current, ctx.Body(), apply)
+		if err != nil {
+			log.Err(err).Msgf("failed to patch user by id %s", id)
+			if errors.Is(err, patch.ErrTestFailed) {
+				return models.UserPatch{}, fiber.NewError(http.StatusConflict, err.Error())
+			}
+			return models.UserPatch{}, fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+
+		if err := validation.Validate(userReq); err != nil {
+			return models.UserPatch{}, fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		return diffUser(current, userReq), nil
+	})
+	if err != nil {
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			return fiberErr
+		}
+		if errors.Is(err, apperr.ErrNotFound) {
+			log.Err(err).Msgf("user with id: %s not found", id)
+			return fiber.NewError(http.StatusNotFound)
+		}
+		if errors.Is(err, apperr.ErrPreconditionFailed) {
+			if version == 0 {
+				return fiber.NewError(http.StatusConflict, "user changed concurrently")
+			}
+			return fiber.NewError(http.StatusPreconditionFailed)
+		}
+		log.Err(err).Msgf("failed to patch user by id %s", id)
+		return errors.Wrap(err, "failed to patch user")
+	}
+
+	ctx.Set(fiber.HeaderETag, userETag(user))
+	response := h.mapUserToResponse(user)
+	return ctx.JSON(fiber.Map{"data": response})
+}
+
+// patchUserRequest applies body to the request form of user. Fields the
+// request does not know, like id, cannot be patched.
+func patchUserRequest(user *models.User, body []byte, apply func(doc, patch []byte) ([]byte, error)) (models.UserRequest, error) {
+	doc, err := json.Marshal(models.UserRequest{Name: user.Name, Age: user.Age, Anonymous: user.Anonymous})
+	if err != nil {
+		return models.UserRequest{}, errors.Wrap(err, "failed to encode user")
+	}
+
+	patched, err := apply(doc, body)
+	if err != nil {
+		return models.UserRequest{}, err
+	}
+
+	var userReq models.UserRequest
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&userReq); err != nil {
+		return models.UserRequest{}, errors.Wrap(err, "invalid patched user")
+	}
+	return userReq, nil
+}
+
+// diffUser returns the fields of userReq that differ from user.
+func diffUser(user *models.User, userReq models.UserRequest) models.UserPatch {
+	var diff models.UserPatch
+	if userReq.Name != user.Name {
+		diff.Name = &userReq.Name
+	}
+	if userReq.Age != user.Age {
+		diff.Age = &userReq.Age
+	}
+	if userReq.Anonymous != user.Anonymous {
+		diff.Anonymous = &userReq.Anonymous
+	}
+	return diff
+}
+
 func (h *Handler) DeleteUser(ctx *fiber.Ctx) error {
 	tracer := otel.Tracer(config.AppName)
 	spanCtx, span := tracer.Start(ctx.UserContext(), "Handler.DeleteUser")
@@ -132,11 +305,19 @@ func (h *Handler) DeleteUser(ctx *fiber.Ctx) error {
 		return fiber.NewError(http.StatusBadRequest, "invalid uuid")
 	}
 
-	if err := h.userUC.DeleteUser(spanCtx, id); err != nil {
+	version, err := h.expectedVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := h.userUC.DeleteUser(spanCtx, id, version); err != nil {
 		if errors.Is(err, apperr.ErrNotFound) {
 			log.Err(err).Msgf("user with id: %s not found", id)
 			return fiber.NewError(http.StatusNotFound)
 		}
+		if errors.Is(err, apperr.ErrPreconditionFailed) {
+			return fiber.NewError(http.StatusPreconditionFailed)
+		}
 		log.Err(err).Msgf("failed to delete user by id %s", id)
 		return errors.Wrap(err, "failed to delete user")
 	}
@@ -144,6 +325,213 @@ func (h *Handler) DeleteUser(ctx *fiber.Ctx) error {
 	return ctx.SendStatus(http.StatusNoContent)
 }
 
+// RestoreUser undoes a soft delete. Users that are not deleted, or were
+// already purged, are not found.
+func (h *Handler) RestoreUser(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "Handler.RestoreUser")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("id", ctx.Params("id")), // Параметр запроса (id)
+	)
+
+	id := ctx.Params("id")
+	if err := uuid.Validate(id); err != nil {
+		log.Err(err).Msg("validation failed")
+		return fiber.NewError(http.StatusBadRequest, "invalid uuid")
+	}
+
+	user, err := h.userUC.RestoreUser(spanCtx, id)
+	if err != nil {
+		if errors.Is(err, apperr.ErrNotFound) {
+			log.Err(err).Msgf("deleted user with id: %s not found", id)
+			return fiber.NewError(http.StatusNotFound)
+		}
+		log.Err(err).Msgf("failed to restore user by id %s", id)
+		return errors.Wrap(err, "failed to restore user")
+	}
+
+	ctx.Set(fiber.HeaderETag, userETag(user))
+	response := h.mapUserToResponse(user)
+	return ctx.JSON(fiber.Map{"data": response})
+}
+
+// ListUsers returns a page of users. The next page is referenced by
+// next_cursor and by a Link header (RFC 8288) carrying the same query.
+func (h *Handler) ListUsers(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "Handler.ListUsers")
+	defer span.End()
+
+	query, err := parseUserListQuery(ctx)
+	if err != nil {
+		log.Err(err).Msg("validation failed")
+		span.SetStatus(codes.Error, "invalid query")
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	page, err := h.userUC.ListUsers(spanCtx, query)
+	if err != nil {
+		if errors.Is(err, apperr.ErrInvalidArgument) {
+			span.SetStatus(codes.Error, "invalid query")
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		log.Err(err).Msg("failed to list users")
+		span.SetStatus(codes.Error, "failed to list users")
+		return errors.Wrap(err, "failed to list users")
+	}
+
+	response := make([]models.UserResponse, len(page.Users))
+	for i, user := range page.Users {
+		response[i] = h.mapUserToResponse(user)
+	}
+	if page.NextCursor != "" {
+		ctx.Append(fiber.HeaderLink, nextPageLink(ctx, page.NextCursor))
+	}
+	return ctx.JSON(fiber.Map{"data": response, "next_cursor": page.NextCursor})
+}
+
+// SearchUsers finds users by name, best matches first. The mode query
+// parameter switches to full-text search.
+func (h *Handler) SearchUsers(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "Handler.SearchUsers")
+	defer span.End()
+
+	query := models.UserSearchQuery{
+		Text:          strings.TrimSpace(ctx.Query("q")),
+		Mode:          ctx.Query("mode"),
+		MinSimilarity: h.search.MinSimilarity,
+	}
+	if query.Text == "" {
+		span.SetStatus(codes.Error, "invalid query")
+		return fiber.NewError(http.StatusBadRequest, "q is required")
+	}
+	limit, err := queryInt(ctx, "limit")
+	if err != nil {
+		span.SetStatus(codes.Error, "invalid query")
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+	if limit == 0 {
+		limit = h.search.Limit
+	}
+	query.Limit = min(limit, h.search.MaxLimit)
+
+	users, err := h.userUC.SearchUsers(spanCtx, query)
+	if err != nil {
+		if errors.Is(err, apperr.ErrInvalidArgument) {
+			span.SetStatus(codes.Error, "invalid query")
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		log.Err(err).Msgf("failed to search users: %s", query.Text)
+		span.SetStatus(codes.Error, "failed to search users")
+		return errors.Wrap(err, "failed to search users")
+	}
+
+	response := make([]models.UserResponse, len(users))
+	for i, user := range users {
+		response[i] = h.mapUserToResponse(user)
+	}
+	return ctx.JSON(fiber.Map{"data": response})
+}
+
+// GetUserHistory returns the audit trail of a user, newest changes first.
+// The trail outlives the user, so deleted users still have a history.
+func (h *Handler) GetUserHistory(ctx *fiber.Ctx) error {
+	tracer := otel.Tracer(config.AppName)
+	spanCtx, span := tracer.Start(ctx.UserContext(), "Handler.GetUserHistory")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("id", ctx.Params("id")), // Параметр запроса (id)
+	)
+
+	id := ctx.Params("id")
+	if err := uuid.Validate(id); err != nil {
+		log.Err(err).Msg("validation failed")
+		return fiber.NewError(http.StatusBadRequest, "invalid uuid")
+	}
+
+	query := models.UserHistoryQuery{Cursor: ctx.Query("cursor")}
+	var err error
+	if query.Limit, err = queryInt(ctx, "limit"); err != nil {
+		return fiber.NewError(http.StatusBadRequest, err.Error())
+	}
+
+	page, err := h.userUC.GetUserHistory(spanCtx, id, query)
+	if err != nil {
+		if errors.Is(err, apperr.ErrInvalidArgument) {
+			return fiber.NewError(http.StatusBadRequest, err.Error())
+		}
+		if errors.Is(err, apperr.ErrNotFound) {
+			log.Err(err).Msgf("user with id: %s not found", id)
+			return fiber.NewError(http.StatusNotFound)
+		}
+		log.Err(err).Msgf("failed to get history of user %s", id)
+		return errors.Wrap(err, "failed to get user history")
+	}
+
+	if page.NextCursor != "" {
+		ctx.Append(fiber.HeaderLink, nextPageLink(ctx, page.NextCursor))
+	}
+	return ctx.JSON(fiber.Map{"data": page.Entries, "next_cursor": page.NextCursor})
+}
+
+func parseUserListQuery(ctx *fiber.Ctx) (models.UserListQuery, error) {
+	query := models.UserListQuery{
+		Cursor: ctx.Query("cursor"),
+		Sort:   ctx.Query("sort"),
+	}
+
+	var err error
+	if query.Limit, err = queryInt(ctx, "limit"); err != nil {
+		return query, err
+	}
+	if value := ctx.Query("anonymous"); value != "" {
+		anonymous, err := strconv.ParseBool(value)
+		if err != nil {
+			return query, errors.Errorf("invalid anonymous: %s", value)
+		}
+		query.Filter.Anonymous = &anonymous
+	}
+	if query.Filter.AgeGTE, err = queryOptionalInt(ctx, "age_gte"); err != nil {
+		return query, err
+	}
+	if query.Filter.AgeLTE, err = queryOptionalInt(ctx, "age_lte"); err != nil {
+		return query, err
+	}
+	if query.Filter.AgeGTE != nil && query.Filter.AgeLTE != nil && *query.Filter.AgeGTE > *query.Filter.AgeLTE {
+		return query, errors.Errorf("age_gte %d is greater than age_lte %d", *query.Filter.AgeGTE, *query.Filter.AgeLTE)
+	}
+	return query, nil
+}
+
+func queryOptionalInt(ctx *fiber.Ctx, param string) (*int, error) {
+	if ctx.Query(param) == "" {
+		return nil, nil
+	}
+	n, err := queryInt(ctx, param)
+	return &n, err
+}
+
+func queryInt(ctx *fiber.Ctx, param string) (int, error) {
+	value := ctx.Query(param)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid %s: %s", param, value)
+	}
+	return n, nil
+}
+
+// nextPageLink repeats the request query with the cursor of the next page.
+func nextPageLink(ctx *fiber.Ctx, cursor string) string {
+	query, _ := url.ParseQuery(string(ctx.Request().URI().QueryString()))
+	query.Set("cursor", cursor)
+	return fmt.Sprintf(`<%s%s?%s>; rel="next"`, ctx.BaseURL(), ctx.Path(), query.Encode())
+}
+
 func (h *Handler) mapUserToResponse(u *models.User) models.UserResponse {
 	return models.UserResponse{
 		ID:        u.ID,
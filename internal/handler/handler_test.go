@@ -0,0 +1,296 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/cache"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/dankru/Api_gateway_v2/internal/patch"
+	"github.com/dankru/Api_gateway_v2/internal/repository"
+	"github.com/dankru/Api_gateway_v2/internal/usecase"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestApp serves the user routes over an in-memory store behind the
+// cache. The store is returned to change users behind the cache's back.
+func newTestApp(t *testing.T, cfg config.App) (*fiber.App, *repository.MemoryRepository) {
+	repo := repository.NewMemoryRepository()
+	cacheDecorator, err := cache.NewCacheDecorator(repo, config.Cache{TTL: time.Hour})
+	require.NoError(t, err)
+	handler := NewHandler(usecase.NewUserUsecase(cacheDecorator, repo), cfg)
+
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Get("/user", handler.ListUsers)
+	app.Get("/user/search", handler.SearchUsers)
+	app.Get("/user/:id", handler.GetUser)
+	app.Put("/user/:id", handler.ReplaceUser)
+	app.Patch("/user/:id", handler.PatchUser)
+	app.Delete("/user/:id", handler.DeleteUser)
+	app.Get("/user/:id/history", handler.GetUserHistory)
+	return app, repo
+}
+
+func doRequest(t *testing.T, app *fiber.App, method, target, body string, header map[string]string) (*http.Response, string) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := app.Test(req, -1)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(respBody)
+}
+
+func decodeUser(t *testing.T, body string) models.UserResponse {
+	var resp struct {
+		Data models.UserResponse `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &resp))
+	return resp.Data
+}
+
+func TestHandler_PatchUserStaleCache(t *testing.T) {
+	app, repo := newTestApp(t, config.App{})
+	ctx := context.Background()
+	id, err := repo.CreateUser(ctx, models.UserRequest{Name: "Daniel", Age: 30})
+	require.NoError(t, err)
+	target := "/user/" + id.String()
+
+	t.Log("Пользователь попадает в кэш, затем меняется мимо кэша\n")
+	resp, _ := doRequest(t, app, http.MethodGet, target, "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = repo.UpdateUser(ctx, id.String(), models.UserRequest{Name: "Daniil", Age: 30}, 0)
+	require.NoError(t, err)
+
+	t.Log("Патч, возвращающий значение из кэша, не теряется\n")
+	resp, body := doRequest(t, app, http.MethodPatch, target, `{"name":"Daniel"}`,
+		map[string]string{fiber.HeaderContentType: patch.MergePatchContentType})
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.Equal(t, "Daniel", decodeUser(t, body).Name)
+
+	user, err := repo.GetUser(ctx, id.String())
+	require.NoError(t, err)
+	require.Equal(t, "Daniel", user.Name)
+	require.Equal(t, int64(3), user.Version)
+}
+
+func TestHandler_Preconditions(t *testing.T) {
+	mergePatch := patch.MergePatchContentType
+
+	testCases := []struct {
+		name       string
+		required   bool
+		method     string
+		body       string
+		header     map[string]string
+		wantStatus int
+	}{
+		{
+			name:       "совпавший If-None-Match",
+			method:     http.MethodGet,
+			header:     map[string]string{fiber.HeaderIfNoneMatch: `"0", "1"`},
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "другой If-None-Match",
+			method:     http.MethodGet,
+			header:     map[string]string{fiber.HeaderIfNoneMatch: `"2"`},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "замена с устаревшим If-Match",
+			method:     http.MethodPut,
+			body:       `{"name":"Daniel","age":31}`,
+			header:     map[string]string{fiber.HeaderContentType: fiber.MIMEApplicationJSON, fiber.HeaderIfMatch: `"1"`},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "патч с устаревшим If-Match",
+			method:     http.MethodPatch,
+			body:       `{"age":31}`,
+			header:     map[string]string{fiber.HeaderContentType: mergePatch, fiber.HeaderIfMatch: `"1"`},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "патч со слабым If-Match",
+			method:     http.MethodPatch,
+			body:       `{"age":31}`,
+			header:     map[string]string{fiber.HeaderContentType: mergePatch, fiber.HeaderIfMatch: `W/"2"`},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "патч с текущим If-Match при устаревшем кэше",
+			method:     http.MethodPatch,
+			body:       `{"age":31}`,
+			header:     map[string]string{fiber.HeaderContentType: mergePatch, fiber.HeaderIfMatch: `"2"`},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "удаление с устаревшим If-Match",
+			method:     http.MethodDelete,
+			header:     map[string]string{fiber.HeaderIfMatch: `"1"`},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "патч без обязательного If-Match",
+			required:   true,
+			method:     http.MethodPatch,
+			body:       `{"age":31}`,
+			header:     map[string]string{fiber.HeaderContentType: mergePatch},
+			wantStatus: http.StatusPreconditionRequired,
+		},
+		{
+			name:       "удаление без обязательного If-Match",
+			required:   true,
+			method:     http.MethodDelete,
+			wantStatus: http.StatusPreconditionRequired,
+		},
+		{
+			name:       "удаление с обязательным If-Match",
+			required:   true,
+			method:     http.MethodDelete,
+			header:     map[string]string{fiber.HeaderIfMatch: `"2"`},
+			wantStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			app, repo := newTestApp(t, config.App{Preconditions: config.Preconditions{Required: tc.required}})
+			ctx := context.Background()
+			id, err := repo.CreateUser(ctx, models.UserRequest{Name: "Daniel", Age: 30})
+			require.NoError(t, err)
+			target := "/user/" + id.String()
+
+			resp, _ := doRequest(t, app, http.MethodGet, target, "", nil)
+			require.Equal(t, `"1"`, resp.Header.Get(fiber.HeaderETag))
+			if tc.method != http.MethodGet {
+				t.Log("В кэше остаётся версия 1, в хранилище уже версия 2\n")
+				_, err = repo.UpdateUser(ctx, id.String(), models.UserRequest{Name: "Daniil", Age: 30}, 0)
+				require.NoError(t, err)
+			}
+
+			resp, body := doRequest(t, app, tc.method, target, tc.body, tc.header)
+			require.Equal(t, tc.wantStatus, resp.StatusCode, body)
+		})
+	}
+}
+
+func TestHandler_ListUsersQuery(t *testing.T) {
+	testCases := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{name: "без параметров", query: "", wantStatus: http.StatusOK},
+		{name: "все фильтры", query: "?limit=2&sort=-age&anonymous=false&age_gte=20&age_lte=30", wantStatus: http.StatusOK},
+		{name: "равные границы возраста", query: "?age_gte=30&age_lte=30", wantStatus: http.StatusOK},
+		{name: "перевёрнутый диапазон возраста", query: "?age_gte=31&age_lte=30", wantStatus: http.StatusBadRequest},
+		{name: "отрицательный лимит", query: "?limit=-1", wantStatus: http.StatusBadRequest},
+		{name: "нечисловой возраст", query: "?age_gte=old", wantStatus: http.StatusBadRequest},
+		{name: "неверный anonymous", query: "?anonymous=maybe", wantStatus: http.StatusBadRequest},
+		{name: "неизвестная сортировка", query: "?sort=password", wantStatus: http.StatusBadRequest},
+		{name: "испорченный курсор", query: "?cursor=garbage", wantStatus: http.StatusBadRequest},
+	}
+
+	app, _ := newTestApp(t, config.App{})
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := doRequest(t, app, http.MethodGet, "/user"+tc.query, "", nil)
+			require.Equal(t, tc.wantStatus, resp.StatusCode, body)
+		})
+	}
+}
+
+func TestHandler_ListUsersPages(t *testing.T) {
+	app, repo := newTestApp(t, config.App{})
+	for age := 20; age < 25; age++ {
+		_, err := repo.CreateUser(context.Background(), models.UserRequest{Name: "User", Age: age})
+		require.NoError(t, err)
+	}
+
+	var ages []int
+	target := "/user?limit=2&sort=-age&age_gte=21"
+	for target != "" {
+		resp, body := doRequest(t, app, http.MethodGet, target, "", nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+
+		var page struct {
+			Data       []models.UserResponse `json:"data"`
+			NextCursor string                `json:"next_cursor"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &page))
+		for _, user := range page.Data {
+			ages = append(ages, user.Age)
+		}
+
+		link := resp.Header.Get(fiber.HeaderLink)
+		if page.NextCursor == "" {
+			require.Empty(t, link)
+			break
+		}
+
+		t.Log("Ссылка на следующую страницу сохраняет фильтры и несёт курсор\n")
+		require.True(t, strings.HasSuffix(link, `>; rel="next"`), link)
+		next, err := url.Parse(strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`))
+		require.NoError(t, err)
+		require.Equal(t, "/user", next.Path)
+		require.Equal(t, page.NextCursor, next.Query().Get("cursor"))
+		require.Equal(t, "-age", next.Query().Get("sort"))
+		require.Equal(t, "21", next.Query().Get("age_gte"))
+		target = next.RequestURI()
+	}
+	require.Equal(t, []int{24, 23, 22, 21}, ages)
+}
+
+func TestHandler_SearchUsers(t *testing.T) {
+	app, repo := newTestApp(t, config.App{Search: config.Search{Limit: 2, MaxLimit: 3}})
+	for _, name := range []string{"Alice", "Alice Cooper", "Alice Liddell", "Alicia Keys", "Bob"} {
+		_, err := repo.CreateUser(context.Background(), models.UserRequest{Name: name, Age: 30})
+		require.NoError(t, err)
+	}
+
+	testCases := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantLen    int
+	}{
+		{name: "лимит по умолчанию", query: "?q=alice", wantStatus: http.StatusOK, wantLen: 2},
+		{name: "лимит ограничен максимумом", query: "?q=alice&limit=50", wantStatus: http.StatusOK, wantLen: 3},
+		{name: "лимит меньше максимума", query: "?q=alice&limit=1", wantStatus: http.StatusOK, wantLen: 1},
+		{name: "полнотекстовый режим", query: "?q=cooper&mode=fulltext", wantStatus: http.StatusOK, wantLen: 1},
+		{name: "пустой запрос", query: "?q=%20", wantStatus: http.StatusBadRequest},
+		{name: "неизвестный режим", query: "?q=alice&mode=regex", wantStatus: http.StatusBadRequest},
+		{name: "неверный лимит", query: "?q=alice&limit=many", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, body := doRequest(t, app, http.MethodGet, "/user/search"+tc.query, "", nil)
+			require.Equal(t, tc.wantStatus, resp.StatusCode, body)
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+
+			var result struct {
+				Data []models.UserResponse `json:"data"`
+			}
+			require.NoError(t, json.Unmarshal([]byte(body), &result))
+			require.Len(t, result.Data, tc.wantLen)
+		})
+	}
+}
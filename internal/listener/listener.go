@@ -0,0 +1,143 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// userChangesChannel is notified by the users_notify_change trigger with
+// the id of every inserted, updated or deleted user.
+const userChangesChannel = "user_changes"
+
+// userChange is the payload of a notification: the changed user and the
+// origin of the connection that changed it, see storage.OriginSetting.
+type userChange struct {
+	ID     string `json:"id"`
+	Origin string `json:"origin"`
+}
+
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+)
+
+type Invalidator interface {
+	Invalidate(ctx context.Context, id string)
+	FlushLocal()
+}
+
+// UserListener keeps cached users in sync with changes made through other
+// gateway replicas. It holds a dedicated connection outside the pool,
+// because LISTEN is bound to the session that issued it. Changes made with
+// the listener's own origin are skipped: the cache already wrote them
+// through.
+type UserListener struct {
+	connString  string
+	origin      string
+	invalidator Invalidator
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+}
+
+func NewUserListener(connString, origin string, invalidator Invalidator, cfg config.Invalidation) *UserListener {
+	minBackoff := cfg.MinBackoff
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+	maxBackoff := cfg.MaxBackoff
+	if maxBackoff < minBackoff {
+		maxBackoff = max(defaultMaxBackoff, minBackoff)
+	}
+
+	return &UserListener{
+		connString:  connString,
+		origin:      origin,
+		invalidator: invalidator,
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+	}
+}
+
+func (l *UserListener) Start(ctx context.Context) {
+	go func() {
+		backoff := l.minBackoff
+		reconnect := false
+
+		for {
+			connected, err := l.listen(ctx, reconnect)
+			if ctx.Err() != nil {
+				log.Info().Msg("user listener shutting down...")
+				return
+			}
+			if connected {
+				backoff = l.minBackoff
+				reconnect = true
+			}
+
+			log.Err(err).Msgf("user listener disconnected, reconnecting in %s", backoff)
+			select {
+			case <-ctx.Done():
+				log.Info().Msg("user listener shutting down...")
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, l.maxBackoff)
+		}
+	}()
+}
+
+// listen subscribes to user changes and evicts notified ids until the
+// connection fails. Notifications sent while the listener was disconnected
+// are lost, so after a reconnect the local cache is flushed.
+func (l *UserListener) listen(ctx context.Context, reconnect bool) (bool, error) {
+	conn, err := pgx.Connect(ctx, l.connString)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to connect")
+	}
+	defer func() {
+		if err := conn.Close(context.Background()); err != nil {
+			log.Err(err).Msg("failed to close listener connection")
+		}
+	}()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+userChangesChannel); err != nil {
+		return false, errors.Wrapf(err, "failed to listen on %s", userChangesChannel)
+	}
+	log.Info().Msgf("listening for user changes on channel: %s", userChangesChannel)
+
+	if reconnect {
+		log.Warn().Msg("flushing local cache after listener reconnect")
+		l.invalidator.FlushLocal()
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, errors.Wrap(err, "failed to wait for notification")
+		}
+
+		l.handle(ctx, notification.Payload)
+	}
+}
+
+// handle evicts the user named in payload unless this gateway changed it.
+func (l *UserListener) handle(ctx context.Context, payload string) {
+	var change userChange
+	if err := json.Unmarshal([]byte(payload), &change); err != nil {
+		log.Err(err).Msgf("failed to decode user change: %s", payload)
+		return
+	}
+	if l.origin != "" && change.Origin == l.origin {
+		log.Debug().Msgf("user changed by this gateway, keeping cache: %s", change.ID)
+		return
+	}
+
+	log.Debug().Msgf("user changed, invalidating cache: %s", change.ID)
+	l.invalidator.Invalidate(ctx, change.ID)
+}
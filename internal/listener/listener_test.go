@@ -0,0 +1,66 @@
+package listener
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingInvalidator struct {
+	invalidated []string
+}
+
+func (i *recordingInvalidator) Invalidate(_ context.Context, id string) {
+	i.invalidated = append(i.invalidated, id)
+}
+
+func (i *recordingInvalidator) FlushLocal() {}
+
+func TestUserListener_Handle(t *testing.T) {
+	testCases := []struct {
+		name    string
+		origin  string
+		payload string
+		want    []string
+	}{
+		{
+			name:    "изменение другого шлюза сбрасывает кэш",
+			origin:  "self",
+			payload: `{"id":"a","origin":"other"}`,
+			want:    []string{"a"},
+		},
+		{
+			name:    "собственное изменение не сбрасывает кэш",
+			origin:  "self",
+			payload: `{"id":"a","origin":"self"}`,
+		},
+		{
+			name:    "изменение без источника сбрасывает кэш",
+			origin:  "self",
+			payload: `{"id":"a","origin":null}`,
+			want:    []string{"a"},
+		},
+		{
+			name:    "шлюз без источника сбрасывает кэш на любое изменение",
+			payload: `{"id":"a","origin":null}`,
+			want:    []string{"a"},
+		},
+		{
+			name:    "нечитаемое уведомление пропускается",
+			origin:  "self",
+			payload: "a",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			invalidator := &recordingInvalidator{}
+			l := NewUserListener("", tc.origin, invalidator, config.Invalidation{})
+
+			l.handle(context.Background(), tc.payload)
+			require.Equal(t, tc.want, invalidator.invalidated)
+		})
+	}
+}
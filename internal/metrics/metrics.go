@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/dankru/Api_gateway_v2/internal/cache"
+	"github.com/dankru/Api_gateway_v2/internal/outbox"
+	"github.com/dankru/Api_gateway_v2/internal/repository"
 	"github.com/gofiber/fiber/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -25,19 +27,135 @@ var (
 			Help: "Number of elements in the cache",
 		})
 
+	CacheEvictionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_evictions_total",
+			Help: "Count of entries evicted from the cache by the eviction policy",
+		})
+
+	CacheHitsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_hits_total",
+			Help: "Count of lookups served from the cache",
+		})
+
+	CacheMissesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_misses_total",
+			Help: "Count of lookups that did not find a fresh entry in the cache and went to the repository, negative cache hits excluded",
+		})
+
+	CacheSetsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_sets_total",
+			Help: "Count of entries written to the cache",
+		})
+
+	CacheExpirationsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_expirations_total",
+			Help: "Count of entries removed from the cache after they expired",
+		})
+
+	CacheCoalescedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_coalesced_requests_total",
+			Help: "Count of cache misses that waited for an in-flight repository call instead of making their own",
+		})
+
+	CacheNegativeHitsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_negative_hits_total",
+			Help: "Count of lookups answered as not found by the negative cache",
+		})
+
+	CacheNegativeMissesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_negative_misses_total",
+			Help: "Count of lookups not found in the negative cache",
+		})
+
+	CacheRefreshesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_refreshes_total",
+			Help: "Count of background refreshes of entries close to expiry",
+		})
+
+	CacheStaleServedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_stale_served_total",
+			Help: "Count of expired entries served because the repository failed",
+		})
+
 	CacheSizeBytes = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "cache_size_bytes",
 			Help: "Size of cache in bytes",
 		})
+
+	DBPoolSelectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "db_pool_selections_total",
+			Help: "Count of queries routed to a database pool, labeled by pool and reason",
+		},
+		[]string{"pool", "reason"},
+	)
+
+	DBHealthyReplicas = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "db_healthy_replicas",
+			Help: "Number of read replicas taking reads",
+		})
+
+	OutboxBacklogSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "outbox_backlog_size",
+			Help: "Number of user events waiting in the outbox",
+		})
+
+	OutboxBacklogAgeSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "outbox_backlog_age_seconds",
+			Help: "Age of the oldest user event waiting in the outbox",
+		})
+
+	OutboxPublishedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "outbox_published_total",
+			Help: "Count of user events delivered to the sink",
+		})
+
+	OutboxFailedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "outbox_failed_total",
+			Help: "Count of failed deliveries of user events, each is retried",
+		})
 )
 
-func InitMetrics(port string, cache *cache.CacheDecorator, sendInterval time.Duration) {
+func InitMetrics(port string, cache *cache.CacheDecorator, replicas *repository.ReplicaRouter, relay *outbox.Relay, sendInterval time.Duration) {
 	prometheus.MustRegister(HttpStatusMetric)
 	prometheus.MustRegister(CacheElementCount)
+	prometheus.MustRegister(CacheEvictionsTotal)
+	prometheus.MustRegister(CacheHitsTotal)
+	prometheus.MustRegister(CacheMissesTotal)
+	prometheus.MustRegister(CacheSetsTotal)
+	prometheus.MustRegister(CacheExpirationsTotal)
+	prometheus.MustRegister(CacheCoalescedTotal)
+	prometheus.MustRegister(CacheNegativeHitsTotal)
+	prometheus.MustRegister(CacheNegativeMissesTotal)
+	prometheus.MustRegister(CacheRefreshesTotal)
+	prometheus.MustRegister(CacheStaleServedTotal)
 	prometheus.MustRegister(CacheSizeBytes)
+	prometheus.MustRegister(DBPoolSelectionsTotal)
+	prometheus.MustRegister(DBHealthyReplicas)
+	prometheus.MustRegister(OutboxBacklogSize)
+	prometheus.MustRegister(OutboxBacklogAgeSeconds)
+	prometheus.MustRegister(OutboxPublishedTotal)
+	prometheus.MustRegister(OutboxFailedTotal)
 
 	startCacheMetricsCollector(cache, sendInterval)
+	startPoolMetricsCollector(replicas, sendInterval)
+	startOutboxMetricsCollector(relay, sendInterval)
 
 	http.Handle("/metrics", promhttp.Handler())
 	go func() {
@@ -72,6 +190,17 @@ func PrometheusMiddleware() fiber.Handler {
 }
 
 func startCacheMetricsCollector(cache *cache.CacheDecorator, interval time.Duration) {
+	evictions := &counterCollector{counter: CacheEvictionsTotal, value: cache.EvictionCount}
+	hits := &counterCollector{counter: CacheHitsTotal, value: cache.HitCount}
+	misses := &counterCollector{counter: CacheMissesTotal, value: cache.MissCount}
+	sets := &counterCollector{counter: CacheSetsTotal, value: cache.SetCount}
+	expirations := &counterCollector{counter: CacheExpirationsTotal, value: cache.ExpirationCount}
+	coalesced := &counterCollector{counter: CacheCoalescedTotal, value: cache.CoalescedCount}
+	negativeHits := &counterCollector{counter: CacheNegativeHitsTotal, value: cache.NegativeHitCount}
+	negativeMisses := &counterCollector{counter: CacheNegativeMissesTotal, value: cache.NegativeMissCount}
+	refreshes := &counterCollector{counter: CacheRefreshesTotal, value: cache.RefreshCount}
+	staleServed := &counterCollector{counter: CacheStaleServedTotal, value: cache.StaleCount}
+
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
@@ -79,6 +208,77 @@ func startCacheMetricsCollector(cache *cache.CacheDecorator, interval time.Durat
 		for range ticker.C {
 			CacheElementCount.Set(float64(cache.ElementCount()))
 			CacheSizeBytes.Set(float64(cache.SizeBytes()))
+
+			evictions.collect()
+			hits.collect()
+			misses.collect()
+			sets.collect()
+			expirations.collect()
+			coalesced.collect()
+			negativeHits.collect()
+			negativeMisses.collect()
+			refreshes.collect()
+			staleServed.collect()
+		}
+	}()
+}
+
+func startPoolMetricsCollector(replicas *repository.ReplicaRouter, interval time.Duration) {
+	if replicas == nil {
+		return
+	}
+	last := make(map[repository.PoolSelection]int)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			DBHealthyReplicas.Set(float64(replicas.HealthyReplicas()))
+
+			for selection, count := range replicas.Selections() {
+				DBPoolSelectionsTotal.WithLabelValues(selection.Pool, selection.Reason).Add(float64(count - last[selection]))
+				last[selection] = count
+			}
+		}
+	}()
+}
+
+func startOutboxMetricsCollector(relay *outbox.Relay, interval time.Duration) {
+	if relay == nil {
+		return
+	}
+	published := &counterCollector{counter: OutboxPublishedTotal, value: relay.PublishedCount}
+	failed := &counterCollector{counter: OutboxFailedTotal, value: relay.FailedCount}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			OutboxBacklogSize.Set(float64(relay.BacklogSize()))
+			OutboxBacklogAgeSeconds.Set(relay.BacklogAge().Seconds())
+
+			published.collect()
+			failed.collect()
 		}
 	}()
 }
+
+// counterCollector feeds a monotonically growing counter into a
+// prometheus counter, adding only what changed since the previous tick. A
+// source that went backwards was reset, by a flush for example; the tick is
+// skipped and counting resumes from the new value.
+type counterCollector struct {
+	counter prometheus.Counter
+	value   func() int
+	last    int
+}
+
+func (c *counterCollector) collect() {
+	current := c.value()
+	if current > c.last {
+		c.counter.Add(float64(current - c.last))
+	}
+	c.last = current
+}
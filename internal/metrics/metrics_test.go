@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterCollector_Collect(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total"})
+	var value int
+	collector := &counterCollector{counter: counter, value: func() int { return value }}
+
+	testCases := []struct {
+		name  string
+		value int
+		want  float64
+	}{
+		{name: "счётчик растёт", value: 5, want: 5},
+		{name: "счётчик не изменился", value: 5, want: 5},
+		{name: "источник сброшен", value: 2, want: 5},
+		{name: "счёт продолжается после сброса", value: 4, want: 7},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			value = tc.value
+			require.NotPanics(t, collector.collect)
+			require.Equal(t, tc.want, testutil.ToFloat64(counter))
+		})
+	}
+}
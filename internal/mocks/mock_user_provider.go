@@ -57,18 +57,64 @@ func (mr *MockUserProviderMockRecorder) CreateUser(ctx, userReq any) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUser", reflect.TypeOf((*MockUserProvider)(nil).CreateUser), ctx, userReq)
 }
 
+// CreateUsers mocks base method.
+func (m *MockUserProvider) CreateUsers(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateUsers", ctx, userReqs)
+	ret0, _ := ret[0].([]uuid.UUID)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateUsers indicates an expected call of CreateUsers.
+func (mr *MockUserProviderMockRecorder) CreateUsers(ctx, userReqs any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUsers", reflect.TypeOf((*MockUserProvider)(nil).CreateUsers), ctx, userReqs)
+}
+
+// CreateUsersPartially mocks base method.
+func (m *MockUserProvider) CreateUsersPartially(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, []error, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateUsersPartially", ctx, userReqs)
+	ret0, _ := ret[0].([]uuid.UUID)
+	ret1, _ := ret[1].([]error)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CreateUsersPartially indicates an expected call of CreateUsersPartially.
+func (mr *MockUserProviderMockRecorder) CreateUsersPartially(ctx, userReqs any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateUsersPartially", reflect.TypeOf((*MockUserProvider)(nil).CreateUsersPartially), ctx, userReqs)
+}
+
 // DeleteUser mocks base method.
-func (m *MockUserProvider) DeleteUser(ctx context.Context, id string) error {
+func (m *MockUserProvider) DeleteUser(ctx context.Context, id string, version int64) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DeleteUser", ctx, id)
+	ret := m.ctrl.Call(m, "DeleteUser", ctx, id, version)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // DeleteUser indicates an expected call of DeleteUser.
-func (mr *MockUserProviderMockRecorder) DeleteUser(ctx, id any) *gomock.Call {
+func (mr *MockUserProviderMockRecorder) DeleteUser(ctx, id, version any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUser", reflect.TypeOf((*MockUserProvider)(nil).DeleteUser), ctx, id, version)
+}
+
+// DeleteUsers mocks base method.
+func (m *MockUserProvider) DeleteUsers(ctx context.Context, ids []string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteUsers", ctx, ids)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteUsers indicates an expected call of DeleteUsers.
+func (mr *MockUserProviderMockRecorder) DeleteUsers(ctx, ids any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUser", reflect.TypeOf((*MockUserProvider)(nil).DeleteUser), ctx, id)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteUsers", reflect.TypeOf((*MockUserProvider)(nil).DeleteUsers), ctx, ids)
 }
 
 // GetUser mocks base method.
@@ -86,17 +132,107 @@ func (mr *MockUserProviderMockRecorder) GetUser(ctx, id any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUser", reflect.TypeOf((*MockUserProvider)(nil).GetUser), ctx, id)
 }
 
+// GetUserHistory mocks base method.
+func (m *MockUserProvider) GetUserHistory(ctx context.Context, id string, query models.UserHistoryQuery) (models.UserHistoryPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUserHistory", ctx, id, query)
+	ret0, _ := ret[0].(models.UserHistoryPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUserHistory indicates an expected call of GetUserHistory.
+func (mr *MockUserProviderMockRecorder) GetUserHistory(ctx, id, query any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUserHistory", reflect.TypeOf((*MockUserProvider)(nil).GetUserHistory), ctx, id, query)
+}
+
+// GetUsers mocks base method.
+func (m *MockUserProvider) GetUsers(ctx context.Context, ids []string) ([]*models.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetUsers", ctx, ids)
+	ret0, _ := ret[0].([]*models.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetUsers indicates an expected call of GetUsers.
+func (mr *MockUserProviderMockRecorder) GetUsers(ctx, ids any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetUsers", reflect.TypeOf((*MockUserProvider)(nil).GetUsers), ctx, ids)
+}
+
+// ListUsers mocks base method.
+func (m *MockUserProvider) ListUsers(ctx context.Context, query models.UserListQuery) (models.UserPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListUsers", ctx, query)
+	ret0, _ := ret[0].(models.UserPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListUsers indicates an expected call of ListUsers.
+func (mr *MockUserProviderMockRecorder) ListUsers(ctx, query any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListUsers", reflect.TypeOf((*MockUserProvider)(nil).ListUsers), ctx, query)
+}
+
+// PatchUser mocks base method.
+func (m *MockUserProvider) PatchUser(ctx context.Context, id string, patch models.UserPatch, version int64) (*models.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PatchUser", ctx, id, patch, version)
+	ret0, _ := ret[0].(*models.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PatchUser indicates an expected call of PatchUser.
+func (mr *MockUserProviderMockRecorder) PatchUser(ctx, id, patch, version any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PatchUser", reflect.TypeOf((*MockUserProvider)(nil).PatchUser), ctx, id, patch, version)
+}
+
+// RestoreUser mocks base method.
+func (m *MockUserProvider) RestoreUser(ctx context.Context, id string) (*models.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RestoreUser", ctx, id)
+	ret0, _ := ret[0].(*models.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RestoreUser indicates an expected call of RestoreUser.
+func (mr *MockUserProviderMockRecorder) RestoreUser(ctx, id any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RestoreUser", reflect.TypeOf((*MockUserProvider)(nil).RestoreUser), ctx, id)
+}
+
+// SearchUsers mocks base method.
+func (m *MockUserProvider) SearchUsers(ctx context.Context, query models.UserSearchQuery) ([]*models.User, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SearchUsers", ctx, query)
+	ret0, _ := ret[0].([]*models.User)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SearchUsers indicates an expected call of SearchUsers.
+func (mr *MockUserProviderMockRecorder) SearchUsers(ctx, query any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SearchUsers", reflect.TypeOf((*MockUserProvider)(nil).SearchUsers), ctx, query)
+}
+
 // UpdateUser mocks base method.
-func (m *MockUserProvider) UpdateUser(ctx context.Context, id string, userReq models.UserRequest) (*models.User, error) {
+func (m *MockUserProvider) UpdateUser(ctx context.Context, id string, userReq models.UserRequest, version int64) (*models.User, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateUser", ctx, id, userReq)
+	ret := m.ctrl.Call(m, "UpdateUser", ctx, id, userReq, version)
 	ret0, _ := ret[0].(*models.User)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // UpdateUser indicates an expected call of UpdateUser.
-func (mr *MockUserProviderMockRecorder) UpdateUser(ctx, id, userReq any) *gomock.Call {
+func (mr *MockUserProviderMockRecorder) UpdateUser(ctx, id, userReq, version any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUser", reflect.TypeOf((*MockUserProvider)(nil).UpdateUser), ctx, id, userReq)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateUser", reflect.TypeOf((*MockUserProvider)(nil).UpdateUser), ctx, id, userReq, version)
 }
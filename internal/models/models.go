@@ -1,6 +1,9 @@
 package models
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/google/uuid"
 )
 
@@ -10,6 +13,10 @@ type User struct {
 	Age          int
 	Anonymous    bool
 	PasswordHash string
+	// Version is incremented by the database on every update.
+	Version   int64
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 type UserResponse struct {
@@ -24,3 +31,113 @@ type UserRequest struct {
 	Age       int    `json:"age" validate:"required"`
 	Anonymous bool   `json:"anonymous"`
 }
+
+// UserPatch lists the fields changed by a partial update, nil fields are
+// left as they are.
+type UserPatch struct {
+	Name      *string
+	Age       *int
+	Anonymous *bool
+}
+
+// Empty reports whether the patch changes nothing.
+func (p UserPatch) Empty() bool {
+	return p.Name == nil && p.Age == nil && p.Anonymous == nil
+}
+
+// UserFilter narrows ListUsers down, nil fields are not applied.
+type UserFilter struct {
+	Anonymous *bool
+	AgeGTE    *int
+	AgeLTE    *int
+}
+
+// UserListQuery selects a page of users. Sort is a field name, optionally
+// prefixed with "-" for descending order. Cursor is the NextCursor of the
+// previous page, it must be used with the same Sort and Filter.
+type UserListQuery struct {
+	Limit  int
+	Cursor string
+	Sort   string
+	Filter UserFilter
+}
+
+// UserPage is one page of users. NextCursor is empty on the last page.
+type UserPage struct {
+	Users      []*User
+	NextCursor string
+}
+
+// UserSearchQuery finds users by name. Mode is "trigram", the default, for
+// partial and misspelled names, or "fulltext" for whole words. Trigram
+// matches must be at least MinSimilarity alike, from 0 to 1.
+type UserSearchQuery struct {
+	Text          string
+	Mode          string
+	Limit         int
+	MinSimilarity float64
+}
+
+// UserAuditEntry records one change of a user. Before is empty for created
+// users, After holds the row as it was written, including deleted_at.
+// ClaimedActor is the actor the client named, it is not verified.
+type UserAuditEntry struct {
+	ID           int64           `json:"id"`
+	UserID       uuid.UUID       `json:"userId"`
+	Action       string          `json:"action"`
+	Before       json.RawMessage `json:"before,omitempty"`
+	After        json.RawMessage `json:"after,omitempty"`
+	ClaimedActor string          `json:"claimedActor"`
+	RequestID    string          `json:"requestId,omitempty"`
+	ChangedAt    time.Time       `json:"changedAt"`
+}
+
+// UserHistoryQuery selects a page of the audit trail of a user. Cursor is
+// the NextCursor of the previous page.
+type UserHistoryQuery struct {
+	Limit  int
+	Cursor string
+}
+
+// UserHistoryPage is one page of an audit trail, newest entries first.
+// NextCursor is empty on the last page.
+type UserHistoryPage struct {
+	Entries    []UserAuditEntry
+	NextCursor string
+}
+
+// BatchCreateRequest creates several users at once. With Atomic set no user
+// is created unless all of them are valid and inserted.
+type BatchCreateRequest struct {
+	Users  []UserRequest `json:"users"`
+	Atomic bool          `json:"atomic"`
+}
+
+type BatchIDsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// BatchItemResult is the outcome of one item of a batch request. Results
+// are listed in the order of the request items.
+type BatchItemResult struct {
+	ID     string        `json:"id,omitempty"`
+	Status int           `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	User   *UserResponse `json:"data,omitempty"`
+}
+
+type CacheKeyResponse struct {
+	ID        string    `json:"id"`
+	StoredAt  time.Time `json:"storedAt"`
+	ExpiredAt time.Time `json:"expiredAt"`
+}
+
+type CacheEntryResponse struct {
+	CacheKeyResponse
+	User UserResponse `json:"user"`
+}
+
+type CacheSettings struct {
+	TTL             string `json:"ttl"`
+	CleanerInterval string `json:"cleanerInterval"`
+}
@@ -0,0 +1,269 @@
+// Package outbox publishes the events the repository writes to the outbox
+// table in the transaction of each change. Events are delivered at least
+// once: an event is removed only after the sink accepted it, so consumers
+// must tolerate duplicates, which carry the same ID.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	defaultInterval   = time.Second
+	defaultBatchSize  = 100
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+// Event is a change published to downstream systems.
+type Event struct {
+	ID          int64           `json:"id"`
+	AggregateID uuid.UUID       `json:"aggregateId"`
+	Type        string          `json:"type"`
+	Payload     json.RawMessage `json:"payload"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	// Attempts counts the failed deliveries before this one.
+	Attempts int `json:"attempts"`
+}
+
+// Sink delivers events. An error leaves the event in the outbox, it is
+// retried later.
+type Sink interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// Relay moves events from the outbox to a sink. Several gateway replicas may
+// run it at once: each leases the events it publishes and skips those leased
+// by others.
+type Relay struct {
+	pool       *pgxpool.Pool
+	sink       Sink
+	interval   time.Duration
+	batchSize  int
+	lease      time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	mu             sync.Mutex
+	backlogSize    int64
+	backlogAge     time.Duration
+	publishedTotal int
+	failedTotal    int
+}
+
+func NewRelay(pool *pgxpool.Pool, sink Sink, cfg config.Outbox) *Relay {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	minBackoff := cfg.MinBackoff
+	if minBackoff <= 0 {
+		minBackoff = defaultMinBackoff
+	}
+	maxBackoff := cfg.MaxBackoff
+	if maxBackoff < minBackoff {
+		maxBackoff = max(defaultMaxBackoff, minBackoff)
+	}
+
+	return &Relay{
+		pool:       pool,
+		sink:       sink,
+		interval:   interval,
+		batchSize:  batchSize,
+		lease:      timeout * time.Duration(batchSize),
+		minBackoff: minBackoff,
+		maxBackoff: maxBackoff,
+	}
+}
+
+// Start relays events every interval until ctx is done. A batch that
+// delivered events is followed by the next one right away, it may have
+// unblocked later events of the same users.
+func (r *Relay) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			for {
+				published, err := r.relay(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Err(err).Msg("failed to relay outbox events")
+				}
+				if err != nil || published == 0 {
+					break
+				}
+			}
+			if err := r.measureBacklog(ctx); err != nil && ctx.Err() == nil {
+				log.Err(err).Msg("failed to measure outbox backlog")
+			}
+
+			select {
+			case <-ctx.Done():
+				log.Info().Msg("outbox relay shutting down...")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// relay claims one batch of due events, publishes them and returns how many
+// it delivered. Delivered events are deleted, failed ones are scheduled again
+// with a growing backoff.
+func (r *Relay) relay(ctx context.Context) (int, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "Relay.relay")
+	defer span.End()
+
+	events, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var published, failed int
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("outbox.published", published),
+			attribute.Int("outbox.failed", failed),
+		)
+		r.mu.Lock()
+		r.publishedTotal += published
+		r.failedTotal += failed
+		r.mu.Unlock()
+	}()
+
+	for _, event := range events {
+		if err := r.sink.Publish(ctx, event); err != nil {
+			failed++
+			log.Warn().Err(err).Msgf("failed to publish outbox event %d (%s), attempt %d", event.ID, event.Type, event.Attempts+1)
+			if _, err := r.pool.Exec(ctx,
+				"UPDATE outbox SET attempts = attempts + 1, next_attempt_at = now() + $2 * interval '1 millisecond', last_error = $3 WHERE id = $1",
+				event.ID, r.backoff(event.Attempts).Milliseconds(), err.Error()); err != nil {
+				return published, errors.Wrap(err, "failed to reschedule outbox event")
+			}
+			continue
+		}
+
+		published++
+		if _, err := r.pool.Exec(ctx, "DELETE FROM outbox WHERE id = $1", event.ID); err != nil {
+			return published, errors.Wrap(err, "failed to delete outbox event")
+		}
+	}
+	return published, nil
+}
+
+// claim leases up to batchSize due events to this relay by moving their next
+// attempt past the time it may take to publish them. The lease is a single
+// short statement and the events are published outside of any transaction;
+// if the relay stops halfway, the events are due again once the lease runs
+// out.
+//
+// Only the oldest event of each user is claimed: the later ones wait until
+// it is delivered, even while it waits for a retry or is leased by another
+// relay, so each user's events arrive in order.
+func (r *Relay) claim(ctx context.Context) ([]Event, error) {
+	rows, err := r.pool.Query(ctx,
+		"UPDATE outbox SET next_attempt_at = now() + $2 * interval '1 millisecond' WHERE id IN ("+
+			"SELECT id FROM outbox o WHERE next_attempt_at <= now() "+
+			"AND NOT EXISTS (SELECT 1 FROM outbox earlier WHERE earlier.aggregate_id = o.aggregate_id AND earlier.id < o.id) "+
+			"ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED) "+
+			"RETURNING id, aggregate_id, event_type, payload, created_at, attempts",
+		r.batchSize, r.lease.Milliseconds())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to claim outbox events")
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var event Event
+		var payload []byte
+		if err := rows.Scan(&event.ID, &event.AggregateID, &event.Type, &payload, &event.CreatedAt, &event.Attempts); err != nil {
+			return nil, errors.Wrap(err, "failed to scan outbox event")
+		}
+		event.Payload = payload
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to claim outbox events")
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+// backoff is the wait before the next delivery of an event that failed
+// attempts times before: doubling from minBackoff up to maxBackoff.
+func (r *Relay) backoff(attempts int) time.Duration {
+	backoff := r.minBackoff
+	for i := 0; i < attempts && backoff < r.maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, r.maxBackoff)
+}
+
+func (r *Relay) measureBacklog(ctx context.Context) error {
+	var size int64
+	var age float64
+	err := r.pool.QueryRow(ctx,
+		"SELECT count(*), coalesce(extract(epoch FROM now() - min(created_at)), 0)::float8 FROM outbox").
+		Scan(&size, &age)
+	if err != nil {
+		return errors.Wrap(err, "failed to measure outbox backlog")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.backlogSize = size
+	r.backlogAge = time.Duration(age * float64(time.Second))
+	return nil
+}
+
+// BacklogSize returns the number of events waiting in the outbox.
+func (r *Relay) BacklogSize() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backlogSize
+}
+
+// BacklogAge returns how long the oldest waiting event has been waiting.
+func (r *Relay) BacklogAge() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backlogAge
+}
+
+// PublishedCount returns the number of events delivered since start.
+func (r *Relay) PublishedCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.publishedTotal
+}
+
+// FailedCount returns the number of failed deliveries since start.
+func (r *Relay) FailedCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failedTotal
+}
@@ -0,0 +1,130 @@
+package outbox
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/database"
+	"github.com/dankru/Api_gateway_v2/internal/storage"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink remembers the events it accepted and fails the ones listed
+// in failures once each.
+type recordingSink struct {
+	mu        sync.Mutex
+	published []int64
+	failures  map[int64]bool
+}
+
+func (s *recordingSink) Publish(_ context.Context, event Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures[event.ID] {
+		delete(s.failures, event.ID)
+		return errors.New("sink is down")
+	}
+	s.published = append(s.published, event.ID)
+	return nil
+}
+
+// TestRelay runs against the database in TEST_DATABASE_URL, its outbox is
+// emptied first.
+func TestRelay(t *testing.T) {
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	require.NoError(t, database.Migrate(connStr))
+
+	pool, err := storage.GetConnect(connStr)
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+
+	ctx := context.Background()
+	_, err = pool.Exec(ctx, "TRUNCATE outbox")
+	require.NoError(t, err)
+
+	alice, bob := uuid.New(), uuid.New()
+	alice1 := insertEvent(t, pool, alice)
+	alice2 := insertEvent(t, pool, alice)
+	alice3 := insertEvent(t, pool, alice)
+	bob1 := insertEvent(t, pool, bob)
+
+	sink := &recordingSink{failures: map[int64]bool{alice1: true}}
+	relay := NewRelay(pool, sink, config.Outbox{MinBackoff: time.Hour, MaxBackoff: time.Hour})
+
+	t.Log("Неудачное событие откладывается и задерживает следующие события того же пользователя\n")
+	published, err := relay.relay(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, published)
+	require.Equal(t, []int64{bob1}, sink.published)
+
+	var attempts int
+	var nextAttempt time.Time
+	var lastError string
+	require.NoError(t, pool.QueryRow(ctx, "SELECT attempts, next_attempt_at, last_error FROM outbox WHERE id = $1", alice1).
+		Scan(&attempts, &nextAttempt, &lastError))
+	require.Equal(t, 1, attempts)
+	require.WithinDuration(t, time.Now().Add(time.Hour), nextAttempt, time.Minute)
+	require.Equal(t, "sink is down", lastError)
+
+	published, err = relay.relay(ctx)
+	require.NoError(t, err)
+	require.Zero(t, published)
+
+	t.Log("Событие, заблокированное другим relay, пропускается\n")
+	_, err = pool.Exec(ctx, "UPDATE outbox SET next_attempt_at = now() WHERE id = $1", alice1)
+	require.NoError(t, err)
+	tx, err := pool.Begin(ctx)
+	require.NoError(t, err)
+	_, err = tx.Exec(ctx, "SELECT id FROM outbox WHERE id = $1 FOR UPDATE", alice1)
+	require.NoError(t, err)
+	published, err = relay.relay(ctx)
+	require.NoError(t, err)
+	require.Zero(t, published)
+	require.NoError(t, tx.Rollback(ctx))
+
+	t.Log("Выданное в аренду событие не выдаётся повторно\n")
+	claimed, err := relay.claim(ctx)
+	require.NoError(t, err)
+	require.Len(t, claimed, 1)
+	require.Equal(t, alice1, claimed[0].ID)
+	claimed, err = relay.claim(ctx)
+	require.NoError(t, err)
+	require.Empty(t, claimed)
+
+	t.Log("После доставки события пользователя приходят по порядку\n")
+	_, err = pool.Exec(ctx, "UPDATE outbox SET next_attempt_at = now() WHERE id = $1", alice1)
+	require.NoError(t, err)
+	for {
+		published, err := relay.relay(ctx)
+		require.NoError(t, err)
+		if published == 0 {
+			break
+		}
+	}
+	require.Equal(t, []int64{bob1, alice1, alice2, alice3}, sink.published)
+	require.Equal(t, 4, relay.PublishedCount())
+	require.Equal(t, 1, relay.FailedCount())
+
+	var left int
+	require.NoError(t, pool.QueryRow(ctx, "SELECT count(*) FROM outbox").Scan(&left))
+	require.Zero(t, left)
+}
+
+func insertEvent(t *testing.T, pool *pgxpool.Pool, aggregateID uuid.UUID) int64 {
+	var id int64
+	err := pool.QueryRow(context.Background(),
+		"INSERT INTO outbox (aggregate_id, event_type, payload) VALUES ($1, 'user.updated', '{}') RETURNING id", aggregateID).
+		Scan(&id)
+	require.NoError(t, err)
+	return id
+}
@@ -0,0 +1,95 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Sinks accepted in app.outbox.sink.
+const (
+	SinkLog  = "log"
+	SinkHTTP = "http"
+)
+
+const defaultHTTPTimeout = 5 * time.Second
+
+// NewSink builds the sink named in the configuration.
+func NewSink(cfg config.Outbox) (Sink, error) {
+	switch cfg.Sink {
+	case "", SinkLog:
+		return LogSink{}, nil
+	case SinkHTTP:
+		if cfg.URL == "" {
+			return nil, errors.New("outbox http sink needs a url")
+		}
+		return NewHTTPSink(cfg.URL, cfg.Timeout), nil
+	default:
+		return nil, errors.Errorf("unknown outbox sink %q", cfg.Sink)
+	}
+}
+
+// LogSink writes events to the log. It never fails.
+type LogSink struct{}
+
+func (LogSink) Publish(_ context.Context, event Event) error {
+	log.Info().
+		Int64("event.id", event.ID).
+		Str("event.type", event.Type).
+		Str("event.aggregate_id", event.AggregateID.String()).
+		RawJSON("event.payload", event.Payload).
+		Msg("user event")
+	return nil
+}
+
+// idempotencyKeyHeader carries the event id, so receivers can drop
+// redelivered events.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// HTTPSink POSTs every event as JSON to a URL. Any status but 2xx is a
+// failed delivery.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPSink(url string, timeout time.Duration) *HTTPSink {
+	if timeout <= 0 {
+		timeout = defaultHTTPTimeout
+	}
+	return &HTTPSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (s *HTTPSink) Publish(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode event")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to build request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyKeyHeader, strconv.FormatInt(event.ID, 10))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to post event")
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("event rejected with status %d", resp.StatusCode)
+	}
+	return nil
+}
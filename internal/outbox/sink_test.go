@@ -0,0 +1,91 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPSink_Publish(t *testing.T) {
+	event := Event{
+		ID:          42,
+		AggregateID: uuid.New(),
+		Type:        "user.created",
+		Payload:     json.RawMessage(`{"userId":"1"}`),
+	}
+
+	testCases := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "событие принято", status: http.StatusAccepted},
+		{name: "получатель недоступен", status: http.StatusServiceUnavailable, wantErr: true},
+		{name: "событие отклонено", status: http.StatusBadRequest, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got Event
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, http.MethodPost, r.Method)
+				require.Equal(t, "42", r.Header.Get(idempotencyKeyHeader))
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			err := NewHTTPSink(server.URL, 0).Publish(context.Background(), event)
+			if tc.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, event.ID, got.ID)
+			require.Equal(t, event.AggregateID, got.AggregateID)
+			require.JSONEq(t, string(event.Payload), string(got.Payload))
+		})
+	}
+}
+
+func TestNewSink(t *testing.T) {
+	testCases := []struct {
+		name    string
+		cfg     config.Outbox
+		wantErr bool
+	}{
+		{name: "лог по умолчанию", cfg: config.Outbox{}},
+		{name: "http", cfg: config.Outbox{Sink: SinkHTTP, URL: "http://events.local/users"}},
+		{name: "http без адреса", cfg: config.Outbox{Sink: SinkHTTP}, wantErr: true},
+		{name: "неизвестный приёмник", cfg: config.Outbox{Sink: "kafka"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewSink(tc.cfg)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestRelay_Backoff(t *testing.T) {
+	relay := NewRelay(nil, LogSink{}, config.Outbox{MinBackoff: time.Second, MaxBackoff: 5 * time.Second})
+
+	t.Log("Пауза удваивается после каждой неудачи и не превышает максимум\n")
+	var got []int64
+	for attempts := 0; attempts < 5; attempts++ {
+		got = append(got, int64(relay.backoff(attempts).Seconds()))
+	}
+	require.Equal(t, []int64{1, 2, 4, 5, 5}, got)
+}
@@ -0,0 +1,319 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch
+// (RFC 6902) documents to JSON documents.
+package patch
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MergePatchContentType = "application/merge-patch+json"
+	JSONPatchContentType  = "application/json-patch+json"
+)
+
+var (
+	ErrInvalidPatch = errors.New("invalid patch")
+	// ErrTestFailed is returned when a JSON Patch "test" operation does not
+	// match the document.
+	ErrTestFailed = errors.New("patch test failed")
+)
+
+// Merge applies a JSON Merge Patch to doc: members of the patch replace the
+// members of doc, null removes them and objects are merged recursively.
+func Merge(doc, patch []byte) ([]byte, error) {
+	var target, changes interface{}
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, errors.Wrap(err, "failed to decode document")
+	}
+	if err := json.Unmarshal(patch, &changes); err != nil {
+		return nil, errors.Wrap(ErrInvalidPatch, err.Error())
+	}
+	return json.Marshal(mergeValue(target, changes))
+}
+
+func mergeValue(target, patch interface{}) interface{} {
+	changes, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		object = make(map[string]interface{}, len(changes))
+	}
+	for key, value := range changes {
+		if value == nil {
+			delete(object, key)
+			continue
+		}
+		object[key] = mergeValue(object[key], value)
+	}
+	return object
+}
+
+type operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Apply applies a JSON Patch to doc. Operations run in order and the patch
+// is applied as a whole or not at all.
+func Apply(doc, patch []byte) ([]byte, error) {
+	var root interface{}
+	if err := json.Unmarshal(doc, &root); err != nil {
+		return nil, errors.Wrap(err, "failed to decode document")
+	}
+	var ops []operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, errors.Wrap(ErrInvalidPatch, err.Error())
+	}
+
+	for i, op := range ops {
+		var err error
+		if root, err = applyOperation(root, op); err != nil {
+			return nil, errors.Wrapf(err, "operation %d (%s %s)", i, op.Op, op.Path)
+		}
+	}
+	return json.Marshal(root)
+}
+
+func applyOperation(root interface{}, op operation) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, errors.Wrap(ErrInvalidPatch, "missing value")
+		}
+		var value interface{}
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, errors.Wrap(ErrInvalidPatch, err.Error())
+		}
+
+		switch op.Op {
+		case "add":
+			return add(root, path, value)
+		case "replace":
+			if root, _, err = remove(root, path); err != nil {
+				return nil, err
+			}
+			return add(root, path, value)
+		default:
+			current, err := get(root, path)
+			if err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(current, value) {
+				return nil, ErrTestFailed
+			}
+			return root, nil
+		}
+	case "remove":
+		root, _, err = remove(root, path)
+		return root, err
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		if op.Op == "move" {
+			if isPrefix(from, path) && len(from) < len(path) {
+				return nil, errors.Wrap(ErrInvalidPatch, "cannot move a value into itself")
+			}
+			root, value, err = remove(root, from)
+		} else {
+			value, err = get(root, from)
+			if err == nil {
+				value, err = deepCopy(value)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return add(root, path, value)
+	default:
+		return nil, errors.Wrapf(ErrInvalidPatch, "unknown operation %q", op.Op)
+	}
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.Wrapf(ErrInvalidPatch, "invalid path %q", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func pathError(token string) error {
+	return errors.Wrapf(ErrInvalidPatch, "path not found at %q", token)
+}
+
+// arrayIndex parses an array index that must be below limit.
+func arrayIndex(token string, limit int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= limit || (len(token) > 1 && token[0] == '0') {
+		return 0, pathError(token)
+	}
+	return i, nil
+}
+
+func get(node interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[token]
+			if !ok {
+				return nil, pathError(token)
+			}
+			node = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(n))
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, pathError(token)
+		}
+	}
+	return node, nil
+}
+
+// add sets the value at path and returns the updated node. Arrays grow, so
+// every parent takes the returned child back.
+func add(node interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	token := path[0]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			n[token] = value
+			return n, nil
+		}
+		child, ok := n[token]
+		if !ok {
+			return nil, pathError(token)
+		}
+		updated, err := add(child, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[token] = updated
+		return n, nil
+	case []interface{}:
+		if len(path) == 1 {
+			i := len(n)
+			if token != "-" {
+				var err error
+				if i, err = arrayIndex(token, len(n)+1); err != nil {
+					return nil, err
+				}
+			}
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+			return n, nil
+		}
+		i, err := arrayIndex(token, len(n))
+		if err != nil {
+			return nil, err
+		}
+		updated, err := add(n[i], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = updated
+		return n, nil
+	default:
+		return nil, pathError(token)
+	}
+}
+
+// remove deletes the value at path and returns the updated node together
+// with the removed value.
+func remove(node interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.Wrap(ErrInvalidPatch, "cannot remove the whole document")
+	}
+
+	token := path[0]
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[token]
+		if !ok {
+			return nil, nil, pathError(token)
+		}
+		if len(path) == 1 {
+			delete(n, token)
+			return n, child, nil
+		}
+		updated, removed, err := remove(child, path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[token] = updated
+		return n, removed, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(n))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) == 1 {
+			removed := n[i]
+			return append(n[:i], n[i+1:]...), removed, nil
+		}
+		updated, removed, err := remove(n[i], path[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		n[i] = updated
+		return n, removed, nil
+	default:
+		return nil, nil, pathError(token)
+	}
+}
+
+func deepCopy(value interface{}) (interface{}, error) {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var clone interface{}
+	err = json.Unmarshal(payload, &clone)
+	return clone, err
+}
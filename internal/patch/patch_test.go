@@ -0,0 +1,108 @@
+package patch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMerge(t *testing.T) {
+	testCases := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{
+			name:  "замена поля",
+			doc:   `{"name":"Daniel","age":30}`,
+			patch: `{"name":"Daniil"}`,
+			want:  `{"name":"Daniil","age":30}`,
+		},
+		{
+			name:  "null удаляет поле",
+			doc:   `{"name":"Daniel","age":30}`,
+			patch: `{"age":null}`,
+			want:  `{"name":"Daniel"}`,
+		},
+		{
+			name:  "вложенные объекты сливаются",
+			doc:   `{"a":{"b":1,"c":2}}`,
+			patch: `{"a":{"c":null,"d":3}}`,
+			want:  `{"a":{"b":1,"d":3}}`,
+		},
+		{
+			name:  "не объект заменяет документ",
+			doc:   `{"a":1}`,
+			patch: `[1,2]`,
+			want:  `[1,2]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Merge([]byte(tc.doc), []byte(tc.patch))
+			require.NoError(t, err)
+			require.JSONEq(t, tc.want, string(got))
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	testCases := []struct {
+		name    string
+		doc     string
+		patch   string
+		want    string
+		wantErr error
+	}{
+		{
+			name:  "add, replace и remove",
+			doc:   `{"name":"Daniel","age":30,"tags":["a"]}`,
+			patch: `[{"op":"replace","path":"/name","value":"Daniil"},{"op":"remove","path":"/age"},{"op":"add","path":"/tags/0","value":"b"},{"op":"add","path":"/tags/-","value":"c"}]`,
+			want:  `{"name":"Daniil","tags":["b","a","c"]}`,
+		},
+		{
+			name:  "move и copy",
+			doc:   `{"a":{"b":1},"c":2}`,
+			patch: `[{"op":"move","from":"/a/b","path":"/d"},{"op":"copy","from":"/c","path":"/a/e"}]`,
+			want:  `{"a":{"e":2},"c":2,"d":1}`,
+		},
+		{
+			name:  "экранирование в пути",
+			doc:   `{"a/b":1,"c~d":2}`,
+			patch: `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/c~0d"}]`,
+			want:  `{"a/b":3}`,
+		},
+		{
+			name:    "test не совпал",
+			doc:     `{"age":30}`,
+			patch:   `[{"op":"test","path":"/age","value":31},{"op":"replace","path":"/age","value":32}]`,
+			wantErr: ErrTestFailed,
+		},
+		{
+			name:    "replace несуществующего поля",
+			doc:     `{"age":30}`,
+			patch:   `[{"op":"replace","path":"/name","value":"Daniil"}]`,
+			wantErr: ErrInvalidPatch,
+		},
+		{
+			name:    "неизвестная операция",
+			doc:     `{}`,
+			patch:   `[{"op":"merge","path":"/a","value":1}]`,
+			wantErr: ErrInvalidPatch,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Apply([]byte(tc.doc), []byte(tc.patch))
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.JSONEq(t, tc.want, string(got))
+		})
+	}
+}
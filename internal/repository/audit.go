@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/dankru/Api_gateway_v2/internal/audit"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	auditActionCreate  = "create"
+	auditActionUpdate  = "update"
+	auditActionDelete  = "delete"
+	auditActionRestore = "restore"
+)
+
+const insertAuditSQL = "INSERT INTO user_audit (user_id, action, before, after, claimed_actor, request_id) VALUES ($1, $2, $3, $4, $5, $6)"
+
+// lockUser locks a user that is not deleted for the rest of the transaction
+// and returns it as JSON, the state recorded as before in the audit trail.
+// A non-zero version must match the version of the user.
+func lockUser(ctx context.Context, tx pgx.Tx, id string, version int64) ([]byte, error) {
+	var current int64
+	var before []byte
+	err := tx.QueryRow(ctx, "SELECT version, to_jsonb(users) FROM users WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", id).
+		Scan(&current, &before)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, apperr.ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to lock user")
+	}
+	if version != 0 && version != current {
+		return nil, apperr.ErrPreconditionFailed
+	}
+	return before, nil
+}
+
+// recordChange writes one entry of the audit trail and the event announcing
+// the change. It runs in the transaction of the change, so a change is never
+// left unrecorded or unannounced.
+func recordChange(ctx context.Context, tx pgx.Tx, userID, action string, before, after []byte) error {
+	source := audit.FromContext(ctx)
+	if _, err := tx.Exec(ctx, insertAuditSQL, userID, action, nullableJSON(before), nullableJSON(after), source.ClaimedActor, source.RequestID); err != nil {
+		return errors.Wrap(err, "failed to record audit")
+	}
+	eventType, payload, err := userEvent(source, userID, action, after)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, insertOutboxSQL, userID, eventType, payload); err != nil {
+		return errors.Wrap(err, "failed to write outbox event")
+	}
+	return nil
+}
+
+// queueChange is recordChange for changes sent as a batch.
+func queueChange(batch *pgx.Batch, source audit.Source, userID, action string, before, after []byte) error {
+	eventType, payload, err := userEvent(source, userID, action, after)
+	if err != nil {
+		return err
+	}
+	batch.Queue(insertAuditSQL, userID, action, nullableJSON(before), nullableJSON(after), source.ClaimedActor, source.RequestID)
+	batch.Queue(insertOutboxSQL, userID, eventType, payload)
+	return nil
+}
+
+// nullableJSON passes JSON as text, so Postgres parses it into jsonb, and a
+// missing document as NULL.
+func nullableJSON(doc []byte) interface{} {
+	if doc == nil {
+		return nil
+	}
+	return string(doc)
+}
+
+// GetUserHistory returns the audit trail of a user, newest entries first.
+// It is kept after the user is deleted or purged, users that never existed
+// are not found.
+func (u *UserRepository) GetUserHistory(ctx context.Context, id string, query models.UserHistoryQuery) (models.UserHistoryPage, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "UserRepository.GetUserHistory")
+	defer span.End()
+
+	limit := clampListLimit(query.Limit)
+	args := []interface{}{id}
+	sql := "SELECT id, user_id, action, before, after, claimed_actor, request_id, changed_at FROM user_audit WHERE user_id = $1"
+	if query.Cursor != "" {
+		cursor, err := strconv.ParseInt(query.Cursor, 10, 64)
+		if err != nil || cursor <= 0 {
+			return models.UserHistoryPage{}, errors.Wrap(apperr.ErrInvalidArgument, "invalid cursor")
+		}
+		args = append(args, cursor)
+		sql += " AND id < $2"
+	}
+	args = append(args, limit+1)
+	sql += " ORDER BY id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	span.SetAttributes(
+		attribute.String("db.query", sql),
+		attribute.String("db.params.id", id),
+		attribute.Int("db.params.limit", limit),
+		attribute.String("db.system", "postgres"),
+	)
+
+	start := time.Now()
+	rows, err := u.readDB(ctx).Query(ctx, sql, args...)
+	if err != nil {
+		return models.UserHistoryPage{}, classifyError(errors.Wrap(err, "failed to get user history"))
+	}
+	defer rows.Close()
+
+	entries := make([]models.UserAuditEntry, 0, limit+1)
+	for rows.Next() {
+		var entry models.UserAuditEntry
+		var before, after []byte
+		if err := rows.Scan(&entry.ID, &entry.UserID, &entry.Action, &before, &after,
+			&entry.ClaimedActor, &entry.RequestID, &entry.ChangedAt); err != nil {
+			return models.UserHistoryPage{}, errors.Wrap(err, "failed to scan audit entry")
+		}
+		entry.Before, entry.After = before, after
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+
+	duration := time.Since(start)
+
+	span.SetAttributes(
+		attribute.Int64("db.duration_ms", duration.Milliseconds()),
+		attribute.Bool("db.success", err == nil),
+	)
+
+	if err != nil {
+		return models.UserHistoryPage{}, classifyError(errors.Wrap(err, "failed to get user history"))
+	}
+	if len(entries) == 0 && query.Cursor == "" {
+		return models.UserHistoryPage{}, apperr.ErrNotFound
+	}
+
+	page := models.UserHistoryPage{Entries: entries}
+	if len(entries) > limit {
+		page.Entries = entries[:limit]
+		page.NextCursor = strconv.FormatInt(page.Entries[limit-1].ID, 10)
+	}
+	return page, nil
+}
@@ -0,0 +1,408 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/database"
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/dankru/Api_gateway_v2/internal/audit"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/dankru/Api_gateway_v2/internal/storage"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+// conformanceStore is what every storage driver offers: the users, the
+// retention purge and units of work.
+type conformanceStore interface {
+	UserProvider
+	PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, error)
+	WithinTx(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type postgresStore struct {
+	*UserRepository
+	*TxManager
+}
+
+func TestMemoryRepository(t *testing.T) {
+	testConformance(t, func(t *testing.T) conformanceStore {
+		return NewMemoryRepository()
+	})
+}
+
+// TestUserRepository runs against the database in TEST_DATABASE_URL, which
+// is migrated and emptied before every case.
+func TestUserRepository(t *testing.T) {
+	connStr := os.Getenv("TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	require.NoError(t, database.Migrate(connStr))
+
+	pool, err := storage.GetConnect(connStr)
+	require.NoError(t, err)
+	t.Cleanup(pool.Close)
+
+	txManager, err := NewTxManager(pool, config.Tx{})
+	require.NoError(t, err)
+
+	testConformance(t, func(t *testing.T) conformanceStore {
+		_, err := pool.Exec(context.Background(), "TRUNCATE users, user_audit, outbox")
+		require.NoError(t, err)
+		return postgresStore{UserRepository: NewUserRepository(pool, nil), TxManager: txManager}
+	})
+
+	t.Run("ключи сортировки не бывают NULL", func(t *testing.T) {
+		for _, sql := range []string{
+			"INSERT INTO users (name, age) VALUES (NULL, 30)",
+			"INSERT INTO users (name, age) VALUES ('Daniel', NULL)",
+		} {
+			_, err := pool.Exec(context.Background(), sql)
+			require.ErrorIs(t, classifyError(err), apperr.ErrValidation, sql)
+		}
+	})
+
+	t.Run("отклонённый пользователь пакета", func(t *testing.T) {
+		ctx := context.Background()
+		_, err := pool.Exec(ctx, "TRUNCATE users, user_audit, outbox")
+		require.NoError(t, err)
+		repo := NewUserRepository(pool, nil)
+		userReqs := []models.UserRequest{{Name: "Daniel", Age: 30}, {Name: strings.Repeat("D", 256), Age: 30}, {Name: "Daniil", Age: 31}}
+
+		t.Log("Частичный пакет создаёт остальных пользователей\n")
+		ids, errs, err := repo.CreateUsersPartially(ctx, userReqs)
+		require.NoError(t, err)
+		require.NotEqual(t, uuid.Nil, ids[0])
+		require.Equal(t, uuid.Nil, ids[1])
+		require.NotEqual(t, uuid.Nil, ids[2])
+		require.NoError(t, errs[0])
+		require.ErrorIs(t, errs[1], apperr.ErrValidation)
+		require.NoError(t, errs[2])
+
+		t.Log("Атомарный пакет называет отклонённого пользователя\n")
+		_, err = repo.CreateUsers(ctx, userReqs)
+		var itemErr *apperr.BatchItemError
+		require.ErrorAs(t, err, &itemErr)
+		require.Equal(t, 1, itemErr.Index)
+		require.ErrorIs(t, err, apperr.ErrValidation)
+
+		var count int
+		require.NoError(t, pool.QueryRow(ctx, "SELECT count(*) FROM users").Scan(&count))
+		require.Equal(t, 2, count)
+	})
+}
+
+func testConformance(t *testing.T, newStore func(t *testing.T) conformanceStore) {
+	ctx := audit.NewContext(context.Background(), audit.Source{ClaimedActor: "tester", RequestID: "req-1"})
+	missing := uuid.New().String()
+
+	create := func(ctx context.Context, t *testing.T, store conformanceStore, name string, age int) string {
+		id, err := store.CreateUser(ctx, models.UserRequest{Name: name, Age: age})
+		require.NoError(t, err)
+		return id.String()
+	}
+
+	t.Run("создание и чтение", func(t *testing.T) {
+		store := newStore(t)
+		id := create(ctx, t, store, "Daniel", 30)
+
+		user, err := store.GetUser(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, id, user.ID.String())
+		require.Equal(t, "Daniel", user.Name)
+		require.Equal(t, 30, user.Age)
+		require.Equal(t, int64(1), user.Version)
+
+		_, err = store.GetUser(ctx, missing)
+		require.ErrorIs(t, err, apperr.ErrNotFound)
+	})
+
+	t.Run("обновление с проверкой версии", func(t *testing.T) {
+		store := newStore(t)
+		id := create(ctx, t, store, "Daniel", 30)
+
+		testCases := []struct {
+			name    string
+			id      string
+			version int64
+			wantErr error
+		}{
+			{name: "устаревшая версия", id: id, version: 5, wantErr: apperr.ErrPreconditionFailed},
+			{name: "текущая версия", id: id, version: 1},
+			{name: "без проверки версии", id: id, version: 0},
+			{name: "неизвестный пользователь", id: missing, wantErr: apperr.ErrNotFound},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := store.UpdateUser(ctx, tc.id, models.UserRequest{Name: "Daniil", Age: 31}, tc.version)
+				require.ErrorIs(t, err, tc.wantErr)
+			})
+		}
+
+		user, err := store.GetUser(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, "Daniil", user.Name)
+		require.Equal(t, int64(3), user.Version)
+	})
+
+	t.Run("частичное обновление", func(t *testing.T) {
+		store := newStore(t)
+		id := create(ctx, t, store, "Daniel", 30)
+		age := 31
+
+		user, err := store.PatchUser(ctx, id, models.UserPatch{Age: &age}, 1)
+		require.NoError(t, err)
+		require.Equal(t, "Daniel", user.Name)
+		require.Equal(t, 31, user.Age)
+		require.Equal(t, int64(2), user.Version)
+
+		t.Log("Пустой патч не меняет версию\n")
+		user, err = store.PatchUser(ctx, id, models.UserPatch{}, 2)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), user.Version)
+
+		_, err = store.PatchUser(ctx, id, models.UserPatch{Age: &age}, 1)
+		require.ErrorIs(t, err, apperr.ErrPreconditionFailed)
+	})
+
+	t.Run("мягкое удаление и восстановление", func(t *testing.T) {
+		store := newStore(t)
+		id := create(ctx, t, store, "Daniel", 30)
+
+		_, err := store.RestoreUser(ctx, id)
+		require.ErrorIs(t, err, apperr.ErrNotFound)
+
+		require.NoError(t, store.DeleteUser(ctx, id, 1))
+		_, err = store.GetUser(ctx, id)
+		require.ErrorIs(t, err, apperr.ErrNotFound)
+		require.ErrorIs(t, store.DeleteUser(ctx, id, 0), apperr.ErrNotFound)
+
+		user, err := store.RestoreUser(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, int64(3), user.Version)
+
+		t.Log("Удалённые до срока хранения пользователи удаляются навсегда\n")
+		require.NoError(t, store.DeleteUser(ctx, id, 0))
+		purged, err := store.PurgeDeletedUsers(ctx, time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, int64(1), purged)
+		_, err = store.RestoreUser(ctx, id)
+		require.ErrorIs(t, err, apperr.ErrNotFound)
+	})
+
+	t.Run("постраничный список", func(t *testing.T) {
+		store := newStore(t)
+		for age := 20; age < 25; age++ {
+			create(ctx, t, store, "User", age)
+		}
+		t.Log("Одинаковые значения сортировки на границе страниц не теряются и не повторяются\n")
+		create(ctx, t, store, "Twin", 22)
+		create(ctx, t, store, "Twin", 22)
+		require.NoError(t, store.DeleteUser(ctx, create(ctx, t, store, "Deleted", 99), 0))
+
+		var ages []int
+		seen := make(map[string]struct{})
+		query := models.UserListQuery{Limit: 2, Sort: "-age"}
+		for {
+			page, err := store.ListUsers(ctx, query)
+			require.NoError(t, err)
+			for _, user := range page.Users {
+				ages = append(ages, user.Age)
+				seen[user.ID.String()] = struct{}{}
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+		require.Equal(t, []int{24, 23, 22, 22, 22, 21, 20}, ages)
+		require.Len(t, seen, len(ages))
+
+		ageGTE := 23
+		page, err := store.ListUsers(ctx, models.UserListQuery{Sort: "age", Filter: models.UserFilter{AgeGTE: &ageGTE}})
+		require.NoError(t, err)
+		require.Len(t, page.Users, 2)
+		require.Equal(t, 23, page.Users[0].Age)
+
+		_, err = store.ListUsers(ctx, models.UserListQuery{Sort: "password"})
+		require.ErrorIs(t, err, apperr.ErrInvalidArgument)
+		_, err = store.ListUsers(ctx, models.UserListQuery{Cursor: "garbage"})
+		require.ErrorIs(t, err, apperr.ErrInvalidArgument)
+	})
+
+	t.Run("поиск", func(t *testing.T) {
+		store := newStore(t)
+		alice := create(ctx, t, store, "Alice Smith", 30)
+		create(ctx, t, store, "Bob Stone", 40)
+		require.NoError(t, store.DeleteUser(ctx, create(ctx, t, store, "Alice Deleted", 50), 0))
+
+		users, err := store.SearchUsers(ctx, models.UserSearchQuery{Text: "alice", Limit: 10, MinSimilarity: 0.3})
+		require.NoError(t, err)
+		require.Len(t, users, 1)
+		require.Equal(t, alice, users[0].ID.String())
+
+		users, err = store.SearchUsers(ctx, models.UserSearchQuery{Text: "smith", Mode: searchModeFullText, Limit: 10})
+		require.NoError(t, err)
+		require.Len(t, users, 1)
+		require.Equal(t, alice, users[0].ID.String())
+
+		_, err = store.SearchUsers(ctx, models.UserSearchQuery{Text: "alice", Mode: "regex", Limit: 10})
+		require.ErrorIs(t, err, apperr.ErrInvalidArgument)
+	})
+
+	t.Run("порог сходства и лимит поиска", func(t *testing.T) {
+		store := newStore(t)
+		alice := create(ctx, t, store, "Alice", 30)
+		create(ctx, t, store, "Alice Cooper", 40)
+		create(ctx, t, store, "Alice Liddell", 50)
+		create(ctx, t, store, "Bob", 60)
+
+		testCases := []struct {
+			name          string
+			text          string
+			minSimilarity float64
+			limit         int
+			wantLen       int
+		}{
+			{name: "опечатка проходит низкий порог", text: "Alise", minSimilarity: 0.3, limit: 10, wantLen: 3},
+			{name: "опечатка не проходит высокий порог", text: "Alise", minSimilarity: 0.9, limit: 10, wantLen: 0},
+			{name: "лимит ограничивает выдачу", text: "alice", minSimilarity: 0.3, limit: 2, wantLen: 2},
+			{name: "нулевой лимит", text: "alice", minSimilarity: 0.3, limit: 0, wantLen: 0},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				users, err := store.SearchUsers(ctx, models.UserSearchQuery{Text: tc.text, Limit: tc.limit, MinSimilarity: tc.minSimilarity})
+				require.NoError(t, err)
+				require.Len(t, users, tc.wantLen)
+			})
+		}
+
+		t.Log("Точное совпадение идёт первым\n")
+		users, err := store.SearchUsers(ctx, models.UserSearchQuery{Text: "alice", Limit: 1, MinSimilarity: 0.3})
+		require.NoError(t, err)
+		require.Len(t, users, 1)
+		require.Equal(t, alice, users[0].ID.String())
+	})
+
+	t.Run("полнотекстовый поиск", func(t *testing.T) {
+		store := newStore(t)
+		create(ctx, t, store, "Alice Cooper", 30)
+		liddell := create(ctx, t, store, "Alice Liddell", 40)
+
+		testCases := []struct {
+			name string
+			text string
+			want []string
+		}{
+			{name: "только целые слова", text: "alic", want: nil},
+			{name: "все слова запроса", text: "alice liddell", want: []string{liddell}},
+			{name: "исключённое слово", text: "alice -cooper", want: []string{liddell}},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				users, err := store.SearchUsers(ctx, models.UserSearchQuery{Text: tc.text, Mode: searchModeFullText, Limit: 10})
+				require.NoError(t, err)
+				var ids []string
+				for _, user := range users {
+					ids = append(ids, user.ID.String())
+				}
+				require.Equal(t, tc.want, ids)
+			})
+		}
+	})
+
+	t.Run("история изменений", func(t *testing.T) {
+		store := newStore(t)
+		id := create(ctx, t, store, "Daniel", 30)
+		_, err := store.UpdateUser(ctx, id, models.UserRequest{Name: "Daniil", Age: 30}, 0)
+		require.NoError(t, err)
+		require.NoError(t, store.DeleteUser(ctx, id, 0))
+		_, err = store.RestoreUser(ctx, id)
+		require.NoError(t, err)
+
+		page, err := store.GetUserHistory(ctx, id, models.UserHistoryQuery{Limit: 3})
+		require.NoError(t, err)
+		require.NotEmpty(t, page.NextCursor)
+		actions := []string{}
+		for _, entry := range page.Entries {
+			require.Equal(t, "tester", entry.ClaimedActor)
+			require.Equal(t, "req-1", entry.RequestID)
+			actions = append(actions, entry.Action)
+		}
+		require.Equal(t, []string{"restore", "delete", "update"}, actions)
+
+		page, err = store.GetUserHistory(ctx, id, models.UserHistoryQuery{Limit: 3, Cursor: page.NextCursor})
+		require.NoError(t, err)
+		require.Len(t, page.Entries, 1)
+		require.Equal(t, "create", page.Entries[0].Action)
+		require.Nil(t, page.Entries[0].Before)
+		require.Empty(t, page.NextCursor)
+
+		_, err = store.GetUserHistory(ctx, missing, models.UserHistoryQuery{})
+		require.ErrorIs(t, err, apperr.ErrNotFound)
+	})
+
+	t.Run("пакетные операции", func(t *testing.T) {
+		store := newStore(t)
+		ids, err := store.CreateUsers(ctx, []models.UserRequest{{Name: "Daniel", Age: 30}, {Name: "Daniil", Age: 31}})
+		require.NoError(t, err)
+		require.Len(t, ids, 2)
+
+		users, err := store.GetUsers(ctx, []string{ids[0].String(), ids[1].String(), missing})
+		require.NoError(t, err)
+		require.Len(t, users, 2)
+
+		created, errs, err := store.CreateUsersPartially(ctx, []models.UserRequest{{Name: "Dmitry", Age: 20}})
+		require.NoError(t, err)
+		require.Len(t, created, 1)
+		require.NoError(t, errs[0])
+
+		deleted, err := store.DeleteUsers(ctx, []string{ids[0].String(), missing})
+		require.NoError(t, err)
+		require.Equal(t, []string{ids[0].String()}, deleted)
+
+		deleted, err = store.DeleteUsers(ctx, []string{ids[0].String()})
+		require.NoError(t, err)
+		require.Empty(t, deleted)
+	})
+
+	t.Run("транзакции", func(t *testing.T) {
+		store := newStore(t)
+		var rolledBack string
+		var hooks int
+		errAbort := errors.New("abort")
+
+		err := store.WithinTx(ctx, func(ctx context.Context) error {
+			rolledBack = create(ctx, t, store, "Rolled Back", 30)
+			AfterCommit(ctx, func() { hooks++ })
+			return errAbort
+		})
+		require.ErrorIs(t, err, errAbort)
+		_, err = store.GetUser(ctx, rolledBack)
+		require.ErrorIs(t, err, apperr.ErrNotFound)
+		require.Zero(t, hooks)
+
+		var committed string
+		err = store.WithinTx(ctx, func(ctx context.Context) error {
+			committed = create(ctx, t, store, "Committed", 30)
+			AfterCommit(ctx, func() { hooks++ })
+			_, err := store.UpdateUser(ctx, committed, models.UserRequest{Name: "Committed", Age: 31}, 1)
+			return err
+		})
+		require.NoError(t, err)
+		user, err := store.GetUser(ctx, committed)
+		require.NoError(t, err)
+		require.Equal(t, 31, user.Age)
+		require.Equal(t, 1, hooks)
+	})
+}
@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultListLimit = 20
+	maxListLimit     = 100
+	defaultListSort  = "created_at"
+)
+
+// sortColumns maps the sort fields accepted by ListUsers to columns. Every
+// column is NOT NULL and indexed together with id for keyset pagination.
+var sortColumns = map[string]string{
+	"created_at": "created_at",
+	"name":       "name",
+	"age":        "age",
+}
+
+// userSort is a parsed sort parameter.
+type userSort struct {
+	field  string
+	column string
+	desc   bool
+}
+
+func parseUserSort(sort string) (userSort, error) {
+	if sort == "" {
+		sort = defaultListSort
+	}
+	field := strings.TrimPrefix(sort, "-")
+	column, ok := sortColumns[field]
+	if !ok {
+		return userSort{}, errors.Wrapf(apperr.ErrInvalidArgument, "unknown sort field %q", field)
+	}
+	return userSort{field: field, column: column, desc: strings.HasPrefix(sort, "-")}, nil
+}
+
+func (s userSort) String() string {
+	if s.desc {
+		return "-" + s.field
+	}
+	return s.field
+}
+
+// value returns the sort key of u as it is written to a cursor.
+func (s userSort) value(u *models.User) string {
+	switch s.field {
+	case "name":
+		return u.Name
+	case "age":
+		return strconv.Itoa(u.Age)
+	default:
+		return u.CreatedAt.Format(time.RFC3339Nano)
+	}
+}
+
+// parseValue turns a cursor value back into a query parameter.
+func (s userSort) parseValue(value string) (interface{}, error) {
+	switch s.field {
+	case "name":
+		return value, nil
+	case "age":
+		return strconv.Atoi(value)
+	default:
+		return time.Parse(time.RFC3339Nano, value)
+	}
+}
+
+// userCursor points right after the last user of a page. It carries the sort
+// it was made for, so it cannot be replayed with another order.
+type userCursor struct {
+	Sort  string    `json:"s"`
+	Value string    `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+func encodeUserCursor(sort userSort, last *models.User) string {
+	payload, _ := json.Marshal(userCursor{Sort: sort.String(), Value: sort.value(last), ID: last.ID})
+	return base64.RawURLEncoding.EncodeToString(payload)
+}
+
+func decodeUserCursor(cursor string, sort userSort) (userCursor, error) {
+	invalid := errors.Wrap(apperr.ErrInvalidArgument, "invalid cursor")
+
+	payload, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return userCursor{}, invalid
+	}
+	var c userCursor
+	if err := json.Unmarshal(payload, &c); err != nil || c.Sort != sort.String() {
+		return userCursor{}, invalid
+	}
+	return c, nil
+}
+
+func clampListLimit(limit int) int {
+	if limit <= 0 {
+		return defaultListLimit
+	}
+	return min(limit, maxListLimit)
+}
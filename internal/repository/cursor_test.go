@@ -0,0 +1,100 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserCursor(t *testing.T) {
+	user := &models.User{
+		ID:        uuid.New(),
+		Name:      "Daniel",
+		Age:       30,
+		CreatedAt: time.Date(2025, 6, 10, 9, 0, 0, 123456000, time.UTC),
+	}
+
+	testCases := []struct {
+		name      string
+		sort      string
+		wantValue interface{}
+	}{
+		{name: "по умолчанию по дате создания", sort: "", wantValue: user.CreatedAt},
+		{name: "по имени", sort: "name", wantValue: "Daniel"},
+		{name: "по возрасту по убыванию", sort: "-age", wantValue: 30},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sort, err := parseUserSort(tc.sort)
+			require.NoError(t, err)
+
+			cursor, err := decodeUserCursor(encodeUserCursor(sort, user), sort)
+			require.NoError(t, err)
+			require.Equal(t, user.ID, cursor.ID)
+
+			value, err := sort.parseValue(cursor.Value)
+			require.NoError(t, err)
+			if want, ok := tc.wantValue.(time.Time); ok {
+				require.True(t, want.Equal(value.(time.Time)))
+				return
+			}
+			require.Equal(t, tc.wantValue, value)
+		})
+	}
+}
+
+func TestDecodeUserCursor_Invalid(t *testing.T) {
+	byName, err := parseUserSort("name")
+	require.NoError(t, err)
+	byAgeDesc, err := parseUserSort("-age")
+	require.NoError(t, err)
+	user := &models.User{ID: uuid.New(), Name: "Daniel"}
+
+	testCases := []struct {
+		name   string
+		cursor string
+	}{
+		{name: "не base64", cursor: "!!!"},
+		{name: "не json", cursor: "bm90IGpzb24"},
+		{name: "другая сортировка", cursor: encodeUserCursor(byAgeDesc, user)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := decodeUserCursor(tc.cursor, byName)
+			require.ErrorIs(t, err, apperr.ErrInvalidArgument)
+		})
+	}
+}
+
+func TestParseUserSort(t *testing.T) {
+	testCases := []struct {
+		name    string
+		sort    string
+		want    userSort
+		wantErr error
+	}{
+		{name: "по умолчанию", sort: "", want: userSort{field: "created_at", column: "created_at"}},
+		{name: "по убыванию", sort: "-name", want: userSort{field: "name", column: "name", desc: true}},
+		{name: "неизвестное поле", sort: "password", wantErr: apperr.ErrInvalidArgument},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sort, err := parseUserSort(tc.sort)
+			require.ErrorIs(t, err, tc.wantErr)
+			require.Equal(t, tc.want, sort)
+		})
+	}
+}
+
+func TestClampListLimit(t *testing.T) {
+	require.Equal(t, defaultListLimit, clampListLimit(0))
+	require.Equal(t, 5, clampListLimit(5))
+	require.Equal(t, maxListLimit, clampListLimit(maxListLimit+1))
+}
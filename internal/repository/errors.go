@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"net"
+
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/jackc/pgconn"
+	"github.com/pkg/errors"
+)
+
+// SQLSTATEs classified by classifyError.
+const (
+	uniqueViolation          = "23505"
+	notNullViolation         = "23502"
+	checkViolation           = "23514"
+	stringDataTruncation     = "22001"
+	numericValueOutOfRange   = "22003"
+	queryCanceled            = "57014"
+	lockNotAvailable         = "55P03"
+	adminShutdown            = "57P01"
+	crashShutdown            = "57P02"
+	cannotConnectNow         = "57P03"
+	tooManyConnections       = "53300"
+	connectionExceptionClass = "08"
+)
+
+// classifyError turns driver errors into apperr.DBError so callers can tell
+// conflicts, invalid data and an unavailable database from other failures.
+// Errors it does not recognise are returned unchanged.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var dbErr *apperr.DBError
+	if errors.As(err, &dbErr) {
+		return err
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch {
+		case pgErr.Code == uniqueViolation:
+			return &apperr.DBError{Kind: apperr.ErrConflict, Constraint: pgErr.ConstraintName, Err: err}
+		case pgErr.Code == notNullViolation, pgErr.Code == checkViolation,
+			pgErr.Code == stringDataTruncation, pgErr.Code == numericValueOutOfRange:
+			constraint := pgErr.ConstraintName
+			if constraint == "" && pgErr.ColumnName != "" {
+				constraint = pgErr.TableName + "." + pgErr.ColumnName
+			}
+			return &apperr.DBError{Kind: apperr.ErrValidation, Constraint: constraint, Err: err}
+		case pgErr.Code == queryCanceled, pgErr.Code == lockNotAvailable,
+			pgErr.Code == adminShutdown, pgErr.Code == crashShutdown,
+			pgErr.Code == cannotConnectNow, pgErr.Code == tooManyConnections,
+			len(pgErr.Code) == 5 && pgErr.Code[:2] == connectionExceptionClass:
+			return &apperr.DBError{Kind: apperr.ErrUnavailable, Err: err}
+		}
+		return err
+	}
+
+	var netErr net.Error
+	if pgconn.Timeout(err) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return &apperr.DBError{Kind: apperr.ErrUnavailable, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/jackc/pgconn"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		name           string
+		err            error
+		wantKind       error
+		wantConstraint string
+	}{
+		{
+			name:           "нарушение уникальности",
+			err:            errors.Wrap(&pgconn.PgError{Code: uniqueViolation, ConstraintName: "users_pkey"}, "failed to create users"),
+			wantKind:       apperr.ErrConflict,
+			wantConstraint: "users_pkey",
+		},
+		{
+			name:           "нарушение check",
+			err:            &pgconn.PgError{Code: checkViolation, ConstraintName: "users_age_check"},
+			wantKind:       apperr.ErrValidation,
+			wantConstraint: "users_age_check",
+		},
+		{
+			name:           "null в not null колонке",
+			err:            &pgconn.PgError{Code: notNullViolation, TableName: "users", ColumnName: "name"},
+			wantKind:       apperr.ErrValidation,
+			wantConstraint: "users.name",
+		},
+		{
+			name:     "обрыв соединения",
+			err:      &pgconn.PgError{Code: "08006"},
+			wantKind: apperr.ErrUnavailable,
+		},
+		{
+			name:     "таймаут",
+			err:      errors.Wrap(context.DeadlineExceeded, "failed to list users"),
+			wantKind: apperr.ErrUnavailable,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := classifyError(tc.err)
+			require.ErrorIs(t, err, tc.wantKind)
+
+			var dbErr *apperr.DBError
+			require.ErrorAs(t, err, &dbErr)
+			require.Equal(t, tc.wantConstraint, dbErr.Constraint)
+			require.ErrorIs(t, err, errors.Cause(tc.err))
+		})
+	}
+
+	t.Log("Прочие ошибки не меняются\n")
+	for _, err := range []error{nil, apperr.ErrNotFound, context.Canceled, &pgconn.PgError{Code: "42P01"}} {
+		require.Equal(t, err, classifyError(err))
+	}
+}
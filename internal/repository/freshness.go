@@ -0,0 +1,38 @@
+package repository
+
+import "context"
+
+// Freshness tells how the value returned by a UserProvider relates to the
+// database at the time of the call. Only caching providers report Stale.
+type Freshness int
+
+const (
+	// Fresh entries were loaded from the source or are within their TTL.
+	Fresh Freshness = iota
+	// Stale entries outlived their TTL and were served because the source
+	// failed.
+	Stale
+)
+
+func (f Freshness) String() string {
+	if f == Stale {
+		return "stale"
+	}
+	return "fresh"
+}
+
+type freshnessKey struct{}
+
+// TrackFreshness returns a context that GetUser reports freshness into.
+func TrackFreshness(ctx context.Context) (context.Context, *Freshness) {
+	freshness := new(Freshness)
+	return context.WithValue(ctx, freshnessKey{}, freshness), freshness
+}
+
+// MarkStale reports into the context passed to TrackFreshness that the value
+// being returned is stale.
+func MarkStale(ctx context.Context) {
+	if freshness, ok := ctx.Value(freshnessKey{}).(*Freshness); ok {
+		*freshness = Stale
+	}
+}
@@ -7,9 +7,21 @@ import (
 	"github.com/google/uuid"
 )
 
+// UserProvider stores users. Writes take the version the caller expects the
+// user to have and fail with apperr.ErrPreconditionFailed when it has
+// another one, a zero version skips the check.
 type UserProvider interface {
 	GetUser(ctx context.Context, id string) (*models.User, error)
 	CreateUser(ctx context.Context, userReq models.UserRequest) (uuid.UUID, error)
-	UpdateUser(ctx context.Context, id string, userReq models.UserRequest) (*models.User, error)
-	DeleteUser(ctx context.Context, id string) error
+	UpdateUser(ctx context.Context, id string, userReq models.UserRequest, version int64) (*models.User, error)
+	PatchUser(ctx context.Context, id string, patch models.UserPatch, version int64) (*models.User, error)
+	DeleteUser(ctx context.Context, id string, version int64) error
+	RestoreUser(ctx context.Context, id string) (*models.User, error)
+	ListUsers(ctx context.Context, query models.UserListQuery) (models.UserPage, error)
+	SearchUsers(ctx context.Context, query models.UserSearchQuery) ([]*models.User, error)
+	GetUserHistory(ctx context.Context, id string, query models.UserHistoryQuery) (models.UserHistoryPage, error)
+	CreateUsers(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, error)
+	CreateUsersPartially(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, []error, error)
+	GetUsers(ctx context.Context, ids []string) ([]*models.User, error)
+	DeleteUsers(ctx context.Context, ids []string) ([]string, error)
 }
@@ -0,0 +1,704 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/dankru/Api_gateway_v2/internal/audit"
+	"github.com/dankru/Api_gateway_v2/internal/models"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+)
+
+// memoryUser is a stored user and its deletion mark.
+type memoryUser struct {
+	user      models.User
+	deletedAt *time.Time
+}
+
+// userDoc is a user as Postgres writes it with to_jsonb(users), the form
+// kept in the audit trail.
+type userDoc struct {
+	ID        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	Age       int        `json:"age"`
+	Anonymous bool       `json:"anonymous"`
+	Version   int64      `json:"version"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+func (m *memoryUser) doc() []byte {
+	doc, _ := json.Marshal(userDoc{
+		ID:        m.user.ID,
+		Name:      m.user.Name,
+		Age:       m.user.Age,
+		Anonymous: m.user.Anonymous,
+		Version:   m.user.Version,
+		UpdatedAt: m.user.UpdatedAt,
+		CreatedAt: m.user.CreatedAt,
+		DeletedAt: m.deletedAt,
+	})
+	return doc
+}
+
+// MemoryRepository keeps users in memory, for running the gateway without
+// Postgres. It behaves like UserRepository: users are soft-deleted, writes
+// bump the version and are recorded in the audit trail. Units of work run
+// by WithinTx hold the store exclusively and are undone when they fail.
+type MemoryRepository struct {
+	mu        sync.RWMutex
+	users     map[uuid.UUID]*memoryUser
+	audit     []models.UserAuditEntry
+	nextAudit int64
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users:     make(map[uuid.UUID]*memoryUser),
+		nextAudit: 1,
+	}
+}
+
+// now returns the time with the precision Postgres stores.
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// lock takes the store for reading or writing and returns the unlock. Calls
+// within WithinTx already hold it.
+func (m *MemoryRepository) lock(ctx context.Context, write bool) func() {
+	if InTx(ctx) {
+		return func() {}
+	}
+	if write {
+		m.mu.Lock()
+		return m.mu.Unlock
+	}
+	m.mu.RLock()
+	return m.mu.RUnlock
+}
+
+// WithinTx runs fn with the store held exclusively. When fn fails every
+// change it made is undone. fn must not share ctx with other goroutines.
+func (m *MemoryRepository) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if InTx(ctx) {
+		return fn(ctx)
+	}
+
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "MemoryRepository.WithinTx")
+	defer span.End()
+
+	state := &txState{}
+	if err := m.runTx(context.WithValue(ctx, txKey{}, state), fn); err != nil {
+		return err
+	}
+	for _, hook := range state.afterCommit {
+		hook()
+	}
+	return nil
+}
+
+// runTx runs fn holding the store and restores the store as it was before
+// when fn fails or panics.
+func (m *MemoryRepository) runTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users := make(map[uuid.UUID]*memoryUser, len(m.users))
+	for id, stored := range m.users {
+		clone := *stored
+		users[id] = &clone
+	}
+	auditLen, nextAudit := len(m.audit), m.nextAudit
+
+	committed := false
+	defer func() {
+		if !committed {
+			m.users, m.audit, m.nextAudit = users, m.audit[:auditLen], nextAudit
+		}
+	}()
+
+	if err := fn(ctx); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// live returns the user with the given id unless it is unknown or deleted.
+func (m *MemoryRepository) live(id string) (*memoryUser, bool) {
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, false
+	}
+	stored, ok := m.users[userID]
+	if !ok || stored.deletedAt != nil {
+		return nil, false
+	}
+	return stored, true
+}
+
+// write applies change to a live user, bumping its version as the
+// users_bump_version trigger does, and records it in the audit trail.
+func (m *MemoryRepository) write(ctx context.Context, stored *memoryUser, action string, change func(*memoryUser)) {
+	before := stored.doc()
+	change(stored)
+	stored.user.Version++
+	stored.user.UpdatedAt = now()
+	m.recordAudit(audit.FromContext(ctx), stored.user.ID, action, before, stored.doc())
+}
+
+func (m *MemoryRepository) recordAudit(source audit.Source, userID uuid.UUID, action string, before, after []byte) {
+	m.audit = append(m.audit, models.UserAuditEntry{
+		ID:           m.nextAudit,
+		UserID:       userID,
+		Action:       action,
+		Before:       before,
+		After:        after,
+		ClaimedActor: source.ClaimedActor,
+		RequestID:    source.RequestID,
+		ChangedAt:    now(),
+	})
+	m.nextAudit++
+}
+
+func (m *MemoryRepository) create(ctx context.Context, userReq models.UserRequest) uuid.UUID {
+	created := now()
+	stored := &memoryUser{user: models.User{
+		ID:        uuid.New(),
+		Name:      userReq.Name,
+		Age:       userReq.Age,
+		Anonymous: userReq.Anonymous,
+		Version:   1,
+		CreatedAt: created,
+		UpdatedAt: created,
+	}}
+	m.users[stored.user.ID] = stored
+	m.recordAudit(audit.FromContext(ctx), stored.user.ID, auditActionCreate, nil, stored.doc())
+	return stored.user.ID
+}
+
+// get returns a copy of a live user, so callers cannot change the store.
+func (m *MemoryRepository) get(id string) (*models.User, error) {
+	stored, ok := m.live(id)
+	if !ok {
+		return nil, apperr.ErrNotFound
+	}
+	user := stored.user
+	return &user, nil
+}
+
+// lockLive returns a live user whose version is the expected one, a zero
+// version skips the check.
+func (m *MemoryRepository) lockLive(id string, version int64) (*memoryUser, error) {
+	stored, ok := m.live(id)
+	if !ok {
+		return nil, apperr.ErrNotFound
+	}
+	if version != 0 && version != stored.user.Version {
+		return nil, apperr.ErrPreconditionFailed
+	}
+	return stored, nil
+}
+
+func (m *MemoryRepository) GetUser(ctx context.Context, id string) (*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.GetUser")
+	defer span.End()
+
+	defer m.lock(ctx, false)()
+	return m.get(id)
+}
+
+func (m *MemoryRepository) CreateUser(ctx context.Context, userReq models.UserRequest) (uuid.UUID, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.CreateUser")
+	defer span.End()
+
+	defer m.lock(ctx, true)()
+	return m.create(ctx, userReq), nil
+}
+
+func (m *MemoryRepository) UpdateUser(ctx context.Context, id string, userReq models.UserRequest, version int64) (*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.UpdateUser")
+	defer span.End()
+
+	defer m.lock(ctx, true)()
+	stored, err := m.lockLive(id, version)
+	if err != nil {
+		return nil, err
+	}
+	m.write(ctx, stored, auditActionUpdate, func(stored *memoryUser) {
+		stored.user.Name = userReq.Name
+		stored.user.Age = userReq.Age
+		stored.user.Anonymous = userReq.Anonymous
+	})
+	return m.get(id)
+}
+
+func (m *MemoryRepository) PatchUser(ctx context.Context, id string, patch models.UserPatch, version int64) (*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.PatchUser")
+	defer span.End()
+
+	defer m.lock(ctx, true)()
+	stored, err := m.lockLive(id, version)
+	if err != nil {
+		return nil, err
+	}
+	if patch.Empty() {
+		return m.get(id)
+	}
+	m.write(ctx, stored, auditActionUpdate, func(stored *memoryUser) {
+		if patch.Name != nil {
+			stored.user.Name = *patch.Name
+		}
+		if patch.Age != nil {
+			stored.user.Age = *patch.Age
+		}
+		if patch.Anonymous != nil {
+			stored.user.Anonymous = *patch.Anonymous
+		}
+	})
+	return m.get(id)
+}
+
+func (m *MemoryRepository) DeleteUser(ctx context.Context, id string, version int64) error {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.DeleteUser")
+	defer span.End()
+
+	defer m.lock(ctx, true)()
+	stored, err := m.lockLive(id, version)
+	if err != nil {
+		return err
+	}
+	m.write(ctx, stored, auditActionDelete, func(stored *memoryUser) {
+		deletedAt := now()
+		stored.deletedAt = &deletedAt
+	})
+	return nil
+}
+
+func (m *MemoryRepository) RestoreUser(ctx context.Context, id string) (*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.RestoreUser")
+	defer span.End()
+
+	defer m.lock(ctx, true)()
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, apperr.ErrNotFound
+	}
+	stored, ok := m.users[userID]
+	if !ok || stored.deletedAt == nil {
+		return nil, apperr.ErrNotFound
+	}
+	m.write(ctx, stored, auditActionRestore, func(stored *memoryUser) {
+		stored.deletedAt = nil
+	})
+	return m.get(id)
+}
+
+// PurgeDeletedUsers permanently removes users deleted before the given time
+// and returns how many were removed.
+func (m *MemoryRepository) PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.PurgeDeletedUsers")
+	defer span.End()
+
+	defer m.lock(ctx, true)()
+	var purged int64
+	for id, stored := range m.users {
+		if stored.deletedAt != nil && stored.deletedAt.Before(before) {
+			delete(m.users, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *MemoryRepository) ListUsers(ctx context.Context, query models.UserListQuery) (models.UserPage, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.ListUsers")
+	defer span.End()
+
+	userSort, err := parseUserSort(query.Sort)
+	if err != nil {
+		return models.UserPage{}, err
+	}
+	limit := clampListLimit(query.Limit)
+
+	var after func(*models.User) bool
+	if query.Cursor != "" {
+		cursor, err := decodeUserCursor(query.Cursor, userSort)
+		if err != nil {
+			return models.UserPage{}, err
+		}
+		value, err := userSort.parseValue(cursor.Value)
+		if err != nil {
+			return models.UserPage{}, errors.Wrap(apperr.ErrInvalidArgument, "invalid cursor")
+		}
+		after = func(u *models.User) bool {
+			cmp := compareSortValue(userSort, u, value)
+			if cmp == 0 {
+				cmp = strings.Compare(u.ID.String(), cursor.ID.String())
+			}
+			if userSort.desc {
+				return cmp < 0
+			}
+			return cmp > 0
+		}
+	}
+
+	defer m.lock(ctx, false)()
+	users := make([]*models.User, 0, len(m.users))
+	for _, stored := range m.users {
+		if stored.deletedAt != nil || !matchesFilter(&stored.user, query.Filter) {
+			continue
+		}
+		if after != nil && !after(&stored.user) {
+			continue
+		}
+		user := stored.user
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		cmp := compareSortValue(userSort, users[i], userSort.sortValue(users[j]))
+		if cmp == 0 {
+			cmp = strings.Compare(users[i].ID.String(), users[j].ID.String())
+		}
+		if userSort.desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+
+	page := models.UserPage{Users: users}
+	if len(users) > limit {
+		page.Users = users[:limit]
+		page.NextCursor = encodeUserCursor(userSort, page.Users[limit-1])
+	}
+	return page, nil
+}
+
+func matchesFilter(u *models.User, filter models.UserFilter) bool {
+	if filter.Anonymous != nil && u.Anonymous != *filter.Anonymous {
+		return false
+	}
+	if filter.AgeGTE != nil && u.Age < *filter.AgeGTE {
+		return false
+	}
+	if filter.AgeLTE != nil && u.Age > *filter.AgeLTE {
+		return false
+	}
+	return true
+}
+
+// sortValue returns the sort key of u in the form parseValue returns it.
+func (s userSort) sortValue(u *models.User) interface{} {
+	switch s.field {
+	case "name":
+		return u.Name
+	case "age":
+		return u.Age
+	default:
+		return u.CreatedAt
+	}
+}
+
+// compareSortValue compares the sort key of u with value, a sort key of the
+// same field.
+func compareSortValue(s userSort, u *models.User, value interface{}) int {
+	switch s.field {
+	case "name":
+		return strings.Compare(u.Name, value.(string))
+	case "age":
+		return u.Age - value.(int)
+	default:
+		return u.CreatedAt.Compare(value.(time.Time))
+	}
+}
+
+// SearchUsers matches names the way the pg_trgm and full-text searches of
+// UserRepository do, closely enough for local runs: trigram matches are
+// ranked by word similarity, full-text queries match whole words, all of
+// them unless a word is prefixed with "-", which excludes it.
+func (m *MemoryRepository) SearchUsers(ctx context.Context, query models.UserSearchQuery) ([]*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.SearchUsers")
+	defer span.End()
+
+	type match struct {
+		user  *models.User
+		rank  float64
+		score float64
+	}
+	var rankName func(name string) (float64, float64, bool)
+	switch query.Mode {
+	case "", searchModeTrigram:
+		queryTrigrams := trigrams(query.Text)
+		rankName = func(name string) (float64, float64, bool) {
+			wordSimilarity := wordSimilarity(queryTrigrams, name)
+			return wordSimilarity, similarity(queryTrigrams, trigrams(name)), wordSimilarity >= query.MinSimilarity && wordSimilarity > 0
+		}
+	case searchModeFullText:
+		include, exclude := parseWebSearch(query.Text)
+		rankName = func(name string) (float64, float64, bool) {
+			return fullTextRank(include, exclude, name)
+		}
+	default:
+		return nil, errors.Wrapf(apperr.ErrInvalidArgument, "unknown search mode %q", query.Mode)
+	}
+
+	defer m.lock(ctx, false)()
+	var matches []match
+	for _, stored := range m.users {
+		if stored.deletedAt != nil {
+			continue
+		}
+		rank, score, ok := rankName(stored.user.Name)
+		if !ok {
+			continue
+		}
+		user := stored.user
+		matches = append(matches, match{user: &user, rank: rank, score: score})
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].rank != matches[j].rank {
+			return matches[i].rank > matches[j].rank
+		}
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].user.ID.String() < matches[j].user.ID.String()
+	})
+
+	users := make([]*models.User, 0, min(len(matches), max(query.Limit, 0)))
+	for _, match := range matches {
+		if len(users) >= query.Limit {
+			break
+		}
+		users = append(users, match.user)
+	}
+	return users, nil
+}
+
+// words splits text into lower-case words of letters and digits, as
+// pg_trgm and the simple text search configuration do.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// wordTrigrams returns the trigrams of every word in text, in order. Words
+// are padded with two spaces in front and one behind.
+func wordTrigrams(text string) []string {
+	var result []string
+	for _, word := range words(text) {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			result = append(result, string(padded[i:i+3]))
+		}
+	}
+	return result
+}
+
+func trigrams(text string) map[string]struct{} {
+	set := make(map[string]struct{})
+	for _, trigram := range wordTrigrams(text) {
+		set[trigram] = struct{}{}
+	}
+	return set
+}
+
+// similarity is the share of trigrams two strings have in common.
+func similarity(a, b map[string]struct{}) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	shared := 0
+	for trigram := range a {
+		if _, ok := b[trigram]; ok {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// wordSimilarity is the greatest similarity between the trigrams of the
+// query and any continuous extent of the trigrams of name.
+func wordSimilarity(query map[string]struct{}, name string) float64 {
+	nameTrigrams := wordTrigrams(name)
+	best := 0.0
+	for start := range nameTrigrams {
+		extent := make(map[string]struct{})
+		for _, trigram := range nameTrigrams[start:] {
+			extent[trigram] = struct{}{}
+			best = max(best, similarity(query, extent))
+		}
+	}
+	return best
+}
+
+// parseWebSearch splits a full-text query into the words a name must and
+// must not contain.
+func parseWebSearch(text string) (include, exclude []string) {
+	for _, field := range strings.Fields(text) {
+		negated := strings.HasPrefix(field, "-")
+		for _, word := range words(field) {
+			if negated {
+				exclude = append(exclude, word)
+			} else {
+				include = append(include, word)
+			}
+		}
+	}
+	return include, exclude
+}
+
+// fullTextRank reports whether name has every included word and none of the
+// excluded ones, ranked by how often the included words occur.
+func fullTextRank(include, exclude []string, name string) (float64, float64, bool) {
+	if len(include) == 0 {
+		return 0, 0, false
+	}
+	counts := make(map[string]int)
+	nameWords := words(name)
+	for _, word := range nameWords {
+		counts[word]++
+	}
+	for _, word := range exclude {
+		if counts[word] > 0 {
+			return 0, 0, false
+		}
+	}
+	occurrences := 0
+	for _, word := range include {
+		if counts[word] == 0 {
+			return 0, 0, false
+		}
+		occurrences += counts[word]
+	}
+	return float64(occurrences) / float64(len(nameWords)), 0, true
+}
+
+func (m *MemoryRepository) GetUserHistory(ctx context.Context, id string, query models.UserHistoryQuery) (models.UserHistoryPage, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.GetUserHistory")
+	defer span.End()
+
+	limit := clampListLimit(query.Limit)
+	var cursor int64
+	if query.Cursor != "" {
+		var err error
+		cursor, err = strconv.ParseInt(query.Cursor, 10, 64)
+		if err != nil || cursor <= 0 {
+			return models.UserHistoryPage{}, errors.Wrap(apperr.ErrInvalidArgument, "invalid cursor")
+		}
+	}
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return models.UserHistoryPage{}, apperr.ErrNotFound
+	}
+
+	defer m.lock(ctx, false)()
+	entries := make([]models.UserAuditEntry, 0, limit+1)
+	for i := len(m.audit) - 1; i >= 0 && len(entries) <= limit; i-- {
+		entry := m.audit[i]
+		if entry.UserID != userID || (cursor != 0 && entry.ID >= cursor) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 && query.Cursor == "" {
+		return models.UserHistoryPage{}, apperr.ErrNotFound
+	}
+
+	page := models.UserHistoryPage{Entries: entries}
+	if len(entries) > limit {
+		page.Entries = entries[:limit]
+		page.NextCursor = strconv.FormatInt(page.Entries[limit-1].ID, 10)
+	}
+	return page, nil
+}
+
+func (m *MemoryRepository) CreateUsers(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.CreateUsers")
+	defer span.End()
+
+	defer m.lock(ctx, true)()
+	ids := make([]uuid.UUID, len(userReqs))
+	for i, userReq := range userReqs {
+		ids[i] = m.create(ctx, userReq)
+	}
+	return ids, nil
+}
+
+// CreateUsersPartially is CreateUsers, the store has no constraints a single
+// user could fail.
+func (m *MemoryRepository) CreateUsersPartially(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, []error, error) {
+	ids, err := m.CreateUsers(ctx, userReqs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ids, make([]error, len(userReqs)), nil
+}
+
+func (m *MemoryRepository) GetUsers(ctx context.Context, ids []string) ([]*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.GetUsers")
+	defer span.End()
+
+	defer m.lock(ctx, false)()
+	users := make([]*models.User, 0, len(ids))
+	seen := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		user, err := m.get(id)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[user.ID.String()]; ok {
+			continue
+		}
+		seen[user.ID.String()] = struct{}{}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (m *MemoryRepository) DeleteUsers(ctx context.Context, ids []string) ([]string, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "MemoryRepository.DeleteUsers")
+	defer span.End()
+
+	defer m.lock(ctx, true)()
+	var deleted []string
+	for _, id := range ids {
+		stored, ok := m.live(id)
+		if !ok {
+			continue
+		}
+		m.write(ctx, stored, auditActionDelete, func(stored *memoryUser) {
+			deletedAt := now()
+			stored.deletedAt = &deletedAt
+		})
+		deleted = append(deleted, stored.user.ID.String())
+	}
+	return deleted, nil
+}
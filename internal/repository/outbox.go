@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"encoding/json"
+
+	"github.com/dankru/Api_gateway_v2/internal/audit"
+	"github.com/pkg/errors"
+)
+
+const insertOutboxSQL = "INSERT INTO outbox (aggregate_id, event_type, payload) VALUES ($1, $2, $3)"
+
+// eventActionPurge is the retention purge. It is announced but not audited,
+// the audit trail outlives the purged users.
+const eventActionPurge = "purge"
+
+// userEventTypes names the events published for each action.
+var userEventTypes = map[string]string{
+	auditActionCreate:  "user.created",
+	auditActionUpdate:  "user.updated",
+	auditActionDelete:  "user.deleted",
+	auditActionRestore: "user.restored",
+	eventActionPurge:   "user.purged",
+}
+
+// userEventPayload is the body of a user event. User is the row as it was
+// written, deleted users carry their deleted_at and purged users are null.
+type userEventPayload struct {
+	UserID       string          `json:"userId"`
+	ClaimedActor string          `json:"claimedActor"`
+	RequestID    string          `json:"requestId,omitempty"`
+	User         json.RawMessage `json:"user"`
+}
+
+// userEvent returns the type and the payload of the event announcing a
+// change. The payload is passed as text, as nullableJSON does.
+func userEvent(source audit.Source, userID, action string, after []byte) (string, string, error) {
+	payload, err := json.Marshal(userEventPayload{
+		UserID:       userID,
+		ClaimedActor: source.ClaimedActor,
+		RequestID:    source.RequestID,
+		User:         after,
+	})
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to encode %s event of user %s", action, userID)
+	}
+	return userEventTypes[action], string(payload), nil
+}
@@ -0,0 +1,284 @@
+package repository
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultStickyWindow   = 5 * time.Second
+	defaultHealthInterval = 5 * time.Second
+)
+
+// PrimaryPool names the primary in pool selections, replicas are named
+// replica_0, replica_1 and so on, in the order of the configuration.
+const PrimaryPool = "primary"
+
+// Reasons for the pool a query runs on.
+const (
+	SelectWrite     = "write"
+	SelectTx        = "tx"
+	SelectSticky    = "sticky"
+	SelectReplica   = "replica"
+	SelectNoReplica = "no_replica"
+)
+
+// PoolSelection is a pool a query ran on and why it was chosen.
+type PoolSelection struct {
+	Pool   string
+	Reason string
+}
+
+type sessionKey struct{}
+
+// Session is the read-your-writes state of one client. It travels with the
+// client, in a cookie for example, so the gateway keeps nothing per client
+// and a client can only steer its own reads.
+type Session struct {
+	lastWrite atomic.Int64
+}
+
+// WithSession starts the session of a request whose client last wrote at
+// lastWrite, zero if it did not write. Reads within the sticky window after a
+// write go to the primary, so the client reads its own writes while the
+// replicas catch up.
+func WithSession(ctx context.Context, lastWrite time.Time) (context.Context, *Session) {
+	session := &Session{}
+	if !lastWrite.IsZero() {
+		session.lastWrite.Store(lastWrite.UnixNano())
+	}
+	return context.WithValue(ctx, sessionKey{}, session), session
+}
+
+// LastWrite returns when the client last wrote, including the writes of this
+// request once they are committed.
+func (s *Session) LastWrite() time.Time {
+	nanos := s.lastWrite.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+func sessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
+
+type replica struct {
+	name    string
+	pool    *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+// ReplicaRouter spreads reads over the healthy replicas and sends everything
+// else to the primary. Clients whose session wrote recently read from the
+// primary.
+type ReplicaRouter struct {
+	primary        *pgxpool.Pool
+	replicas       []*replica
+	next           atomic.Uint64
+	stickyWindow   time.Duration
+	healthInterval time.Duration
+
+	mu         sync.Mutex
+	selections map[PoolSelection]int
+}
+
+// NewReplicaRouter opens a pool for each replica. The pools connect lazily
+// and replicas take reads only after their first successful health check.
+func NewReplicaRouter(primary *pgxpool.Pool, cfg config.Replicas, connect func(connString string) (*pgxpool.Pool, error)) (*ReplicaRouter, error) {
+	stickyWindow := cfg.StickyWindow
+	if stickyWindow <= 0 {
+		stickyWindow = defaultStickyWindow
+	}
+	healthInterval := cfg.HealthInterval
+	if healthInterval <= 0 {
+		healthInterval = defaultHealthInterval
+	}
+
+	router := &ReplicaRouter{
+		primary:        primary,
+		stickyWindow:   stickyWindow,
+		healthInterval: healthInterval,
+		selections:     make(map[PoolSelection]int),
+	}
+	for i, dsn := range cfg.DSNs {
+		pool, err := connect(dsn)
+		if err != nil {
+			router.Close()
+			return nil, err
+		}
+		router.replicas = append(router.replicas, &replica{name: "replica_" + strconv.Itoa(i), pool: pool})
+	}
+	return router, nil
+}
+
+// Start checks the replicas right away and then every health interval
+// until ctx is done.
+func (r *ReplicaRouter) Start(ctx context.Context) {
+	if len(r.replicas) == 0 {
+		return
+	}
+
+	r.checkHealth(ctx)
+	go func() {
+		ticker := time.NewTicker(r.healthInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.checkHealth(ctx)
+			}
+		}
+	}()
+}
+
+func (r *ReplicaRouter) checkHealth(ctx context.Context) {
+	for _, replica := range r.replicas {
+		pingCtx, cancel := context.WithTimeout(ctx, r.healthInterval)
+		err := replica.pool.Ping(pingCtx)
+		cancel()
+
+		healthy := err == nil
+		if replica.healthy.Swap(healthy) == healthy {
+			continue
+		}
+		if healthy {
+			log.Info().Msgf("%s is healthy, routing reads to it", replica.name)
+		} else {
+			log.Warn().Err(err).Msgf("%s is unhealthy, routing reads away from it", replica.name)
+		}
+	}
+}
+
+// reader returns the pool for a read of the session in ctx.
+func (r *ReplicaRouter) reader(ctx context.Context) querier {
+	if session := sessionFromContext(ctx); session != nil && r.sticky(session.LastWrite(), time.Now()) {
+		r.selected(PrimaryPool, SelectSticky)
+		return r.primary
+	}
+
+	n := len(r.replicas)
+	start := int(r.next.Add(1) % uint64(max(n, 1)))
+	for i := 0; i < n; i++ {
+		replica := r.replicas[(start+i)%n]
+		if replica.healthy.Load() {
+			r.selected(replica.name, SelectReplica)
+			return replica.pool
+		}
+	}
+
+	r.selected(PrimaryPool, SelectNoReplica)
+	return r.primary
+}
+
+// stick records a successful write in the session of ctx once it is
+// committed.
+// Without replicas every read goes to the primary and there is nothing to
+// record.
+func (r *ReplicaRouter) stick(ctx context.Context) {
+	if r == nil || len(r.replicas) == 0 {
+		return
+	}
+	if session := sessionFromContext(ctx); session != nil {
+		AfterCommit(ctx, func() { session.lastWrite.Store(time.Now().UnixNano()) })
+	}
+}
+
+// sticky reports whether a read at now follows a write at lastWrite within
+// the sticky window. Sessions come from clients, so writes from the future
+// do not count.
+func (r *ReplicaRouter) sticky(lastWrite, now time.Time) bool {
+	if lastWrite.IsZero() || lastWrite.After(now) {
+		return false
+	}
+	return now.Sub(lastWrite) < r.stickyWindow
+}
+
+func (r *ReplicaRouter) selected(pool, reason string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.selections[PoolSelection{Pool: pool, Reason: reason}]++
+}
+
+// Selections returns how many queries ran on each pool for each reason
+// since start.
+func (r *ReplicaRouter) Selections() map[PoolSelection]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	selections := make(map[PoolSelection]int, len(r.selections))
+	for selection, count := range r.selections {
+		selections[selection] = count
+	}
+	return selections
+}
+
+// HealthyReplicas returns the number of replicas taking reads.
+func (r *ReplicaRouter) HealthyReplicas() int {
+	healthy := 0
+	for _, replica := range r.replicas {
+		if replica.healthy.Load() {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+// Close closes the replica pools, the primary is owned by the caller.
+func (r *ReplicaRouter) Close() {
+	for _, replica := range r.replicas {
+		replica.pool.Close()
+	}
+}
+
+// db returns the connection for a write: the transaction carried by ctx, or
+// the primary outside of one.
+func (u *UserRepository) db(ctx context.Context) querier {
+	if state, ok := txFromContext(ctx); ok {
+		u.replicas.selected(PrimaryPool, SelectTx)
+		return state.tx
+	}
+	u.replicas.selected(PrimaryPool, SelectWrite)
+	return u.conn
+}
+
+// write runs fn in a transaction on the primary, or in a savepoint of the
+// transaction carried by ctx. Only a write that succeeded makes the session
+// of ctx sticky, failed writes leave the client reading from the replicas.
+func (u *UserRepository) write(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	if err := u.db(ctx).BeginFunc(ctx, fn); err != nil {
+		return err
+	}
+	u.replicas.stick(ctx)
+	return nil
+}
+
+// readDB returns the connection for a read. Reads within a transaction use
+// it, so they see its writes.
+func (u *UserRepository) readDB(ctx context.Context) querier {
+	if state, ok := txFromContext(ctx); ok {
+		u.replicas.selected(PrimaryPool, SelectTx)
+		return state.tx
+	}
+	if u.replicas == nil {
+		return u.conn
+	}
+	return u.replicas.reader(ctx)
+}
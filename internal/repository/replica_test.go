@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplicaRouter_Sticky(t *testing.T) {
+	router, err := NewReplicaRouter(nil, config.Replicas{StickyWindow: time.Second}, nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	testCases := []struct {
+		name      string
+		lastWrite time.Time
+		want      bool
+	}{
+		{name: "клиент только что писал", lastWrite: now.Add(-500 * time.Millisecond), want: true},
+		{name: "окно закончилось", lastWrite: now.Add(-time.Second), want: false},
+		{name: "клиент не писал", want: false},
+		{name: "запись из будущего", lastWrite: now.Add(time.Hour), want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, router.sticky(tc.lastWrite, now))
+		})
+	}
+}
+
+func TestReplicaRouter_Reader(t *testing.T) {
+	primary, replicaPool := &pgxpool.Pool{}, &pgxpool.Pool{}
+	router, err := NewReplicaRouter(primary, config.Replicas{DSNs: []string{"replica"}, StickyWindow: time.Minute},
+		func(string) (*pgxpool.Pool, error) { return replicaPool, nil })
+	require.NoError(t, err)
+
+	recent, _ := WithSession(context.Background(), time.Now())
+	expired, _ := WithSession(context.Background(), time.Now().Add(-time.Hour))
+
+	testCases := []struct {
+		name      string
+		ctx       context.Context
+		healthy   bool
+		want      *pgxpool.Pool
+		selection PoolSelection
+	}{
+		{
+			name:      "без здоровых реплик чтение идёт в primary",
+			ctx:       context.Background(),
+			want:      primary,
+			selection: PoolSelection{Pool: PrimaryPool, Reason: SelectNoReplica},
+		},
+		{
+			name:      "чтение идёт в здоровую реплику",
+			ctx:       context.Background(),
+			healthy:   true,
+			want:      replicaPool,
+			selection: PoolSelection{Pool: "replica_0", Reason: SelectReplica},
+		},
+		{
+			name:      "клиент, который писал, читает из primary",
+			ctx:       recent,
+			healthy:   true,
+			want:      primary,
+			selection: PoolSelection{Pool: PrimaryPool, Reason: SelectSticky},
+		},
+		{
+			name:      "после окна клиент читает из реплики",
+			ctx:       expired,
+			healthy:   true,
+			want:      replicaPool,
+			selection: PoolSelection{Pool: "replica_0", Reason: SelectReplica},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			router.replicas[0].healthy.Store(tc.healthy)
+			before := router.Selections()[tc.selection]
+
+			require.Same(t, tc.want, router.reader(tc.ctx))
+			require.Equal(t, before+1, router.Selections()[tc.selection])
+		})
+	}
+}
+
+func TestReplicaRouter_Stick(t *testing.T) {
+	ctx, session := WithSession(context.Background(), time.Time{})
+
+	t.Log("Без реплик запись не делает сессию липкой\n")
+	withoutReplicas, err := NewReplicaRouter(nil, config.Replicas{}, nil)
+	require.NoError(t, err)
+	withoutReplicas.stick(ctx)
+	require.True(t, session.LastWrite().IsZero())
+
+	router, err := NewReplicaRouter(nil, config.Replicas{DSNs: []string{"replica"}},
+		func(string) (*pgxpool.Pool, error) { return &pgxpool.Pool{}, nil })
+	require.NoError(t, err)
+
+	t.Log("Запись в транзакции попадает в сессию только после коммита\n")
+	state := &txState{}
+	router.stick(context.WithValue(ctx, txKey{}, state))
+	require.True(t, session.LastWrite().IsZero())
+	for _, hook := range state.afterCommit {
+		hook()
+	}
+	require.WithinDuration(t, time.Now(), session.LastWrite(), time.Second)
+}
+
+func TestUserRepository_ReadDB(t *testing.T) {
+	primary, replicaPool := &pgxpool.Pool{}, &pgxpool.Pool{}
+	router, err := NewReplicaRouter(primary, config.Replicas{DSNs: []string{"replica"}, StickyWindow: time.Minute},
+		func(string) (*pgxpool.Pool, error) { return replicaPool, nil })
+	require.NoError(t, err)
+	router.replicas[0].healthy.Store(true)
+	repo := NewUserRepository(primary, router)
+
+	t.Log("Чтения, которые наполняют кэш, идут в здоровую реплику\n")
+	require.Same(t, replicaPool, repo.readDB(context.Background()))
+
+	t.Log("Клиент, который только что писал, читает из primary\n")
+	sticky, _ := WithSession(context.Background(), time.Now())
+	require.Same(t, primary, repo.readDB(sticky))
+}
+
+// fakeTx is a transaction whose savepoints run fn without a database.
+type fakeTx struct {
+	pgx.Tx
+}
+
+func (fakeTx) BeginFunc(_ context.Context, fn func(pgx.Tx) error) error {
+	return fn(fakeTx{})
+}
+
+func TestUserRepository_Write(t *testing.T) {
+	router, err := NewReplicaRouter(nil, config.Replicas{DSNs: []string{"replica"}},
+		func(string) (*pgxpool.Pool, error) { return &pgxpool.Pool{}, nil })
+	require.NoError(t, err)
+	repo := NewUserRepository(nil, router)
+
+	testCases := []struct {
+		name       string
+		err        error
+		wantSticky bool
+	}{
+		{name: "успешная запись делает сессию липкой", wantSticky: true},
+		{name: "неудачная запись не делает сессию липкой", err: apperr.ErrNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, session := WithSession(context.Background(), time.Time{})
+			state := &txState{tx: fakeTx{}}
+			ctx = context.WithValue(ctx, txKey{}, state)
+
+			err := repo.write(ctx, func(pgx.Tx) error { return tc.err })
+			require.ErrorIs(t, err, tc.err)
+			for _, hook := range state.afterCommit {
+				hook()
+			}
+			require.Equal(t, tc.wantSticky, !session.LastWrite().IsZero())
+		})
+	}
+}
@@ -2,10 +2,14 @@ package repository
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dankru/Api_gateway_v2/config"
 	"github.com/dankru/Api_gateway_v2/internal/apperr"
+	"github.com/dankru/Api_gateway_v2/internal/audit"
 	"github.com/dankru/Api_gateway_v2/internal/models"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4"
@@ -16,12 +20,15 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 )
 
+// UserRepository stores users in Postgres. Writes and the reads that fill the
+// cache go to conn, other reads go to the replicas when there are any.
 type UserRepository struct {
-	conn *pgxpool.Pool
+	conn     *pgxpool.Pool
+	replicas *ReplicaRouter
 }
 
-func NewUserRepository(conn *pgxpool.Pool) *UserRepository {
-	return &UserRepository{conn: conn}
+func NewUserRepository(conn *pgxpool.Pool, replicas *ReplicaRouter) *UserRepository {
+	return &UserRepository{conn: conn, replicas: replicas}
 }
 
 func (u *UserRepository) GetUser(ctx context.Context, id string) (*models.User, error) {
@@ -30,7 +37,7 @@ func (u *UserRepository) GetUser(ctx context.Context, id string) (*models.User,
 	defer span.End()
 
 	span.SetAttributes(
-		attribute.String("db.query", "SELECT id, name, age, anonymous FROM users WHERE id = $1"),
+		attribute.String("db.query", "SELECT id, name, age, anonymous, version, created_at, updated_at FROM users WHERE id = $1 AND deleted_at IS NULL"),
 		attribute.String("db.params.id", id),
 		attribute.String("db.system", "postgres"),
 	)
@@ -38,13 +45,16 @@ func (u *UserRepository) GetUser(ctx context.Context, id string) (*models.User,
 	userData := &models.User{}
 
 	start := time.Now()
-	err := u.conn.QueryRow(
+	err := u.readDB(ctx).QueryRow(
 		ctx,
-		"SELECT id, name, age, anonymous FROM users WHERE id = $1", id).
-		Scan(userData.ID,
-			userData.Name,
-			userData.Age,
-			userData.Anonymous)
+		"SELECT id, name, age, anonymous, version, created_at, updated_at FROM users WHERE id = $1 AND deleted_at IS NULL", id).
+		Scan(&userData.ID,
+			&userData.Name,
+			&userData.Age,
+			&userData.Anonymous,
+			&userData.Version,
+			&userData.CreatedAt,
+			&userData.UpdatedAt)
 
 	duration := time.Since(start)
 
@@ -57,16 +67,18 @@ func (u *UserRepository) GetUser(ctx context.Context, id string) (*models.User,
 		return nil, apperr.ErrNotFound
 	}
 
-	return userData, err
+	return userData, classifyError(err)
 }
 
+// CreateUser inserts the user and records it in the audit trail, in one
+// transaction.
 func (u *UserRepository) CreateUser(ctx context.Context, userReq models.UserRequest) (uuid.UUID, error) {
 	tracer := otel.Tracer(config.AppName)
 	_, span := tracer.Start(ctx, "UserRepository.CreateUser")
 	defer span.End()
 
 	span.SetAttributes(
-		attribute.String("db.query", "INSERT INTO users (name, age, anonymous) VALUES ($1, $2, $3) RETURNING id"),
+		attribute.String("db.query", "INSERT INTO users (name, age, anonymous) VALUES ($1, $2, $3) RETURNING id, to_jsonb(users)"),
 		attribute.String("db.params.name", userReq.Name),
 		attribute.Int("db.params.age", userReq.Age),
 		attribute.Bool("db.params.anonymous", userReq.Anonymous),
@@ -76,13 +88,19 @@ func (u *UserRepository) CreateUser(ctx context.Context, userReq models.UserRequ
 	var userId uuid.UUID
 
 	start := time.Now()
-	err := u.conn.QueryRow(
-		ctx,
-		"INSERT INTO users (name, age, anonymous) VALUES ($1, $2, $3) RETURNING id",
-		userReq.Name,
-		userReq.Age,
-		userReq.Anonymous,
-	).Scan(&userId)
+	err := u.write(ctx, func(tx pgx.Tx) error {
+		var after []byte
+		if err := tx.QueryRow(
+			ctx,
+			"INSERT INTO users (name, age, anonymous) VALUES ($1, $2, $3) RETURNING id, to_jsonb(users)",
+			userReq.Name,
+			userReq.Age,
+			userReq.Anonymous,
+		).Scan(&userId, &after); err != nil {
+			return err
+		}
+		return recordChange(ctx, tx, userId.String(), auditActionCreate, nil, after)
+	})
 
 	duration := time.Since(start)
 
@@ -91,33 +109,45 @@ func (u *UserRepository) CreateUser(ctx context.Context, userReq models.UserRequ
 		attribute.Bool("db.success", err == nil),
 	)
 
-	return userId, err
+	return userId, classifyError(err)
 }
 
-func (u *UserRepository) UpdateUser(ctx context.Context, id string, userReq models.UserRequest) (*models.User, error) {
+func (u *UserRepository) UpdateUser(ctx context.Context, id string, userReq models.UserRequest, version int64) (*models.User, error) {
 	tracer := otel.Tracer(config.AppName)
 	_, span := tracer.Start(ctx, "UserRepository.UpdateUser")
 	defer span.End()
 
 	span.SetAttributes(
-		attribute.String("db.query", "UPDATE users SET name = $1, age = $2, anonymous = $3 WHERE id = $4 RETURNING id, name, age, anonymous"),
+		attribute.String("db.query", "UPDATE users SET name = $1, age = $2, anonymous = $3 WHERE id = $4 RETURNING id, name, age, anonymous, version, created_at, updated_at, to_jsonb(users)"),
 		attribute.String("db.params.name", userReq.Name),
 		attribute.Int("db.params.age", userReq.Age),
 		attribute.Bool("db.params.anonymous", userReq.Anonymous),
+		attribute.Int64("db.params.version", version),
 		attribute.String("db.system", "postgres"),
 	)
 
 	userData := &models.User{}
 
 	start := time.Now()
-	err := u.conn.QueryRow(
-		ctx,
-		"UPDATE users SET name = $1, age = $2, anonymous = $3 WHERE id = $4 RETURNING id, name, age, anonymous",
-		userReq.Name,
-		userReq.Age,
-		userReq.Anonymous,
-		id).
-		Scan(userData.ID, userData.Name, userData.Age, userData.Anonymous)
+	err := u.write(ctx, func(tx pgx.Tx) error {
+		before, err := lockUser(ctx, tx, id, version)
+		if err != nil {
+			return err
+		}
+
+		var after []byte
+		if err := tx.QueryRow(
+			ctx,
+			"UPDATE users SET name = $1, age = $2, anonymous = $3 WHERE id = $4 RETURNING id, name, age, anonymous, version, created_at, updated_at, to_jsonb(users)",
+			userReq.Name,
+			userReq.Age,
+			userReq.Anonymous,
+			id).
+			Scan(&userData.ID, &userData.Name, &userData.Age, &userData.Anonymous, &userData.Version, &userData.CreatedAt, &userData.UpdatedAt, &after); err != nil {
+			return err
+		}
+		return recordChange(ctx, tx, id, auditActionUpdate, before, after)
+	})
 
 	duration := time.Since(start)
 
@@ -126,30 +156,484 @@ func (u *UserRepository) UpdateUser(ctx context.Context, id string, userReq mode
 		attribute.Bool("db.success", err == nil),
 	)
 
-	if errors.Is(err, pgx.ErrNoRows) {
-		return nil, apperr.ErrNotFound
+	if err != nil {
+		return nil, classifyError(err)
 	}
 
-	return userData, err
+	return userData, nil
 }
 
-func (u *UserRepository) DeleteUser(ctx context.Context, id string) error {
+// PatchUser updates only the columns set in patch. An empty patch leaves the
+// row and its version untouched and returns the current user.
+func (u *UserRepository) PatchUser(ctx context.Context, id string, patch models.UserPatch, version int64) (*models.User, error) {
+	if patch.Empty() {
+		user, err := u.GetUser(ctx, id)
+		if err == nil && version != 0 && user.Version != version {
+			return nil, apperr.ErrPreconditionFailed
+		}
+		return user, err
+	}
+
 	tracer := otel.Tracer(config.AppName)
-	_, span := tracer.Start(ctx, "UserRepository.DeleteUser")
+	_, span := tracer.Start(ctx, "UserRepository.PatchUser")
 	defer span.End()
+
+	var set []string
+	var args []interface{}
+	addSet := func(column string, arg interface{}) {
+		args = append(args, arg)
+		set = append(set, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	if patch.Name != nil {
+		addSet("name", *patch.Name)
+	}
+	if patch.Age != nil {
+		addSet("age", *patch.Age)
+	}
+	if patch.Anonymous != nil {
+		addSet("anonymous", *patch.Anonymous)
+	}
+	args = append(args, id)
+	sql := fmt.Sprintf("UPDATE users SET %s WHERE id = $%d RETURNING id, name, age, anonymous, version, created_at, updated_at, to_jsonb(users)",
+		strings.Join(set, ", "), len(args))
+
 	span.SetAttributes(
-		attribute.String("db.query", "DELETE FROM users WHERE id = $1"),
+		attribute.String("db.query", sql),
 		attribute.String("db.params.id", id),
+		attribute.Int64("db.params.version", version),
 		attribute.String("db.system", "postgres"),
 	)
 
+	userData := &models.User{}
+
 	start := time.Now()
-	result, err := u.conn.Exec(ctx, "DELETE FROM users WHERE id = $1", id)
+	err := u.write(ctx, func(tx pgx.Tx) error {
+		before, err := lockUser(ctx, tx, id, version)
+		if err != nil {
+			return err
+		}
+
+		var after []byte
+		if err := tx.QueryRow(ctx, sql, args...).
+			Scan(&userData.ID, &userData.Name, &userData.Age, &userData.Anonymous, &userData.Version, &userData.CreatedAt, &userData.UpdatedAt, &after); err != nil {
+			return err
+		}
+		return recordChange(ctx, tx, id, auditActionUpdate, before, after)
+	})
+
+	duration := time.Since(start)
+
+	span.SetAttributes(
+		attribute.Int64("db.duration_ms", duration.Milliseconds()),
+		attribute.Bool("db.success", err == nil),
+	)
+
 	if err != nil {
+		return nil, classifyError(err)
+	}
+
+	return userData, nil
+}
+
+// DeleteUser marks the user as deleted. The row is kept, so the user can be
+// restored until PurgeDeletedUsers removes it.
+func (u *UserRepository) DeleteUser(ctx context.Context, id string, version int64) error {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "UserRepository.DeleteUser")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("db.query", "UPDATE users SET deleted_at = now() WHERE id = $1 RETURNING to_jsonb(users)"),
+		attribute.String("db.params.id", id),
+		attribute.Int64("db.params.version", version),
+		attribute.String("db.system", "postgres"),
+	)
+
+	start := time.Now()
+	err := u.write(ctx, func(tx pgx.Tx) error {
+		before, err := lockUser(ctx, tx, id, version)
+		if err != nil {
+			return err
+		}
+
+		var after []byte
+		if err := tx.QueryRow(ctx, "UPDATE users SET deleted_at = now() WHERE id = $1 RETURNING to_jsonb(users)", id).Scan(&after); err != nil {
+			return err
+		}
+		return recordChange(ctx, tx, id, auditActionDelete, before, after)
+	})
+
+	duration := time.Since(start)
+
+	span.SetAttributes(
+		attribute.Int64("db.duration_ms", duration.Milliseconds()),
+		attribute.Bool("db.success", err == nil),
+	)
+
+	if err != nil && !errors.Is(err, apperr.ErrNotFound) && !errors.Is(err, apperr.ErrPreconditionFailed) {
 		log.Err(err).Msg("failed to delete user")
-		return errors.Wrap(err, "failed to delete user")
+		return classifyError(errors.Wrap(err, "failed to delete user"))
+	}
+
+	return err
+}
+
+// RestoreUser clears the deletion mark of a soft-deleted user. Users that
+// are not deleted are reported as not found.
+func (u *UserRepository) RestoreUser(ctx context.Context, id string) (*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "UserRepository.RestoreUser")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.query", "UPDATE users SET deleted_at = NULL WHERE id = $1 RETURNING id, name, age, anonymous, version, created_at, updated_at, to_jsonb(users)"),
+		attribute.String("db.params.id", id),
+		attribute.String("db.system", "postgres"),
+	)
+
+	userData := &models.User{}
+
+	start := time.Now()
+	err := u.write(ctx, func(tx pgx.Tx) error {
+		var before []byte
+		err := tx.QueryRow(ctx, "SELECT to_jsonb(users) FROM users WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE", id).
+			Scan(&before)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return apperr.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var after []byte
+		if err := tx.QueryRow(
+			ctx,
+			"UPDATE users SET deleted_at = NULL WHERE id = $1 RETURNING id, name, age, anonymous, version, created_at, updated_at, to_jsonb(users)",
+			id).
+			Scan(&userData.ID, &userData.Name, &userData.Age, &userData.Anonymous, &userData.Version, &userData.CreatedAt, &userData.UpdatedAt, &after); err != nil {
+			return err
+		}
+		return recordChange(ctx, tx, id, auditActionRestore, before, after)
+	})
+
+	duration := time.Since(start)
+
+	span.SetAttributes(
+		attribute.Int64("db.duration_ms", duration.Milliseconds()),
+		attribute.Bool("db.success", err == nil),
+	)
+
+	if err != nil {
+		return nil, classifyError(err)
+	}
+
+	return userData, nil
+}
+
+// PurgeDeletedUsers permanently removes users deleted before the given time
+// and returns how many rows were removed. Each purge is announced in the
+// outbox, in the transaction of the delete.
+func (u *UserRepository) PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "UserRepository.PurgeDeletedUsers")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("db.query", "DELETE FROM users WHERE deleted_at < $1 RETURNING id"),
+		attribute.String("db.params.before", before.Format(time.RFC3339)),
+		attribute.String("db.system", "postgres"),
+	)
+
+	var purged int64
+	start := time.Now()
+	err := u.write(ctx, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, "DELETE FROM users WHERE deleted_at < $1 RETURNING id", before)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for rows.Next() {
+			var id uuid.UUID
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return errors.Wrap(err, "failed to scan purged user")
+			}
+			ids = append(ids, id.String())
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		purged = int64(len(ids))
+
+		source := audit.FromContext(ctx)
+		events := &pgx.Batch{}
+		for _, id := range ids {
+			eventType, payload, err := userEvent(source, id, eventActionPurge, nil)
+			if err != nil {
+				return err
+			}
+			events.Queue(insertOutboxSQL, id, eventType, payload)
+		}
+		if events.Len() == 0 {
+			return nil
+		}
+		if err := tx.SendBatch(ctx, events).Close(); err != nil {
+			return errors.Wrap(err, "failed to write outbox events")
+		}
+		return nil
+	})
+
+	duration := time.Since(start)
+
+	span.SetAttributes(
+		attribute.Int64("db.duration_ms", duration.Milliseconds()),
+		attribute.Bool("db.success", err == nil),
+	)
+
+	if err != nil {
+		return 0, classifyError(errors.Wrap(err, "failed to purge deleted users"))
+	}
+	return purged, nil
+}
+
+// CreateUsers inserts all users in one transaction, sending the inserts and
+// their audit entries as batches. Either every user is created or none is,
+// ids are returned in the order of userReqs.
+func (u *UserRepository) CreateUsers(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "UserRepository.CreateUsers")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.query", "INSERT INTO users (name, age, anonymous) VALUES ($1, $2, $3) RETURNING id, to_jsonb(users)"),
+		attribute.Int("db.batch.size", len(userReqs)),
+		attribute.String("db.system", "postgres"),
+	)
+
+	var ids []uuid.UUID
+
+	start := time.Now()
+	err := u.write(ctx, func(tx pgx.Tx) error {
+		var err error
+		ids, err = insertUsers(ctx, tx, userReqs)
+		return err
+	})
+
+	duration := time.Since(start)
+
+	span.SetAttributes(
+		attribute.Int64("db.duration_ms", duration.Milliseconds()),
+		attribute.Bool("db.success", err == nil),
+	)
+
+	if err != nil {
+		return nil, classifyError(errors.Wrap(err, "failed to create users"))
+	}
+	return ids, nil
+}
+
+// CreateUsersPartially inserts users in one transaction like CreateUsers,
+// but a user the database rejects fails only its own item: the batch is
+// rolled back to a savepoint and sent again without it. errs holds the
+// failure of each item and ids the id of each created user, in the order of
+// userReqs.
+func (u *UserRepository) CreateUsersPartially(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, []error, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "UserRepository.CreateUsersPartially")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.query", "INSERT INTO users (name, age, anonymous) VALUES ($1, $2, $3) RETURNING id, to_jsonb(users)"),
+		attribute.Int("db.batch.size", len(userReqs)),
+		attribute.String("db.system", "postgres"),
+	)
+
+	ids := make([]uuid.UUID, len(userReqs))
+	errs := make([]error, len(userReqs))
+
+	start := time.Now()
+	attempts := 0
+	err := u.write(ctx, func(tx pgx.Tx) error {
+		pending := make([]int, len(userReqs))
+		for i := range pending {
+			pending[i] = i
+			ids[i], errs[i] = uuid.Nil, nil
+		}
+
+		for len(pending) > 0 {
+			reqs := make([]models.UserRequest, len(pending))
+			for j, i := range pending {
+				reqs[j] = userReqs[i]
+			}
+
+			attempts++
+			var created []uuid.UUID
+			err := tx.BeginFunc(ctx, func(tx pgx.Tx) error {
+				var err error
+				created, err = insertUsers(ctx, tx, reqs)
+				return err
+			})
+			var itemErr *apperr.BatchItemError
+			if err == nil {
+				for j, i := range pending {
+					ids[i] = created[j]
+				}
+				return nil
+			}
+			if !errors.As(err, &itemErr) || !apperr.Rejected(itemErr) {
+				return err
+			}
+			errs[pending[itemErr.Index]] = itemErr.Err
+			pending = append(pending[:itemErr.Index], pending[itemErr.Index+1:]...)
+		}
+		return nil
+	})
+
+	duration := time.Since(start)
+
+	span.SetAttributes(
+		attribute.Int64("db.duration_ms", duration.Milliseconds()),
+		attribute.Int("db.batch.attempts", attempts),
+		attribute.Bool("db.success", err == nil),
+	)
+
+	if err != nil {
+		return nil, nil, classifyError(errors.Wrap(err, "failed to create users"))
+	}
+	return ids, errs, nil
+}
+
+// insertUsers inserts users and records their creation, sending the inserts
+// and the audit entries as one batch each. The failed insert is returned as
+// an apperr.BatchItemError.
+func insertUsers(ctx context.Context, tx pgx.Tx, userReqs []models.UserRequest) ([]uuid.UUID, error) {
+	batch := &pgx.Batch{}
+	for _, userReq := range userReqs {
+		batch.Queue("INSERT INTO users (name, age, anonymous) VALUES ($1, $2, $3) RETURNING id, to_jsonb(users)",
+			userReq.Name, userReq.Age, userReq.Anonymous)
 	}
 
+	ids := make([]uuid.UUID, len(userReqs))
+	afters := make([][]byte, len(userReqs))
+	results := tx.SendBatch(ctx, batch)
+	for i := range userReqs {
+		if err := results.QueryRow().Scan(&ids[i], &afters[i]); err != nil {
+			_ = results.Close()
+			return nil, &apperr.BatchItemError{Index: i, Err: classifyError(errors.Wrap(err, "failed to insert user"))}
+		}
+	}
+	if err := results.Close(); err != nil {
+		return nil, err
+	}
+
+	source := audit.FromContext(ctx)
+	audits := &pgx.Batch{}
+	for i, id := range ids {
+		if err := queueChange(audits, source, id.String(), auditActionCreate, nil, afters[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.SendBatch(ctx, audits).Close(); err != nil {
+		return nil, errors.Wrap(err, "failed to record changes")
+	}
+	return ids, nil
+}
+
+// GetUsers returns the users with the given ids in no particular order, ids
+// that do not exist or are deleted are left out.
+func (u *UserRepository) GetUsers(ctx context.Context, ids []string) ([]*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "UserRepository.GetUsers")
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.query", "SELECT id, name, age, anonymous, version, created_at, updated_at FROM users WHERE id = ANY($1) AND deleted_at IS NULL"),
+		attribute.Int("db.batch.size", len(ids)),
+		attribute.String("db.system", "postgres"),
+	)
+
+	start := time.Now()
+	rows, err := u.readDB(ctx).Query(ctx,
+		"SELECT id, name, age, anonymous, version, created_at, updated_at FROM users WHERE id = ANY($1) AND deleted_at IS NULL", ids)
+	if err != nil {
+		return nil, classifyError(errors.Wrap(err, "failed to get users"))
+	}
+	defer rows.Close()
+
+	users := make([]*models.User, 0, len(ids))
+	for rows.Next() {
+		userData := &models.User{}
+		if err := rows.Scan(&userData.ID, &userData.Name, &userData.Age, &userData.Anonymous,
+			&userData.Version, &userData.CreatedAt, &userData.UpdatedAt); err != nil {
+			return nil, errors.Wrap(err, "failed to scan user")
+		}
+		users = append(users, userData)
+	}
+	err = rows.Err()
+
+	duration := time.Since(start)
+
+	span.SetAttributes(
+		attribute.Int64("db.duration_ms", duration.Milliseconds()),
+		attribute.Bool("db.success", err == nil),
+	)
+
+	if err != nil {
+		return nil, classifyError(errors.Wrap(err, "failed to get users"))
+	}
+	return users, nil
+}
+
+// DeleteUsers soft-deletes the users with the given ids in one transaction
+// and returns the ids that were deleted. Ids that do not exist or are
+// already deleted are left out.
+func (u *UserRepository) DeleteUsers(ctx context.Context, ids []string) ([]string, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "UserRepository.DeleteUsers")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("db.query", "UPDATE users SET deleted_at = now() WHERE id = ANY($1) RETURNING id, to_jsonb(users)"),
+		attribute.Int("db.batch.size", len(ids)),
+		attribute.String("db.system", "postgres"),
+	)
+
+	var deleted []string
+
+	start := time.Now()
+	err := u.write(ctx, func(tx pgx.Tx) error {
+		befores, err := collectUserDocs(tx.Query(ctx,
+			"SELECT id, to_jsonb(users) FROM users WHERE id = ANY($1) AND deleted_at IS NULL FOR UPDATE", ids))
+		if err != nil {
+			return err
+		}
+		locked := make([]string, 0, len(befores))
+		for id := range befores {
+			locked = append(locked, id)
+		}
+
+		afters, err := collectUserDocs(tx.Query(ctx,
+			"UPDATE users SET deleted_at = now() WHERE id = ANY($1) RETURNING id, to_jsonb(users)", locked))
+		if err != nil {
+			return err
+		}
+
+		source := audit.FromContext(ctx)
+		audits := &pgx.Batch{}
+		for id, after := range afters {
+			deleted = append(deleted, id)
+			if err := queueChange(audits, source, id, auditActionDelete, befores[id], after); err != nil {
+				return err
+			}
+		}
+		if audits.Len() == 0 {
+			return nil
+		}
+		if err := tx.SendBatch(ctx, audits).Close(); err != nil {
+			return errors.Wrap(err, "failed to record changes")
+		}
+		return nil
+	})
+
 	duration := time.Since(start)
 
 	span.SetAttributes(
@@ -157,9 +641,203 @@ func (u *UserRepository) DeleteUser(ctx context.Context, id string) error {
 		attribute.Bool("db.success", err == nil),
 	)
 
-	if result.RowsAffected() == 0 {
-		return apperr.ErrNotFound
+	if err != nil {
+		return nil, classifyError(errors.Wrap(err, "failed to delete users"))
 	}
+	return deleted, nil
+}
 
-	return nil
+// collectUserDocs reads rows of user ids and their JSON documents.
+func collectUserDocs(rows pgx.Rows, err error) (map[string][]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := make(map[string][]byte)
+	for rows.Next() {
+		var id uuid.UUID
+		var doc []byte
+		if err := rows.Scan(&id, &doc); err != nil {
+			return nil, errors.Wrap(err, "failed to scan user")
+		}
+		docs[id.String()] = doc
+	}
+	return docs, rows.Err()
+}
+
+const (
+	searchModeTrigram  = "trigram"
+	searchModeFullText = "fulltext"
+)
+
+// SearchUsers finds users by name, best matches first. The trigram mode
+// compares the query with the words of each name, so partial and misspelled
+// names match; the full-text mode matches whole words only. Both are served
+// by GIN indexes.
+func (u *UserRepository) SearchUsers(ctx context.Context, query models.UserSearchQuery) ([]*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "UserRepository.SearchUsers")
+	defer span.End()
+
+	var sql string
+	switch query.Mode {
+	case "", searchModeTrigram:
+		query.Mode = searchModeTrigram
+		sql = "SELECT id, name, age, anonymous, version, created_at, updated_at FROM users " +
+			"WHERE $1 <% name AND deleted_at IS NULL " +
+			"ORDER BY word_similarity($1, name) DESC, similarity($1, name) DESC, id LIMIT $2"
+	case searchModeFullText:
+		sql = "SELECT id, name, age, anonymous, version, created_at, updated_at FROM users " +
+			"WHERE to_tsvector('simple', coalesce(name, '')) @@ websearch_to_tsquery('simple', $1) AND deleted_at IS NULL " +
+			"ORDER BY ts_rank(to_tsvector('simple', coalesce(name, '')), websearch_to_tsquery('simple', $1)) DESC, id LIMIT $2"
+	default:
+		return nil, errors.Wrapf(apperr.ErrInvalidArgument, "unknown search mode %q", query.Mode)
+	}
+
+	span.SetAttributes(
+		attribute.String("db.query", sql),
+		attribute.String("db.params.q", query.Text),
+		attribute.String("db.params.mode", query.Mode),
+		attribute.Int("db.params.limit", query.Limit),
+		attribute.Float64("db.params.min_similarity", query.MinSimilarity),
+		attribute.String("db.system", "postgres"),
+	)
+
+	var users []*models.User
+
+	start := time.Now()
+	// The <% operator compares against a session setting, it is set for this
+	// transaction only, so pooled connections keep their defaults.
+	err := u.readDB(ctx).BeginFunc(ctx, func(tx pgx.Tx) error {
+		if query.Mode == searchModeTrigram {
+			threshold := strconv.FormatFloat(query.MinSimilarity, 'f', -1, 64)
+			if _, err := tx.Exec(ctx, "SELECT set_config('pg_trgm.word_similarity_threshold', $1, true)", threshold); err != nil {
+				return errors.Wrap(err, "failed to set similarity threshold")
+			}
+		}
+
+		rows, err := tx.Query(ctx, sql, query.Text, query.Limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			userData := &models.User{}
+			if err := rows.Scan(&userData.ID, &userData.Name, &userData.Age, &userData.Anonymous,
+				&userData.Version, &userData.CreatedAt, &userData.UpdatedAt); err != nil {
+				return errors.Wrap(err, "failed to scan user")
+			}
+			users = append(users, userData)
+		}
+		return rows.Err()
+	})
+
+	duration := time.Since(start)
+
+	span.SetAttributes(
+		attribute.Int64("db.duration_ms", duration.Milliseconds()),
+		attribute.Bool("db.success", err == nil),
+	)
+
+	if err != nil {
+		return nil, classifyError(errors.Wrap(err, "failed to search users"))
+	}
+	return users, nil
+}
+
+// ListUsers returns a page of users using keyset pagination on the sort
+// column and id, so pages stay stable while users are inserted.
+func (u *UserRepository) ListUsers(ctx context.Context, query models.UserListQuery) (models.UserPage, error) {
+	tracer := otel.Tracer(config.AppName)
+	_, span := tracer.Start(ctx, "UserRepository.ListUsers")
+	defer span.End()
+
+	sort, err := parseUserSort(query.Sort)
+	if err != nil {
+		return models.UserPage{}, err
+	}
+	limit := clampListLimit(query.Limit)
+
+	where := []string{"deleted_at IS NULL"}
+	var args []interface{}
+	addCond := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+
+	if query.Filter.Anonymous != nil {
+		addCond("anonymous = $%d", *query.Filter.Anonymous)
+	}
+	if query.Filter.AgeGTE != nil {
+		addCond("age >= $%d", *query.Filter.AgeGTE)
+	}
+	if query.Filter.AgeLTE != nil {
+		addCond("age <= $%d", *query.Filter.AgeLTE)
+	}
+
+	direction, cmp := "ASC", ">"
+	if sort.desc {
+		direction, cmp = "DESC", "<"
+	}
+	if query.Cursor != "" {
+		cursor, err := decodeUserCursor(query.Cursor, sort)
+		if err != nil {
+			return models.UserPage{}, err
+		}
+		value, err := sort.parseValue(cursor.Value)
+		if err != nil {
+			return models.UserPage{}, errors.Wrap(apperr.ErrInvalidArgument, "invalid cursor")
+		}
+		args = append(args, value, cursor.ID)
+		where = append(where, fmt.Sprintf("(%s, id) %s ($%d, $%d)", sort.column, cmp, len(args)-1, len(args)))
+	}
+
+	sql := "SELECT id, name, age, anonymous, version, created_at, updated_at FROM users WHERE " + strings.Join(where, " AND ")
+	args = append(args, limit+1)
+	sql += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", sort.column, direction, direction, len(args))
+
+	span.SetAttributes(
+		attribute.String("db.query", sql),
+		attribute.String("db.params.sort", sort.String()),
+		attribute.Int("db.params.limit", limit),
+		attribute.String("db.system", "postgres"),
+	)
+
+	start := time.Now()
+	rows, err := u.readDB(ctx).Query(ctx, sql, args...)
+	if err != nil {
+		return models.UserPage{}, classifyError(errors.Wrap(err, "failed to list users"))
+	}
+	defer rows.Close()
+
+	users := make([]*models.User, 0, limit+1)
+	for rows.Next() {
+		userData := &models.User{}
+		if err := rows.Scan(&userData.ID, &userData.Name, &userData.Age, &userData.Anonymous,
+			&userData.Version, &userData.CreatedAt, &userData.UpdatedAt); err != nil {
+			return models.UserPage{}, errors.Wrap(err, "failed to scan user")
+		}
+		users = append(users, userData)
+	}
+	err = rows.Err()
+
+	duration := time.Since(start)
+
+	span.SetAttributes(
+		attribute.Int64("db.duration_ms", duration.Milliseconds()),
+		attribute.Bool("db.success", err == nil),
+	)
+
+	if err != nil {
+		return models.UserPage{}, classifyError(errors.Wrap(err, "failed to list users"))
+	}
+
+	page := models.UserPage{Users: users}
+	if len(users) > limit {
+		page.Users = users[:limit]
+		page.NextCursor = encodeUserCursor(sort, page.Users[limit-1])
+	}
+	return page, nil
 }
@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const defaultTxRetryBackoff = 20 * time.Millisecond
+
+// SQLSTATEs of transactions that failed only because of concurrent ones and
+// succeed when run again.
+const (
+	serializationFailure = "40001"
+	deadlockDetected     = "40P01"
+)
+
+// querier runs statements on the pool or on the transaction carried by the
+// context. BeginFunc on a transaction starts a savepoint, so repository
+// methods that need their own transaction nest into the caller's.
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+	BeginFunc(ctx context.Context, f func(pgx.Tx) error) error
+}
+
+type txKey struct{}
+
+// txState is the transaction of a WithinTx call and the hooks that run once
+// it is committed.
+type txState struct {
+	tx          pgx.Tx
+	afterCommit []func()
+}
+
+func txFromContext(ctx context.Context) (*txState, bool) {
+	state, ok := ctx.Value(txKey{}).(*txState)
+	return state, ok
+}
+
+// InTx reports whether ctx carries a transaction started by WithinTx.
+func InTx(ctx context.Context) bool {
+	_, ok := txFromContext(ctx)
+	return ok
+}
+
+// AfterCommit runs fn once the transaction carried by ctx is committed, and
+// never if it is rolled back. Without a transaction fn runs right away.
+func AfterCommit(ctx context.Context, fn func()) {
+	if state, ok := txFromContext(ctx); ok {
+		state.afterCommit = append(state.afterCommit, fn)
+		return
+	}
+	fn()
+}
+
+// TxManager runs units of work in a single transaction. Repository methods
+// called with the context passed to the unit of work use its transaction.
+type TxManager struct {
+	pool         *pgxpool.Pool
+	isoLevel     pgx.TxIsoLevel
+	maxRetries   int
+	retryBackoff time.Duration
+}
+
+func NewTxManager(pool *pgxpool.Pool, cfg config.Tx) (*TxManager, error) {
+	isoLevel, err := parseIsoLevel(cfg.IsolationLevel)
+	if err != nil {
+		return nil, err
+	}
+	maxRetries := cfg.MaxRetries
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	retryBackoff := cfg.RetryBackoff
+	if retryBackoff <= 0 {
+		retryBackoff = defaultTxRetryBackoff
+	}
+
+	return &TxManager{
+		pool:         pool,
+		isoLevel:     isoLevel,
+		maxRetries:   maxRetries,
+		retryBackoff: retryBackoff,
+	}, nil
+}
+
+// parseIsoLevel accepts the isolation levels of Postgres written with
+// spaces or underscores, empty keeps the server default.
+func parseIsoLevel(level string) (pgx.TxIsoLevel, error) {
+	isoLevel := pgx.TxIsoLevel(strings.ToLower(strings.ReplaceAll(level, "_", " ")))
+	switch isoLevel {
+	case "", pgx.ReadCommitted, pgx.RepeatableRead, pgx.Serializable:
+		return isoLevel, nil
+	default:
+		return "", errors.Errorf("unknown transaction isolation level %q", level)
+	}
+}
+
+// WithinTx runs fn in a transaction and commits it when fn succeeds. A
+// transaction that fails on a serialization failure or a deadlock is rolled
+// back and fn runs again, up to the configured number of retries, so fn must
+// not have effects outside the database; use AfterCommit for those. Called
+// within another unit of work, fn joins its transaction. The transaction
+// belongs to one goroutine, fn must not share ctx with others.
+func (m *TxManager) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	if InTx(ctx) {
+		return fn(ctx)
+	}
+
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "TxManager.WithinTx")
+	defer span.End()
+	span.SetAttributes(attribute.String("db.isolation_level", string(m.isoLevel)))
+
+	backoff := m.retryBackoff
+	for attempt := 0; ; attempt++ {
+		state := &txState{}
+		err := m.pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: m.isoLevel}, func(tx pgx.Tx) error {
+			state.tx = tx
+			return fn(context.WithValue(ctx, txKey{}, state))
+		})
+		if err == nil {
+			span.SetAttributes(attribute.Int("db.tx.retries", attempt))
+			for _, hook := range state.afterCommit {
+				hook()
+			}
+			return nil
+		}
+		if !isRetryable(err) || attempt >= m.maxRetries {
+			span.SetAttributes(attribute.Int("db.tx.retries", attempt))
+			return err
+		}
+
+		log.Warn().Err(err).Msgf("retrying transaction in %s, attempt %d of %d", backoff, attempt+1, m.maxRetries)
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "transaction retry canceled")
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func isRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == serializationFailure || pgErr.Code == deadlockDetected
+}
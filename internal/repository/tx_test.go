@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIsoLevel(t *testing.T) {
+	testCases := []struct {
+		name    string
+		level   string
+		want    pgx.TxIsoLevel
+		wantErr bool
+	}{
+		{name: "по умолчанию", level: "", want: ""},
+		{name: "через подчёркивание", level: "repeatable_read", want: pgx.RepeatableRead},
+		{name: "как в postgres", level: "SERIALIZABLE", want: pgx.Serializable},
+		{name: "неизвестный уровень", level: "snapshot", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseIsoLevel(tc.level)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "сбой сериализации", err: &pgconn.PgError{Code: serializationFailure}, want: true},
+		{name: "обёрнутая взаимоблокировка", err: errors.Wrap(&pgconn.PgError{Code: deadlockDetected}, "update"), want: true},
+		{name: "нарушение уникальности", err: &pgconn.PgError{Code: "23505"}, want: false},
+		{name: "не ошибка postgres", err: context.Canceled, want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.want, isRetryable(tc.err))
+		})
+	}
+}
+
+func TestAfterCommit(t *testing.T) {
+	t.Log("Без транзакции функция выполняется сразу\n")
+	var calls int
+	AfterCommit(context.Background(), func() { calls++ })
+	require.Equal(t, 1, calls)
+
+	t.Log("В транзакции функция откладывается до коммита\n")
+	state := &txState{}
+	ctx := context.WithValue(context.Background(), txKey{}, state)
+	require.True(t, InTx(ctx))
+	AfterCommit(ctx, func() { calls++ })
+	require.Equal(t, 1, calls)
+	require.Len(t, state.afterCommit, 1)
+}
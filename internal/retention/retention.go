@@ -0,0 +1,76 @@
+package retention
+
+import (
+	"context"
+	"time"
+
+	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultDays     = 30
+	defaultInterval = time.Hour
+)
+
+type Purger interface {
+	PurgeDeletedUsers(ctx context.Context, before time.Time) (int64, error)
+}
+
+// UserPurger permanently removes users that were soft-deleted more than the
+// configured number of days ago. Until then they can be restored.
+type UserPurger struct {
+	purger   Purger
+	period   time.Duration
+	interval time.Duration
+}
+
+func NewUserPurger(purger Purger, cfg config.Retention) *UserPurger {
+	days := cfg.Days
+	if days <= 0 {
+		days = defaultDays
+	}
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	return &UserPurger{
+		purger:   purger,
+		period:   time.Duration(days) * 24 * time.Hour,
+		interval: interval,
+	}
+}
+
+// Start purges once right away and then every interval until ctx is done.
+func (p *UserPurger) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		for {
+			p.purge(ctx)
+
+			select {
+			case <-ctx.Done():
+				log.Info().Msg("user purger shutting down...")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (p *UserPurger) purge(ctx context.Context) {
+	before := time.Now().Add(-p.period)
+	purged, err := p.purger.PurgeDeletedUsers(ctx, before)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Err(err).Msg("failed to purge deleted users")
+		}
+		return
+	}
+	if purged > 0 {
+		log.Info().Msgf("purged %d users deleted before %s", purged, before.Format(time.RFC3339))
+	}
+}
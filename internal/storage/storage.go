@@ -3,9 +3,15 @@ package storage
 import (
 	"context"
 
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 )
 
+// OriginSetting is the session setting that names the gateway which opened
+// the connection. The users_notify_change trigger sends it along with the
+// changed id, so a gateway can tell its own writes apart.
+const OriginSetting = "gateway.origin"
+
 func GetConnect(connString string) (*pgxpool.Pool, error) {
 	pool, err := pgxpool.Connect(context.Background(), connString)
 	if err != nil {
@@ -14,3 +20,30 @@ func GetConnect(connString string) (*pgxpool.Pool, error) {
 
 	return pool, nil
 }
+
+// GetOriginConnect is GetConnect for a pool whose sessions set
+// OriginSetting to origin.
+func GetOriginConnect(connString, origin string) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		_, err := conn.Exec(ctx, "SELECT set_config($1, $2, false)", OriginSetting, origin)
+		return err
+	}
+
+	return pgxpool.ConnectConfig(context.Background(), cfg)
+}
+
+// GetLazyConnect builds a pool that connects on first use, so an unreachable
+// database does not fail the start.
+func GetLazyConnect(connString string) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, err
+	}
+	cfg.LazyConnect = true
+
+	return pgxpool.ConnectConfig(context.Background(), cfg)
+}
@@ -8,8 +8,24 @@ import (
 )
 
 type UserProvider interface {
-	GetUser(ctx context.Context, id string) (*models.User, error)
+	GetUser(ctx context.Context, id string) (*models.User, bool, error)
 	CreateUser(ctx context.Context, userReq models.UserRequest) (uuid.UUID, error)
-	UpdateUser(ctx context.Context, id string, userReq models.UserRequest) (*models.User, error)
-	DeleteUser(ctx context.Context, id string) error
+	UpdateUser(ctx context.Context, id string, userReq models.UserRequest, version int64) (*models.User, error)
+	PatchUser(ctx context.Context, id string, patch models.UserPatch, version int64) (*models.User, error)
+	PatchUserWith(ctx context.Context, id string, version int64, diff func(current *models.User) (models.UserPatch, error)) (*models.User, error)
+	DeleteUser(ctx context.Context, id string, version int64) error
+	RestoreUser(ctx context.Context, id string) (*models.User, error)
+	ListUsers(ctx context.Context, query models.UserListQuery) (models.UserPage, error)
+	SearchUsers(ctx context.Context, query models.UserSearchQuery) ([]*models.User, error)
+	GetUserHistory(ctx context.Context, id string, query models.UserHistoryQuery) (models.UserHistoryPage, error)
+	CreateUsers(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, error)
+	CreateUsersPartially(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, []error, error)
+	GetUsers(ctx context.Context, ids []string) ([]*models.User, error)
+	DeleteUsers(ctx context.Context, ids []string) ([]string, error)
+}
+
+// Transactor runs fn in a transaction, the writes fn makes through the
+// context it is given are committed or rolled back together.
+type Transactor interface {
+	WithinTx(ctx context.Context, fn func(ctx context.Context) error) error
 }
@@ -4,28 +4,45 @@ import (
 	"context"
 
 	"github.com/dankru/Api_gateway_v2/config"
+	"github.com/dankru/Api_gateway_v2/internal/apperr"
 	"github.com/dankru/Api_gateway_v2/internal/models"
 	"github.com/dankru/Api_gateway_v2/internal/repository"
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"go.opentelemetry.io/otel"
 )
 
 type UserUsecase struct {
 	repo repository.UserProvider
+	tx   Transactor
 }
 
-func NewUserUsecase(repo repository.UserProvider) *UserUsecase {
+func NewUserUsecase(repo repository.UserProvider, tx Transactor) *UserUsecase {
 	return &UserUsecase{
 		repo: repo,
+		tx:   tx,
 	}
 }
 
-func (u *UserUsecase) GetUser(ctx context.Context, id string) (*models.User, error) {
+// WithinTx runs fn in a transaction. Use cases passing the context fn is given
+// to the repository make their writes atomically; fn may run more than once
+// when the transaction is retried.
+func (u *UserUsecase) WithinTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.WithinTx")
+	defer span.End()
+	return u.tx.WithinTx(ctx, fn)
+}
+
+// GetUser returns the user and whether it is stale: served by the cache past
+// its TTL because the database failed.
+func (u *UserUsecase) GetUser(ctx context.Context, id string) (*models.User, bool, error) {
 	tracer := otel.Tracer(config.AppName)
 	ctx, span := tracer.Start(ctx, "UserService.GetUser")
 	defer span.End()
+	ctx, freshness := repository.TrackFreshness(ctx)
 	user, err := u.repo.GetUser(ctx, id)
-	return user, err
+	return user, *freshness == repository.Stale, err
 }
 
 func (u *UserUsecase) CreateUser(ctx context.Context, userReq models.UserRequest) (uuid.UUID, error) {
@@ -35,17 +52,119 @@ func (u *UserUsecase) CreateUser(ctx context.Context, userReq models.UserRequest
 	return u.repo.CreateUser(ctx, userReq)
 }
 
-func (u *UserUsecase) UpdateUser(ctx context.Context, id string, userReq models.UserRequest) (*models.User, error) {
+func (u *UserUsecase) UpdateUser(ctx context.Context, id string, userReq models.UserRequest, version int64) (*models.User, error) {
 	tracer := otel.Tracer(config.AppName)
 	ctx, span := tracer.Start(ctx, "UserService.UpdateUser")
 	defer span.End()
-	user, err := u.repo.UpdateUser(ctx, id, userReq)
+	user, err := u.repo.UpdateUser(ctx, id, userReq, version)
 	return user, err
 }
 
-func (u *UserUsecase) DeleteUser(ctx context.Context, id string) error {
+func (u *UserUsecase) PatchUser(ctx context.Context, id string, patch models.UserPatch, version int64) (*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.PatchUser")
+	defer span.End()
+	return u.repo.PatchUser(ctx, id, patch, version)
+}
+
+// maxPatchAttempts bounds how often PatchUserWith reads a user again when it
+// changed between the read and the write.
+const maxPatchAttempts = 3
+
+// PatchUserWith writes the fields diff derives from the stored user. The user
+// is read past the cache, in the transaction that writes it, and the write
+// only succeeds if the user still has the version read, so a patch is never
+// merged into a stale copy. A non-zero version is the version the client
+// expects. Without one, a user that changed in between is read again.
+func (u *UserUsecase) PatchUserWith(ctx context.Context, id string, version int64, diff func(current *models.User) (models.UserPatch, error)) (*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.PatchUserWith")
+	defer span.End()
+
+	for attempt := 1; ; attempt++ {
+		var user *models.User
+		err := u.tx.WithinTx(ctx, func(ctx context.Context) error {
+			current, err := u.repo.GetUser(ctx, id)
+			if err != nil {
+				return err
+			}
+			if version != 0 && current.Version != version {
+				return apperr.ErrPreconditionFailed
+			}
+
+			patch, err := diff(current)
+			if err != nil {
+				return err
+			}
+			user, err = u.repo.PatchUser(ctx, id, patch, current.Version)
+			return err
+		})
+		if version == 0 && errors.Is(err, apperr.ErrPreconditionFailed) && attempt < maxPatchAttempts {
+			continue
+		}
+		return user, err
+	}
+}
+
+func (u *UserUsecase) DeleteUser(ctx context.Context, id string, version int64) error {
 	tracer := otel.Tracer(config.AppName)
 	ctx, span := tracer.Start(ctx, "UserService.DeleteUser")
 	defer span.End()
-	return u.repo.DeleteUser(ctx, id)
+	return u.repo.DeleteUser(ctx, id, version)
+}
+
+func (u *UserUsecase) RestoreUser(ctx context.Context, id string) (*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.RestoreUser")
+	defer span.End()
+	return u.repo.RestoreUser(ctx, id)
+}
+
+func (u *UserUsecase) ListUsers(ctx context.Context, query models.UserListQuery) (models.UserPage, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.ListUsers")
+	defer span.End()
+	return u.repo.ListUsers(ctx, query)
+}
+
+func (u *UserUsecase) SearchUsers(ctx context.Context, query models.UserSearchQuery) ([]*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.SearchUsers")
+	defer span.End()
+	return u.repo.SearchUsers(ctx, query)
+}
+
+func (u *UserUsecase) GetUserHistory(ctx context.Context, id string, query models.UserHistoryQuery) (models.UserHistoryPage, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.GetUserHistory")
+	defer span.End()
+	return u.repo.GetUserHistory(ctx, id, query)
+}
+
+func (u *UserUsecase) CreateUsers(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.CreateUsers")
+	defer span.End()
+	return u.repo.CreateUsers(ctx, userReqs)
+}
+
+func (u *UserUsecase) CreateUsersPartially(ctx context.Context, userReqs []models.UserRequest) ([]uuid.UUID, []error, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.CreateUsersPartially")
+	defer span.End()
+	return u.repo.CreateUsersPartially(ctx, userReqs)
+}
+
+func (u *UserUsecase) GetUsers(ctx context.Context, ids []string) ([]*models.User, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.GetUsers")
+	defer span.End()
+	return u.repo.GetUsers(ctx, ids)
+}
+
+func (u *UserUsecase) DeleteUsers(ctx context.Context, ids []string) ([]string, error) {
+	tracer := otel.Tracer(config.AppName)
+	ctx, span := tracer.Start(ctx, "UserService.DeleteUsers")
+	defer span.End()
+	return u.repo.DeleteUsers(ctx, ids)
 }